@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var bootstrapTargetCmd = &cobra.Command{
+	Use:   "bootstrap-target --pool <pool> [flags] <vdev>...",
+	Short: "Create a backup pool and target filesystem on empty disks",
+	Long: `Create a new backup pool from the given vdevs with properties suited to
+backups (ashift=12, autotrim, lz4 compression, atime=off, xattr=sa and an
+unmounted root), then create the target filesystem and its parents.
+
+The vdevs are passed to zpool create as is, so "mirror /dev/sdb /dev/sdc"
+creates a mirror. Use -T 'ssh host zfs' to set up a remote host; zpool is
+run the same way as the target command. Disks that are in use or carry a
+pool label are refused by zpool.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pool, _ := cmd.Flags().GetString("pool")
+		if pool == "" {
+			return fmt.Errorf("--pool is required")
+		}
+		if !cmd.Flags().Changed("target-fs") {
+			cmd.Flags().Set("target-fs", pool)
+		}
+		targetfs, _ := cmd.Flags().GetString("target-fs")
+		if targetfs != pool && !strings.HasPrefix(targetfs, pool+"/") {
+			return fmt.Errorf("target filesystem %s is not in pool %s", targetfs, pool)
+		}
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		if err := b.BootstrapTarget(pool, args); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Created pool %s with target %s\n", pool, targetfs)
+		return nil
+	},
+}
+
+func init() {
+	addBackupFlags(bootstrapTargetCmd.Flags())
+	registerBackupCompletions(bootstrapTargetCmd)
+	bootstrapTargetCmd.Flags().String("pool", "", "Name of the pool to create")
+	rootCmd.AddCommand(bootstrapTargetCmd)
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var cleanupCmd = &cobra.Command{
+	Use:   "cleanup [flags]",
+	Short: "Repair what a crashed run left behind, using its --journal",
+	Long: `Look up the changes that were in flight when an earlier run died in the
+intent journal given with --journal, and repair what they left behind:
+interrupted holds are placed or released according to --hold-target, and
+snapshots the run took that never reached the target are destroyed on
+the source. Only snapshots
+named in the journal are touched.
+
+Every action is listed first; with --dry-run nothing else happens. Once
+all actions succeed the stale journal entries are cleared. Entries that
+can't be repaired automatically are listed to be checked by hand, and
+the journal is then left for zfsbackup journal --clear.
+
+Give the same flags as the backup, so the same target and commands are
+used.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		journalFile, _ := cmd.Flags().GetString("journal")
+		if journalFile == "" {
+			return fmt.Errorf("cleanup needs --journal")
+		}
+		dryrun, _ := cmd.Flags().GetBool("dry-run")
+		readOnly, _ := cmd.Flags().GetBool("read-only")
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		actions, err := b.PlanCleanup()
+		if err != nil {
+			return err
+		}
+		w := cmd.OutOrStdout()
+		if len(actions) == 0 {
+			fmt.Fprintln(w, "Nothing to clean up")
+		}
+		manual := 0
+		for _, a := range actions {
+			if a.Manual {
+				manual++
+			}
+			fmt.Fprintf(w, "  %s\n", a)
+		}
+		if dryrun || readOnly {
+			return nil
+		}
+
+		var errs []error
+		for _, a := range actions {
+			if err := a.Apply(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", a, err))
+			}
+		}
+		if len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+		if manual > 0 {
+			return fmt.Errorf("%d change(s) need to be checked by hand, then run zfsbackup journal --clear %s", manual, journalFile)
+		}
+		n, err := zfs.ClearJournal(journalFile)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Cleared %d stale journal entries\n", n)
+		return nil
+	},
+}
+
+func init() {
+	addBackupFlags(cleanupCmd.Flags())
+	registerBackupCompletions(cleanupCmd)
+	rootCmd.AddCommand(cleanupCmd)
+}
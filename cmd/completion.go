@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// listDatasets lists all filesystems and volumes with the zfs command in
+// the named command flag of cmd, for shell completion.
+func listDatasets(cmd *cobra.Command, commandFlag string) []string {
+	cmdStr, _ := cmd.Flags().GetString(commandFlag)
+	zfsCmd := strings.Fields(cmdStr)
+	if len(zfsCmd) == 0 {
+		return nil
+	}
+	args := append(slices.Clone(zfsCmd[1:]), "list", "-H", "-o", "name", "-t", "filesystem,volume")
+	out, err := exec.Command(zfsCmd[0], args...).Output()
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+// completeDatasets returns a completion function for dataset names listed
+// with the zfs command in commandFlag. If recursive is set, "/..." variants
+// are offered too, for recursive sources. At most maxArgs arguments are
+// completed, or any number if maxArgs is 0.
+func completeDatasets(commandFlag string, recursive bool, maxArgs int) cobra.CompletionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if maxArgs > 0 && len(args) >= maxArgs {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		var names []string
+		for _, ds := range listDatasets(cmd, commandFlag) {
+			if !strings.HasPrefix(ds, toComplete) {
+				continue
+			}
+			names = append(names, ds)
+			if recursive {
+				names = append(names, ds+"/...")
+			}
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
+// registerBackupCompletions registers dynamic completions for the flags
+// added by addBackupFlags.
+func registerBackupCompletions(cmd *cobra.Command) {
+	cmd.RegisterFlagCompletionFunc("target-fs", completeDatasets("target-command", false, 0))
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.yaml.in/yaml/v3"
+)
+
+// config is the file given with --config.
+type config struct {
+	// Templates are named sets of backup flags that jobs can start from.
+	Templates map[string]map[string]any `yaml:"templates"`
+	Jobs      []jobConfig               `yaml:"jobs"`
+}
+
+// jobConfig is one backup job: its sources and any backup flags, by long
+// name, e.g. "target-command: ssh backuphost zfs" or "label: [a=b]".
+type jobConfig struct {
+	Name    string   `yaml:"name"`
+	Sources []string `yaml:"sources"`
+	// Template names the template whose flags the job starts from; its
+	// own flags override the template's.
+	Template string         `yaml:"template"`
+	Flags    map[string]any `yaml:",inline"`
+}
+
+// loadConfig reads and checks a config file.
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if len(c.Jobs) == 0 {
+		return nil, fmt.Errorf("%s defines no jobs", path)
+	}
+	for i, job := range c.Jobs {
+		if job.Name == "" {
+			return nil, fmt.Errorf("%s: job %d has no name", path, i+1)
+		}
+		if len(job.Sources) == 0 {
+			return nil, fmt.Errorf("%s: job %s has no sources", path, job.Name)
+		}
+		if job.Template == "" {
+			continue
+		}
+		tmpl, ok := c.Templates[job.Template]
+		if !ok {
+			return nil, fmt.Errorf("%s: job %s uses unknown template %q", path, job.Name, job.Template)
+		}
+		flags := maps.Clone(tmpl)
+		maps.Copy(flags, job.Flags)
+		c.Jobs[i].Flags = flags
+	}
+	return &c, nil
+}
+
+// jobCommand returns a command whose backup flags are set from job, and
+// then from the flags given on the command line of cmd, which override
+// the file, so e.g. --dry-run applies to every job. The owner defaults to
+// the job name, so jobs sharing a source don't prune each other's
+// snapshots.
+func jobCommand(cmd *cobra.Command, job jobConfig) (*cobra.Command, error) {
+	jobCmd := &cobra.Command{Use: job.Name}
+	jobCmd.SetOut(cmd.OutOrStdout())
+	jobCmd.SetErr(cmd.ErrOrStderr())
+	flags := jobCmd.Flags()
+	addBackupFlags(flags)
+	flags.AddFlag(cmd.Flags().Lookup("debug"))
+	flags.AddFlag(cmd.Flags().Lookup("read-only"))
+
+	if err := flags.Set("owner", job.Name); err != nil {
+		return nil, fmt.Errorf("invalid owner: %w", err)
+	}
+	for name, value := range job.Flags {
+		if flags.Lookup(name) == nil {
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			if err := flags.Set(name, fmt.Sprint(v)); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	var err error
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if err != nil || f.Name == "config" || flags.Lookup(f.Name) == f {
+			return
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			for _, v := range sv.GetSlice() {
+				if err = flags.Set(f.Name, v); err != nil {
+					return
+				}
+			}
+			return
+		}
+		err = flags.Set(f.Name, f.Value.String())
+	})
+	return jobCmd, err
+}
+
+// runConfig runs every job of the config file at path in order. A failed
+// job doesn't stop the others; all failures are returned together.
+func runConfig(cmd *cobra.Command, path string) error {
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	var jobs []*configJob
+	var errs []error
+	for _, job := range c.Jobs {
+		j, err := newConfigJob(cmd, job)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %w", job.Name, err))
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	if err := checkJobOwners(jobs); err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if err := j.run(); err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %w", j.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// configJob is a job of the config file, ready to run.
+type configJob struct {
+	jobConfig
+	cmd     *cobra.Command
+	sources []zfs.Source
+	owner   string
+}
+
+func newConfigJob(cmd *cobra.Command, job jobConfig) (*configJob, error) {
+	var sources []zfs.Source
+	for _, arg := range job.Sources {
+		src, err := zfs.ParseSource(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source %q: %w", arg, err)
+		}
+		sources = append(sources, src)
+	}
+	jobCmd, err := jobCommand(cmd, job)
+	if err != nil {
+		return nil, err
+	}
+	owner, _ := jobCmd.Flags().GetString("owner")
+	return &configJob{jobConfig: job, cmd: jobCmd, sources: sources, owner: owner}, nil
+}
+
+// checkJobOwners refuses jobs that share an owner and a source dataset:
+// each would prune the snapshots the other's next incremental needs.
+func checkJobOwners(jobs []*configJob) error {
+	for i, a := range jobs {
+		for _, b := range jobs[i+1:] {
+			if a.owner != b.owner {
+				continue
+			}
+			for _, sa := range a.sources {
+				for _, sb := range b.sources {
+					if sa.Overlaps(sb) {
+						return fmt.Errorf("jobs %s and %s both back up %s with owner %q: give them different owners", a.Name, b.Name, sa, a.owner)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (j *configJob) run() error {
+	b, closeBackup, err := newBackup(j.cmd, zfs.WithJobOption(j.Name))
+	if err != nil {
+		return err
+	}
+	defer closeBackup()
+
+	fmt.Printf("Job %s, backing up to %s:\n", j.Name, b.Target())
+	for _, src := range j.sources {
+		fmt.Printf("  %s\n", src)
+	}
+	err = b.RunBackup(j.sources)
+	printResults(j.cmd.OutOrStdout(), b.Results())
+	return err
+}
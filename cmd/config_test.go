@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// testRootCommand returns a command with the root command's flags, parsed
+// from args.
+func testRootCommand(t *testing.T, args ...string) *cobra.Command {
+	t.Helper()
+	cmd := &cobra.Command{Use: "zfsbackup"}
+	flags := cmd.Flags()
+	addBackupFlags(flags)
+	flags.BoolP("debug", "d", false, "")
+	flags.Bool("read-only", false, "")
+	flags.String("config", "", "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		jobs    int
+		wantErr bool
+	}{
+		{"jobs", "jobs:\n  - name: local\n    sources: [tank/data]\n  - name: offsite\n    sources: [tank/data]\n    target-fs: offsite\n", 2, false},
+		{"no jobs", "jobs: []\n", 0, true},
+		{"no name", "jobs:\n  - sources: [tank/data]\n", 0, true},
+		{"no sources", "jobs:\n  - name: local\n", 0, true},
+		{"invalid yaml", "jobs: [\n", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "zfsbackup.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig: %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(c.Jobs) != tt.jobs {
+				t.Errorf("%d jobs, want %d", len(c.Jobs), tt.jobs)
+			}
+		})
+	}
+}
+
+// TestJobCommand checks that the flags given on the command line override
+// those of the job.
+func TestJobCommand(t *testing.T) {
+	cmd := testRootCommand(t, "--dry-run", "--target-fs", "cli", "--label", "a=1")
+	job := jobConfig{
+		Name:    "offsite",
+		Sources: []string{"tank/data"},
+		Flags:   map[string]any{"target-fs": "offsite", "max-datasets": 3, "label": []any{"b=2"}},
+	}
+	jobCmd, err := jobCommand(cmd, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := jobCmd.Flags()
+	if v, _ := flags.GetString("target-fs"); v != "cli" {
+		t.Errorf("target-fs = %q, want %q", v, "cli")
+	}
+	if v, _ := flags.GetInt("max-datasets"); v != 3 {
+		t.Errorf("max-datasets = %d, want 3", v)
+	}
+	if v, _ := flags.GetBool("dry-run"); !v {
+		t.Error("dry-run not set from the command line")
+	}
+	if v, _ := flags.GetStringArray("label"); len(v) != 2 {
+		t.Errorf("label = %q, want both the job's and the command line's", v)
+	}
+
+	job.Flags = map[string]any{"no-such-flag": true}
+	if _, err := jobCommand(cmd, job); err == nil {
+		t.Error("unknown option accepted")
+	}
+}
+
+func TestConfigJobOwners(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		jobs    []jobConfig
+		owners  []string
+		wantErr bool
+	}{
+		{
+			name: "default owners",
+			jobs: []jobConfig{
+				{Name: "local", Sources: []string{"tank/data/..."}},
+				{Name: "offsite", Sources: []string{"tank/data/db"}},
+			},
+			owners: []string{"local", "offsite"},
+		},
+		{
+			name: "shared owner on overlapping sources",
+			jobs: []jobConfig{
+				{Name: "local", Sources: []string{"tank/data/..."}, Flags: map[string]any{"owner": "zfsbackup"}},
+				{Name: "offsite", Sources: []string{"tank/data/db"}, Flags: map[string]any{"owner": "zfsbackup"}},
+			},
+			owners:  []string{"zfsbackup", "zfsbackup"},
+			wantErr: true,
+		},
+		{
+			name: "shared owner on separate sources",
+			jobs: []jobConfig{
+				{Name: "data", Sources: []string{"tank/data/..."}, Flags: map[string]any{"owner": "zfsbackup"}},
+				{Name: "home", Sources: []string{"tank/home"}, Flags: map[string]any{"owner": "zfsbackup"}},
+			},
+			owners: []string{"zfsbackup", "zfsbackup"},
+		},
+		{
+			name: "owner on the command line",
+			args: []string{"--owner", "all"},
+			jobs: []jobConfig{
+				{Name: "local", Sources: []string{"tank/data"}},
+				{Name: "offsite", Sources: []string{"tank/data"}},
+			},
+			owners:  []string{"all", "all"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := testRootCommand(t, tt.args...)
+			var jobs []*configJob
+			for i, job := range tt.jobs {
+				j, err := newConfigJob(cmd, job)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if j.owner != tt.owners[i] {
+					t.Errorf("job %s: owner %q, want %q", job.Name, j.owner, tt.owners[i])
+				}
+				jobs = append(jobs, j)
+			}
+			if err := checkJobOwners(jobs); (err != nil) != tt.wantErr {
+				t.Errorf("checkJobOwners: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
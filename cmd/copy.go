@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var copyCmd = &cobra.Command{
+	Use:   "copy --from <root> --to <root> [flags] <dataset>",
+	Short: "Copy a backup chain between targets",
+	Long: `Copy the snapshot chain of <from>/<dataset> to <to>/<dataset>, one
+snapshot at a time, e.g. to replay stream files archived with
+--file-target into a live pool for a fast restore, or to move a ZFS
+backup out to stream files.
+
+A root of the form file:<dir> is a directory of stream files as written
+by --file-target. Any other root is a ZFS filesystem, read with the
+source command for --from and written with the target command for --to.
+If the destination already has part of the chain, copying continues
+after the latest snapshot in common.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		if from == "" || to == "" {
+			return fmt.Errorf("--from and --to are required")
+		}
+		dataset := strings.Trim(args[0], "/")
+
+		fromVol, toVol := dataset, dataset
+		var extra []zfs.BackupOption
+		if dir, ok := strings.CutPrefix(from, "file:"); ok {
+			extra = append(extra, zfs.WithFileSourceOption(dir))
+		} else {
+			fromVol = from + "/" + dataset
+		}
+		if dir, ok := strings.CutPrefix(to, "file:"); ok {
+			cmd.Flags().Set("file-target", dir)
+		} else {
+			toVol = to + "/" + dataset
+			cmd.Flags().Set("target-fs", to)
+		}
+
+		b, closeBackup, err := newBackup(cmd, extra...)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Copying %s to %s\n", from+"/"+dataset, to+"/"+dataset)
+		return b.Copy(fromVol, toVol)
+	},
+}
+
+func init() {
+	addBackupFlags(copyCmd.Flags())
+	registerBackupCompletions(copyCmd)
+	copyCmd.Flags().String("from", "", "Root to copy from: a ZFS filesystem or file:<dir>")
+	copyCmd.Flags().String("to", "", "Root to copy to: a ZFS filesystem or file:<dir>")
+	rootCmd.AddCommand(copyCmd)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/jamesmcdonald/zfsbackup/util"
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var estimateCmd = &cobra.Command{
+	Use:   "estimate [flags] <source> [<source>...]",
+	Short: "Estimate how much data a backup would transfer",
+	Long: `Report how much data an incremental (or full) backup of each dataset
+would transfer right now, and the total, without creating snapshots or
+sending anything.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var sources []zfs.Source
+		for _, arg := range args {
+			src, err := zfs.ParseSource(arg)
+			if err != nil {
+				return fmt.Errorf("invalid source %q: %w", arg, err)
+			}
+			sources = append(sources, src)
+		}
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		estimates, err := b.Estimate(sources)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DATASET\tTYPE\tBASE\tSIZE")
+		var total int64
+		for _, e := range estimates {
+			kind, base := "incremental", e.Base
+			if base == "" {
+				kind, base = "full", "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Dataset, kind, base, util.HumanBytes(e.Bytes))
+			total += e.Bytes
+		}
+		fmt.Fprintf(w, "TOTAL\t\t\t%s\n", util.HumanBytes(total))
+		return w.Flush()
+	},
+}
+
+func init() {
+	addBackupFlags(estimateCmd.Flags())
+	registerBackupCompletions(estimateCmd)
+	estimateCmd.ValidArgsFunction = completeDatasets("source-command", true, 0)
+	rootCmd.AddCommand(estimateCmd)
+}
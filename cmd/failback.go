@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var failbackCmd = &cobra.Command{
+	Use:   "failback [flags] <promoted-dataset> <original-dataset>",
+	Short: "Replicate a promoted backup copy back to the original host",
+	Long: `Reverse replication after a failover: snapshot the promoted dataset, read
+with the target command, and send it incrementally to the original
+dataset, written with the source command, from the latest snapshot they
+have in common.
+
+Failback refuses to run if the original dataset has snapshots newer than
+that snapshot, or has been written to since, as receiving would roll
+those changes back. On success the primary mark set by promote is
+cleared, so scheduled backups resume from the failback snapshot.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		promoted, original := args[0], args[1]
+		cmd.Flags().Set("target-fs", promoted)
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		if err := b.Failback(promoted, original); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Failed back %s to %s\n", promoted, original)
+		return nil
+	},
+}
+
+func init() {
+	addBackupFlags(failbackCmd.Flags())
+	registerBackupCompletions(failbackCmd)
+	failbackCmd.ValidArgsFunction = func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 0 {
+			return completeDatasets("target-command", false, 1)(cmd, args, toComplete)
+		}
+		return completeDatasets("source-command", false, 2)(cmd, args, toComplete)
+	}
+	rootCmd.AddCommand(failbackCmd)
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Interactively set up a scheduled backup",
+	Long: `Walk through choosing the sources, the target and a schedule, checking
+each answer against the live system, and write a systemd service and
+timer that run the backup.
+
+The units are written to the current directory by default. Copy them to
+/etc/systemd/system and enable the timer with
+systemctl enable --now zfsbackup.timer.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := refuseReadOnly(cmd); err != nil {
+			return err
+		}
+		dir, _ := cmd.Flags().GetString("dir")
+		w := &wizard{in: bufio.NewScanner(cmd.InOrStdin()), out: cmd.OutOrStdout()}
+		return w.run(dir)
+	},
+}
+
+type wizard struct {
+	in  *bufio.Scanner
+	out io.Writer
+}
+
+// ask prompts for an answer, returning def if the answer is empty.
+func (w *wizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	if !w.in.Scan() {
+		if err := w.in.Err(); err != nil {
+			return "", err
+		}
+		return "", io.ErrUnexpectedEOF
+	}
+	answer := strings.TrimSpace(w.in.Text())
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// askUntil asks until check accepts the answer, printing each rejection.
+func (w *wizard) askUntil(question, def string, check func(string) error) (string, error) {
+	for {
+		answer, err := w.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if err := check(answer); err != nil {
+			fmt.Fprintf(w.out, "  %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// datasetExists checks that vol exists using the zfs command zfsCmd.
+func datasetExists(zfsCmd []string, vol string) error {
+	args := append(slices.Clone(zfsCmd[1:]), "list", "-H", "-o", "name", vol)
+	out, err := exec.Command(zfsCmd[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", vol, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (w *wizard) run(dir string) error {
+	sourceCmdStr, err := w.askUntil("Source zfs command", "zfs", func(s string) error {
+		if len(strings.Fields(s)) == 0 {
+			return fmt.Errorf("the command cannot be empty")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sourceCmd := strings.Fields(sourceCmdStr)
+
+	sourcesStr, err := w.askUntil("Datasets to back up, space separated (append /... to include children)", "", func(s string) error {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			return fmt.Errorf("at least one dataset is required")
+		}
+		for _, f := range fields {
+			src, err := zfs.ParseSource(f)
+			if err != nil {
+				return fmt.Errorf("invalid source %q: %w", f, err)
+			}
+			if err := datasetExists(sourceCmd, strings.TrimSuffix(src.String(), "/...")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	targetCmdStr, err := w.askUntil("Target zfs command (e.g. ssh backuphost zfs for a remote target)", "zfs", func(s string) error {
+		if len(strings.Fields(s)) == 0 {
+			return fmt.Errorf("the command cannot be empty")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	targetCmd := strings.Fields(targetCmdStr)
+
+	targetFS, err := w.askUntil("Target filesystem", "backup", func(s string) error {
+		return datasetExists(targetCmd, s)
+	})
+	if err != nil {
+		return err
+	}
+
+	schedule, err := w.askUntil("Schedule, as a systemd OnCalendar expression", "daily", func(s string) error {
+		// systemd-analyze isn't always installed; only check when it is.
+		if _, err := exec.LookPath("systemd-analyze"); err != nil {
+			return nil
+		}
+		if out, err := exec.Command("systemd-analyze", "calendar", s).CombinedOutput(); err != nil {
+			return fmt.Errorf("invalid schedule: %s", strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error finding zfsbackup executable: %w", err)
+	}
+	args := []string{exe, "--target-fs", targetFS}
+	if sourceCmdStr != "zfs" {
+		args = append(args, "--source-command", sourceCmdStr)
+	}
+	if targetCmdStr != "zfs" {
+		args = append(args, "--target-command", targetCmdStr)
+	}
+	args = append(args, strings.Fields(sourcesStr)...)
+	var quoted []string
+	for _, a := range args {
+		quoted = append(quoted, systemdQuote(a))
+	}
+
+	service := fmt.Sprintf(`[Unit]
+Description=zfsbackup
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+`, strings.Join(quoted, " "))
+	timer := fmt.Sprintf(`[Unit]
+Description=Run zfsbackup %s
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`, schedule, schedule)
+
+	units := []struct{ name, content string }{
+		{"zfsbackup.service", service},
+		{"zfsbackup.timer", timer},
+	}
+	for _, u := range units {
+		path := filepath.Join(dir, u.name)
+		if err := os.WriteFile(path, []byte(u.content), 0o644); err != nil {
+			return fmt.Errorf("error writing %s: %w", path, err)
+		}
+		fmt.Fprintf(w.out, "Wrote %s\n", path)
+	}
+	fmt.Fprintf(w.out, "Install with: cp %s /etc/systemd/system/ && systemctl enable --now zfsbackup.timer\n",
+		filepath.Join(dir, "zfsbackup.{service,timer}"))
+	return nil
+}
+
+// systemdQuote quotes s for an ExecStart= line if needed.
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;$%") {
+		return s
+	}
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	s = strings.ReplaceAll(s, "$", "$$")
+	return `"` + s + `"`
+}
+
+func init() {
+	initCmd.Flags().String("dir", ".", "Directory to write the systemd units to")
+	rootCmd.AddCommand(initCmd)
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// introspection is the output of the introspect command.
+type introspection struct {
+	Version  string            `json:"version"`
+	Commands []string          `json:"commands"`
+	Features []string          `json:"features"`
+	Source   zfs.Endpoint      `json:"source"`
+	Target   zfs.Endpoint      `json:"target"`
+	Config   map[string]string `json:"config"`
+}
+
+var introspectCmd = &cobra.Command{
+	Use:   "introspect [flags]",
+	Short: "Describe this installation in machine-readable form",
+	Long: `Print the zfsbackup version, its commands and backup features, the zfs
+version reached through the source and target commands, and the
+effective value of every backup flag, for fleet management tooling.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, _ := cmd.Flags().GetString("format")
+		if format != "json" {
+			return fmt.Errorf("unsupported format %q: only json is supported", format)
+		}
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		out := introspection{
+			Version: "unknown",
+			Source:  b.ProbeEndpoint(false),
+			Target:  b.ProbeEndpoint(true),
+			Config:  make(map[string]string),
+		}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			out.Version = info.Main.Version
+		}
+		for _, c := range cmd.Root().Commands() {
+			if !c.Hidden {
+				out.Commands = append(out.Commands, c.Name())
+			}
+		}
+		// Every backup flag is a feature; none of them hold secrets.
+		rootCmd.Flags().VisitAll(func(f *pflag.Flag) {
+			out.Features = append(out.Features, f.Name)
+		})
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			if f.Name != "format" && f.Name != "help" {
+				out.Config[f.Name] = f.Value.String()
+			}
+		})
+
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(out)
+	},
+}
+
+func init() {
+	addBackupFlags(introspectCmd.Flags())
+	registerBackupCompletions(introspectCmd)
+	introspectCmd.Flags().String("format", "json", "Output format (only json)")
+	rootCmd.AddCommand(introspectCmd)
+}
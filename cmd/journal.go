@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var journalCmd = &cobra.Command{
+	Use:   "journal [flags] <file>",
+	Short: "Show changes that were in flight according to a --journal file",
+	Long: `List the entries of an intent journal written with --journal that were
+never marked done. Entries of a process that is gone are stale: the host
+crashed or zfsbackup was killed while making that change, so check the
+dataset and snapshots it names, e.g. for a leftover hold or a missing
+snapshot, before trusting the next run.
+
+With --clear, stale and finished entries are removed from the journal.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		clearStale, _ := cmd.Flags().GetBool("clear")
+		if clearStale {
+			if err := refuseReadOnly(cmd); err != nil {
+				return err
+			}
+			n, err := zfs.ClearJournal(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Cleared %d stale entries\n", n)
+			return nil
+		}
+
+		entries, err := zfs.ReadJournal(args[0])
+		if err != nil {
+			return err
+		}
+		w := cmd.OutOrStdout()
+		if len(entries) == 0 {
+			fmt.Fprintln(w, "Nothing in flight")
+			return nil
+		}
+		stale := 0
+		for _, e := range entries {
+			status := "running"
+			if e.Stale() {
+				status = "STALE"
+				stale++
+			}
+			fmt.Fprintf(w, "%-7s  %s\n         %s\n", status, e, e.Command)
+		}
+		if stale > 0 {
+			return fmt.Errorf("%d change(s) were in flight when an earlier run died", stale)
+		}
+		return nil
+	},
+}
+
+func init() {
+	journalCmd.Flags().Bool("clear", false, "Remove stale and finished entries")
+	rootCmd.AddCommand(journalCmd)
+}
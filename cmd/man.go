@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+var manCmd = &cobra.Command{
+	Use:    "man",
+	Short:  "Generate man pages",
+	Long:   `Generate man pages for zfsbackup and all its commands in a directory.`,
+	Args:   cobra.NoArgs,
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := refuseReadOnly(cmd); err != nil {
+			return err
+		}
+		dir, _ := cmd.Flags().GetString("dir")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("error creating man page directory: %w", err)
+		}
+		header := &doc.GenManHeader{Title: "ZFSBACKUP", Section: "8", Source: "zfsbackup"}
+		root := cmd.Root()
+		root.DisableAutoGenTag = true
+		if err := doc.GenManTree(root, header, dir); err != nil {
+			return fmt.Errorf("error generating man pages: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Wrote man pages to %s\n", dir)
+		return nil
+	},
+}
+
+func init() {
+	manCmd.Flags().String("dir", "man", "Directory to write the man pages to")
+	rootCmd.AddCommand(manCmd)
+}
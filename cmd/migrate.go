@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var migrateTargetCmd = &cobra.Command{
+	Use:   "migrate-target --from <old> --to <new> [flags]",
+	Short: "Move all backups from one target to another",
+	Long: `Replicate every backup chain under the old target filesystem to the new
+one, keeping all snapshots, e.g. when replacing the backup pool's
+hardware. The old target is read with the source command and the new one
+written with the target command, so -S 'ssh oldhost zfs' migrates from
+another host.
+
+Each dataset directly under --from is sent with zfs send -R. Datasets
+that already exist under --to are updated incrementally, so an
+interrupted migration can simply be run again.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, _ := cmd.Flags().GetString("from")
+		to, _ := cmd.Flags().GetString("to")
+		if from == "" || to == "" {
+			return fmt.Errorf("--from and --to are required")
+		}
+		cmd.Flags().Set("target-fs", to)
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Migrating %s to %s\n", from, to)
+		return b.Migrate(from)
+	},
+}
+
+func init() {
+	addBackupFlags(migrateTargetCmd.Flags())
+	registerBackupCompletions(migrateTargetCmd)
+	migrateTargetCmd.Flags().String("from", "", "Target filesystem to migrate from")
+	migrateTargetCmd.Flags().String("to", "", "Target filesystem to migrate to")
+	migrateTargetCmd.RegisterFlagCompletionFunc("from", completeDatasets("source-command", false, 0))
+	migrateTargetCmd.RegisterFlagCompletionFunc("to", completeDatasets("target-command", false, 0))
+	rootCmd.AddCommand(migrateTargetCmd)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var nowCmd = &cobra.Command{
+	Use:   "now [flags] <dataset>",
+	Short: "Back up a single dataset immediately",
+	Long: `Take a fresh snapshot of one dataset and replicate it, blocking until
+it completes. Only the given dataset is backed up, not its descendants.
+Use --label to record why, e.g. --label reason=pre-upgrade.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, err := zfs.ParseSource(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid source %q: %w", args[0], err)
+		}
+		if src.Recursive() {
+			return fmt.Errorf("now backs up a single dataset; use the root command for recursive sources")
+		}
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		if err := b.RunBackup([]zfs.Source{src}); err != nil {
+			fmt.Fprintf(cmd.OutOrStdout(), "Backup of %s FAILED\n", src)
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Backup of %s succeeded\n", src)
+		return nil
+	},
+}
+
+func init() {
+	addBackupFlags(nowCmd.Flags())
+	registerBackupCompletions(nowCmd)
+	nowCmd.ValidArgsFunction = completeDatasets("source-command", false, 1)
+	rootCmd.AddCommand(nowCmd)
+}
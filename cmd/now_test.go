@@ -0,0 +1,15 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNowRefusesRecursiveSource(t *testing.T) {
+	for _, arg := range []string{"tank/data/...", "tank/data/...,retain=3"} {
+		err := nowCmd.RunE(nowCmd, []string{arg})
+		if err == nil || !strings.Contains(err.Error(), "single dataset") {
+			t.Errorf("now %s: error %v, want a refusal of the recursive source", arg, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var offlineRunCmd = &cobra.Command{
+	Use:   "offline-run --pool <pool> [flags] <source> [<source>...]",
+	Short: "Back up to a removable pool, importing and exporting it",
+	Long: `Import a pool on removable media, back up the sources to it and
+export it again, so the disks can be unplugged and rotated offsite.
+
+The target filesystem defaults to the root of the pool. If --target-fs is
+given it must be inside the pool. A pool that was already imported is
+left imported.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pool, _ := cmd.Flags().GetString("pool")
+		if pool == "" {
+			return fmt.Errorf("--pool is required")
+		}
+		if !cmd.Flags().Changed("target-fs") {
+			cmd.Flags().Set("target-fs", pool)
+		}
+		targetfs, _ := cmd.Flags().GetString("target-fs")
+		if targetfs != pool && !strings.HasPrefix(targetfs, pool+"/") {
+			return fmt.Errorf("target filesystem %s is not in pool %s", targetfs, pool)
+		}
+
+		var sources []zfs.Source
+		for _, arg := range args {
+			src, err := zfs.ParseSource(arg)
+			if err != nil {
+				return fmt.Errorf("invalid source %q: %w", arg, err)
+			}
+			sources = append(sources, src)
+		}
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		imported, err := b.ImportPool(pool)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Backing up to %s:\n", targetfs)
+		for _, src := range sources {
+			fmt.Printf("  %s\n", src)
+		}
+		err = b.RunBackup(sources)
+		printResults(cmd.OutOrStdout(), b.Results())
+		if imported {
+			err = errors.Join(err, b.ExportPool(pool))
+		}
+		return err
+	},
+}
+
+func init() {
+	addBackupFlags(offlineRunCmd.Flags())
+	registerBackupCompletions(offlineRunCmd)
+	offlineRunCmd.ValidArgsFunction = completeDatasets("source-command", true, 0)
+	offlineRunCmd.Flags().String("pool", "", "Removable pool to import, back up to and export")
+	rootCmd.AddCommand(offlineRunCmd)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan [flags] <source> [<source>...]",
+	Short: "Verify sources and options against the live systems",
+	Long: `Check, without snapshotting or sending anything, that the source and
+target commands work, the target pool and every source dataset exist,
+every source and --priority pattern matches at least one dataset, and
+the limits are consistent with retention. Every check is listed and the
+exit status is non-zero if any fails, so the production command line can
+be verified in CI.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		offlineCheck, _ := cmd.Flags().GetBool("offline-check")
+		if !offlineCheck {
+			return fmt.Errorf("plan currently only supports --offline-check")
+		}
+		var sources []zfs.Source
+		for _, arg := range args {
+			src, err := zfs.ParseSource(arg)
+			if err != nil {
+				return fmt.Errorf("invalid source %q: %w", arg, err)
+			}
+			sources = append(sources, src)
+		}
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		failed := 0
+		for _, c := range b.CheckConfig(sources) {
+			fmt.Fprintln(cmd.OutOrStdout(), c)
+			if c.Err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d check(s) failed", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	addBackupFlags(planCmd.Flags())
+	registerBackupCompletions(planCmd)
+	planCmd.ValidArgsFunction = completeDatasets("source-command", true, 0)
+	planCmd.Flags().Bool("offline-check", false, "Check the sources and options without sending anything")
+	rootCmd.AddCommand(planCmd)
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote [flags] <target-dataset>",
+	Short: "Prepare a backup copy to serve as the primary after a failover",
+	Long: `Make a target dataset usable as the primary copy: clear readonly on it
+and its descendants, apply any --set properties such as the mountpoint or
+sharing, and mark it with zfsbackup:role=primary. Backups refuse to
+receive into a promoted dataset, so a scheduled run can't roll back
+changes made after the failover.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		props, _ := cmd.Flags().GetStringArray("set")
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		if err := b.Promote(args[0], props); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Promoted %s to primary\n", args[0])
+		return nil
+	},
+}
+
+func init() {
+	addBackupFlags(promoteCmd.Flags())
+	registerBackupCompletions(promoteCmd)
+	promoteCmd.ValidArgsFunction = completeDatasets("target-command", false, 1)
+	promoteCmd.Flags().StringArray("set", nil, "Property to set on the promoted dataset, e.g. mountpoint=/srv/data (repeatable)")
+	rootCmd.AddCommand(promoteCmd)
+}
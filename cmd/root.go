@@ -2,40 +2,33 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/jamesmcdonald/zfsbackup/util"
 	"github.com/jamesmcdonald/zfsbackup/zfs"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "zfsbackup [flags] <source> [<source>...]",
 	Short: "Back up ZFS filesystems",
 	Long:  `Back up ZFS filesystems incrementally to target ZFS filesystems.`,
+	Args:  cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if configPath, _ := cmd.Flags().GetString("config"); configPath != "" {
+			if len(args) > 0 {
+				return fmt.Errorf("sources can't be given on the command line with --config")
+			}
+			return runConfig(cmd, configPath)
+		}
 		if len(args) == 0 {
 			return fmt.Errorf("no source filesystems provided")
 		}
-		targetfs, _ := cmd.Flags().GetString("target-fs")
-		dryrun, _ := cmd.Flags().GetBool("dry-run")
-		debug, _ := cmd.Flags().GetBool("debug")
-		sourceCmdStr, _ := cmd.Flags().GetString("source-command")
-		targetCmdStr, _ := cmd.Flags().GetString("target-command")
-		sourceCmd := strings.Fields(sourceCmdStr)
-		targetCmd := strings.Fields(targetCmdStr)
-
-		level := slog.LevelInfo
-		if debug {
-			level = slog.LevelDebug
-		}
-
-		handler := slog.NewTextHandler(cmd.ErrOrStderr(), &slog.HandlerOptions{
-			Level: level,
-		})
-		logger := slog.New(handler)
-
 		var sources []zfs.Source
 		for _, arg := range args {
 			src, err := zfs.ParseSource(arg)
@@ -45,42 +38,461 @@ var rootCmd = &cobra.Command{
 			sources = append(sources, src)
 		}
 
-		fmt.Printf("Backing up to %s:\n", targetfs)
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		fmt.Printf("Backing up to %s:\n", b.Target())
 		for _, src := range sources {
 			fmt.Printf("  %s\n", src)
 		}
+		err = b.RunBackup(sources)
+		printResults(cmd.OutOrStdout(), b.Results())
+		return err
+	},
+}
+
+// printResults writes one line per source of a run, if there was more
+// than one.
+func printResults(w io.Writer, results []zfs.SourceResult) {
+	if len(results) < 2 {
+		return
+	}
+	fmt.Fprintln(w, "Results:")
+	for _, r := range results {
+		status := "ok"
+		switch {
+		case r.Err != nil:
+			status = "failed: " + r.Err.Error()
+		case r.Deferred:
+			status = "deferred"
+		}
+		fmt.Fprintf(w, "  %s: %s (%d dataset(s) replicated)\n", r.Source, status, r.Datasets)
+	}
+}
+
+// newBackup builds a Backup from the backup flags on cmd, followed by any
+// extra options. The returned function releases any files opened for it
+// and must be called when done.
+func newBackup(cmd *cobra.Command, extra ...zfs.BackupOption) (*zfs.Backup, func(), error) {
+	targetfs, _ := cmd.Flags().GetString("target-fs")
+	dryrun, _ := cmd.Flags().GetBool("dry-run")
+	readOnly, _ := cmd.Flags().GetBool("read-only")
+	debug, _ := cmd.Flags().GetBool("debug")
+	printCommands, _ := cmd.Flags().GetBool("print-commands")
+	recordFile, _ := cmd.Flags().GetString("record")
+	journalFile, _ := cmd.Flags().GetString("journal")
+	progressStr, _ := cmd.Flags().GetString("progress")
+	noEstimate, _ := cmd.Flags().GetBool("no-estimate")
+	unmountTarget, _ := cmd.Flags().GetBool("unmount-target")
+	preSnapshot, _ := cmd.Flags().GetStringArray("pre-snapshot-hook")
+	postSnapshot, _ := cmd.Flags().GetStringArray("post-snapshot-hook")
+	hookTimeout, _ := cmd.Flags().GetDuration("hook-timeout")
+	priority, _ := cmd.Flags().GetStringArray("priority")
+	deadlineStr, _ := cmd.Flags().GetString("deadline")
+	diffSummary, _ := cmd.Flags().GetBool("diff-summary")
+	diffTop, _ := cmd.Flags().GetInt("diff-top")
+	labelArgs, _ := cmd.Flags().GetStringArray("label")
+	maxDatasets, _ := cmd.Flags().GetInt("max-datasets")
+	maxSnapshots, _ := cmd.Flags().GetInt("max-snapshots")
+	excludeEphemeral, _ := cmd.Flags().GetBool("exclude-ephemeral")
+	honorAutoSnapshot, _ := cmd.Flags().GetBool("honor-auto-snapshot")
+	snapshotWarn, _ := cmd.Flags().GetInt("snapshot-warn")
+	retain, _ := cmd.Flags().GetInt("retain")
+	retainTarget, _ := cmd.Flags().GetInt("retain-target")
+	var retention zfs.RetentionPolicy
+	retention.Hourly, _ = cmd.Flags().GetInt("keep-hourly")
+	retention.Daily, _ = cmd.Flags().GetInt("keep-daily")
+	retention.Weekly, _ = cmd.Flags().GetInt("keep-weekly")
+	retention.Monthly, _ = cmd.Flags().GetInt("keep-monthly")
+	retention.Yearly, _ = cmd.Flags().GetInt("keep-yearly")
+	snapshotPrefix, _ := cmd.Flags().GetString("snapshot-prefix")
+	owner, _ := cmd.Flags().GetString("owner")
+	sweepOrphans, _ := cmd.Flags().GetBool("sweep-orphans")
+	hostNamespace, _ := cmd.Flags().GetBool("host-namespace")
+	nice, _ := cmd.Flags().GetInt("nice")
+	ionice, _ := cmd.Flags().GetString("ionice")
+	systemdProps, _ := cmd.Flags().GetStringArray("systemd-property")
+	logDir, _ := cmd.Flags().GetString("log-dir")
+	logRetain, _ := cmd.Flags().GetInt("log-retain")
+	smartCheckStr, _ := cmd.Flags().GetString("smart-check")
+	rootCheckStr, _ := cmd.Flags().GetString("root-check")
+	explain, _ := cmd.Flags().GetBool("explain")
+	profile, _ := cmd.Flags().GetBool("profile")
+	estimateThresholdStr, _ := cmd.Flags().GetString("estimate-threshold")
+	onDivergence, _ := cmd.Flags().GetString("on-divergence")
+	checkPoolErrors, _ := cmd.Flags().GetBool("check-pool-errors")
+	relay, _ := cmd.Flags().GetString("relay")
+	fileTarget, _ := cmd.Flags().GetString("file-target")
+	targetReadonly, _ := cmd.Flags().GetBool("target-readonly")
+	atomicSnapshots, _ := cmd.Flags().GetBool("atomic-snapshots")
+	holdTarget, _ := cmd.Flags().GetBool("hold-target")
+	syncHistory, _ := cmd.Flags().GetString("sync-history")
+	checkDrift, _ := cmd.Flags().GetBool("check-drift")
+	sourceCmdStr, _ := cmd.Flags().GetString("source-command")
+	targetCmdStr, _ := cmd.Flags().GetString("target-command")
+	targetHost, _ := cmd.Flags().GetString("target-host")
+	targetUser, _ := cmd.Flags().GetString("target-user")
+	sourceHost, _ := cmd.Flags().GetString("source-host")
+	sourceUser, _ := cmd.Flags().GetString("source-user")
+	sshPort, _ := cmd.Flags().GetInt("ssh-port")
+	sshIdentity, _ := cmd.Flags().GetString("ssh-identity")
+	nativeSSH, _ := cmd.Flags().GetBool("native-ssh")
+	sshKnownHosts, _ := cmd.Flags().GetStringArray("ssh-known-hosts")
+	targetPruneCmdStr, _ := cmd.Flags().GetString("target-prune-command")
+	sourceCmd := strings.Fields(sourceCmdStr)
+	targetCmd := strings.Fields(targetCmdStr)
+	targetPruneCmd := strings.Fields(targetPruneCmdStr)
+
+	logger := newLogger(cmd, debug)
+
+	progress, err := zfs.ParseProgressMode(progressStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	smartCheck, err := zfs.ParseSmartMode(smartCheckStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	rootCheck, err := zfs.ParseRootMode(rootCheckStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	divergence, err := zfs.ParseDivergencePolicy(onDivergence)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		var opts []zfs.BackupOption
-		opts = append(opts, zfs.WithLogger(logger))
-		if dryrun {
-			opts = append(opts, zfs.WithDryRunOption())
+	var opts []zfs.BackupOption
+	var closers []func() error
+	closeAll := func() {
+		for _, c := range closers {
+			c()
 		}
-		if len(sourceCmd) > 0 {
-			opts = append(opts, zfs.WithSourceCommandOption(sourceCmd))
+	}
+	opts = append(opts, zfs.WithLogger(logger), zfs.WithProgressOption(progress), zfs.WithOwnerOption(owner))
+	if dryrun {
+		opts = append(opts, zfs.WithDryRunOption())
+	}
+	if debug {
+		opts = append(opts, zfs.WithDebugOption())
+	}
+	if noEstimate {
+		opts = append(opts, zfs.WithNoEstimateOption())
+	}
+	if unmountTarget {
+		opts = append(opts, zfs.WithUnmountTargetOption())
+	}
+	if len(preSnapshot) > 0 || len(postSnapshot) > 0 {
+		opts = append(opts, zfs.WithSnapshotHooksOption(preSnapshot, postSnapshot, hookTimeout))
+	}
+	if len(priority) > 0 {
+		opts = append(opts, zfs.WithPriorityOption(priority))
+	}
+	if deadlineStr != "" {
+		deadline, err := zfs.ParseDeadline(deadlineStr, time.Now())
+		if err != nil {
+			return nil, nil, err
 		}
-		if len(targetCmd) > 0 {
-			opts = append(opts, zfs.WithTargetCommandOption(targetCmd))
+		opts = append(opts, zfs.WithDeadlineOption(deadline))
+	}
+	if diffSummary {
+		opts = append(opts, zfs.WithDiffSummaryOption(diffTop))
+	}
+	if len(labelArgs) > 0 {
+		labels := make(map[string]string)
+		for _, l := range labelArgs {
+			k, v, err := zfs.ParseLabel(l)
+			if err != nil {
+				return nil, nil, err
+			}
+			labels[k] = v
 		}
+		opts = append(opts, zfs.WithLabelsOption(labels))
+	}
+	if maxDatasets > 0 || maxSnapshots > 0 {
+		opts = append(opts, zfs.WithLimitsOption(maxDatasets, maxSnapshots))
+	}
+	if excludeEphemeral {
+		opts = append(opts, zfs.WithExcludeEphemeralOption())
+	}
+	if atomicSnapshots {
+		opts = append(opts, zfs.WithAtomicSnapshotsOption())
+	}
+	if syncHistory != "" {
+		opts = append(opts, zfs.WithSyncHistoryOption(syncHistory))
+	}
+	if holdTarget {
+		opts = append(opts, zfs.WithHoldTargetOption())
+	}
+	if targetReadonly {
+		opts = append(opts, zfs.WithTargetReadonlyOption())
+	}
+	if checkDrift {
+		opts = append(opts, zfs.WithDriftCheckOption())
+	}
+	if honorAutoSnapshot {
+		opts = append(opts, zfs.WithHonorAutoSnapshotOption())
+	}
+	if snapshotWarn > 0 {
+		opts = append(opts, zfs.WithSnapshotWarnOption(snapshotWarn))
+	}
+	if snapshotPrefix != "" {
+		opts = append(opts, zfs.WithSnapshotPrefixOption(snapshotPrefix))
+	}
+	if cmd.Flags().Changed("retain") {
+		opts = append(opts, zfs.WithRetainOption(retain))
+	}
+	if cmd.Flags().Changed("retain-target") {
+		opts = append(opts, zfs.WithRetainTargetOption(retainTarget))
+	}
+	if !retention.IsZero() {
+		opts = append(opts, zfs.WithRetentionPolicyOption(retention))
+	}
+	if sweepOrphans {
+		opts = append(opts, zfs.WithSweepOrphansOption())
+	}
+	if hostNamespace {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error getting hostname: %w", err)
+		}
+		host, _, _ = strings.Cut(host, ".")
+		opts = append(opts, zfs.WithHostNamespaceOption(host))
+	}
+	if nice != 0 || ionice != "" {
+		opts = append(opts, zfs.WithNiceOption(nice, ionice))
+	}
+	if len(systemdProps) > 0 {
+		opts = append(opts, zfs.WithSystemdPropertiesOption(systemdProps))
+	}
+	if logDir != "" {
+		opts = append(opts, zfs.WithLogDirOption(logDir, logRetain))
+	}
+	if smartCheck != zfs.SmartOff {
+		opts = append(opts, zfs.WithSmartCheckOption(smartCheck))
+	}
+	if rootCheck != zfs.RootAllow {
+		opts = append(opts, zfs.WithRootCheckOption(rootCheck))
+	}
+	if explain {
+		opts = append(opts, zfs.WithExplainOption())
+	}
+	if profile {
+		opts = append(opts, zfs.WithProfileOption())
+	}
+	if estimateThresholdStr != "" {
+		threshold, err := util.ParseBytes(estimateThresholdStr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid estimate threshold: %w", err)
+		}
+		opts = append(opts, zfs.WithEstimateThresholdOption(threshold))
+	}
+	if divergence != zfs.DivergenceIgnore {
+		opts = append(opts, zfs.WithDivergenceOption(divergence))
+	}
+	if checkPoolErrors {
+		opts = append(opts, zfs.WithPoolErrorCheckOption())
+	}
+	if relay != "" {
+		opts = append(opts, zfs.WithRelayOption(relay))
+	}
+	if fileTarget != "" {
+		opts = append(opts, zfs.WithFileTargetOption(fileTarget))
+	}
+	if printCommands {
+		opts = append(opts, zfs.WithPrintCommandsOption(cmd.OutOrStdout()))
+	}
+	if readOnly {
+		if recordFile != "" {
+			return nil, nil, fmt.Errorf("--record writes a file and can't be used with --read-only")
+		}
+		opts = append(opts, zfs.WithReadOnlyOption())
+	}
+	if journalFile != "" {
+		opts = append(opts, zfs.WithJournalOption(journalFile))
+	}
+	if len(sourceCmd) > 0 {
+		opts = append(opts, zfs.WithSourceCommandOption(sourceCmd))
+	}
+	if len(targetCmd) > 0 {
+		opts = append(opts, zfs.WithTargetCommandOption(targetCmd))
+	}
+	if len(targetPruneCmd) > 0 {
+		opts = append(opts, zfs.WithTargetPruneCommandOption(targetPruneCmd))
+	}
+	if sourceHost != "" {
+		if len(sourceCmd) > 0 && sourceCmd[0] == "ssh" {
+			return nil, nil, fmt.Errorf("--source-host runs ssh itself, set --source-command to the zfs command on the host")
+		}
+		opts = append(opts, zfs.WithSSHSourceOption(zfs.SSHHost{
+			Host:     sourceHost,
+			User:     sourceUser,
+			Port:     sshPort,
+			Identity: sshIdentity,
+		}))
+	} else if sourceUser != "" {
+		return nil, nil, fmt.Errorf("--source-user needs --source-host")
+	}
+	if targetHost != "" {
+		if len(targetCmd) > 0 && targetCmd[0] == "ssh" {
+			return nil, nil, fmt.Errorf("--target-host runs ssh itself, set --target-command to the zfs command on the host")
+		}
+		opts = append(opts, zfs.WithSSHTargetOption(zfs.SSHHost{
+			Host:     targetHost,
+			User:     targetUser,
+			Port:     sshPort,
+			Identity: sshIdentity,
+		}))
+	} else if targetUser != "" {
+		return nil, nil, fmt.Errorf("--target-user needs --target-host")
+	}
+	if sourceHost == "" && targetHost == "" && (sshPort != 0 || sshIdentity != "") {
+		return nil, nil, fmt.Errorf("--ssh-port and --ssh-identity need --source-host or --target-host")
+	}
+	if nativeSSH {
+		opts = append(opts, zfs.WithNativeSSHOption(sshKnownHosts...))
+	} else if len(sshKnownHosts) > 0 {
+		return nil, nil, fmt.Errorf("--ssh-known-hosts needs --native-ssh")
+	}
 
-		b, err := zfs.NewBackup(targetfs, opts...)
+	b, err := zfs.NewBackup(targetfs, append(opts, extra...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	closers = append(closers, b.Close)
+	// The record file is created last, so a run refused by any of the
+	// checks above leaves an existing recording intact.
+	if recordFile != "" {
+		f, err := os.Create(recordFile)
 		if err != nil {
-			return err
+			closeAll()
+			return nil, nil, fmt.Errorf("error creating record file: %w", err)
 		}
-		return b.RunBackup(sources)
-	},
+		closers = append(closers, f.Close)
+		if err := zfs.WithRecordOption(f)(b); err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+	}
+	return b, closeAll, nil
+}
+
+func newLogger(cmd *cobra.Command, debug bool) *slog.Logger {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+
+	handler := slog.NewTextHandler(cmd.ErrOrStderr(), &slog.HandlerOptions{
+		Level: level,
+	})
+	return slog.New(handler)
+}
+
+// exitCodes maps classified zfs failures to sysexits(3) exit codes, so
+// wrappers can tell e.g. a busy target worth retrying from a full pool.
+var exitCodes = map[zfs.ErrorClass]int{
+	zfs.ClassInvalid:    64, // EX_USAGE
+	zfs.ClassNotFound:   66, // EX_NOINPUT
+	zfs.ClassConnection: 69, // EX_UNAVAILABLE
+	zfs.ClassNoSpace:    73, // EX_CANTCREAT
+	zfs.ClassBusy:       75, // EX_TEMPFAIL
+	zfs.ClassPermission: 77, // EX_NOPERM
 }
 
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
+		if code, ok := exitCodes[zfs.ClassOf(err)]; ok {
+			os.Exit(code)
+		}
 		os.Exit(1)
 	}
 }
 
 func init() {
-	rootCmd.Flags().StringP("target-fs", "t", "backup", "Target filesystem")
-	rootCmd.Flags().BoolP("dry-run", "n", false, "Perform a trial run with no changes made")
-	rootCmd.Flags().BoolP("debug", "d", false, "Enable debug output")
-	rootCmd.Flags().StringP("source-command", "S", "zfs", "Source ZFS command")
-	rootCmd.Flags().StringP("target-command", "T", "zfs", "Target ZFS command")
+	rootCmd.PersistentFlags().BoolP("debug", "d", false, "Enable debug output")
+	rootCmd.PersistentFlags().Bool("read-only", false, "Guarantee no changes: like --dry-run, but refuse any command that isn't known to be read-only")
+	addBackupFlags(rootCmd.Flags())
+	rootCmd.Flags().String("config", "", "Run the backup jobs defined in this YAML file")
+	registerBackupCompletions(rootCmd)
+	rootCmd.ValidArgsFunction = completeDatasets("source-command", true, 0)
+}
+
+// refuseReadOnly returns an error if --read-only is set, for commands that
+// change the system outside of zfs.Backup.
+func refuseReadOnly(cmd *cobra.Command) error {
+	if readOnly, _ := cmd.Flags().GetBool("read-only"); readOnly {
+		return fmt.Errorf("%s makes changes and can't be run with --read-only", cmd.Name())
+	}
+	return nil
+}
+
+// addBackupFlags adds the flags read by newBackup to flags.
+func addBackupFlags(flags *pflag.FlagSet) {
+	flags.StringP("target-fs", "t", "backup", "Target filesystem")
+	flags.BoolP("dry-run", "n", false, "Perform a trial run with no changes made")
+	flags.Bool("unmount-target", false, "Unmount mounted target datasets around each receive")
+	flags.StringArray("pre-snapshot-hook", nil, "Shell command to run before each snapshot (repeatable)")
+	flags.StringArray("post-snapshot-hook", nil, "Shell command to run after each snapshot, even if it failed (repeatable)")
+	flags.Duration("hook-timeout", zfs.DefaultHookTimeout, "Timeout for each snapshot hook")
+	flags.StringArray("priority", nil, "Dataset pattern to replicate first in recursive sources (repeatable, in order)")
+	flags.String("deadline", "", "Stop starting new datasets after this time (duration, HH:MM or RFC 3339)")
+	flags.Bool("diff-summary", false, "Log a zfs diff summary of the changes in each incremental backup")
+	flags.Int("diff-top", 5, "Number of most-changed directories to list in the diff summary")
+	flags.String("owner", zfs.DefaultOwner, "Ownership marker stored on created snapshots; cleanup only destroys snapshots with this owner")
+	flags.Bool("sweep-orphans", false, "Destroy owned source snapshots that never reached the target")
+	flags.Bool("host-namespace", false, "Receive under <target-fs>/<hostname> so several hosts can share a backup pool")
+	flags.StringArray("label", nil, "Label the run with key=value (repeatable)")
+	flags.Int("max-datasets", 0, "Abort before replicating more than this many datasets in one run (0 for no limit)")
+	flags.Int("max-snapshots", 0, "Abort before creating more than this many snapshots in one run (0 for no limit)")
+	flags.Bool("exclude-ephemeral", false, "Skip Docker layers, .system and swap datasets in recursive sources")
+	flags.Bool("atomic-snapshots", false, "Snapshot all datasets of all sources in one atomic operation")
+	flags.String("sync-history", "", "Also replicate existing source snapshots matching this pattern")
+	flags.Bool("hold-target", false, "Place a hold on every received snapshot so it can't be destroyed until unlocked")
+	flags.Bool("target-readonly", false, "Set readonly=on on received datasets")
+	flags.Bool("check-drift", false, "Warn when a target dataset was modified since the last receive")
+	flags.String("on-divergence", "", "Check targets for changes past the common snapshot: fail, keep-source, keep-target or save-target")
+	flags.Bool("honor-auto-snapshot", false, "Skip datasets with com.sun:auto-snapshot=false in recursive sources")
+	flags.String("snapshot-prefix", "", "Prefix for the names of the snapshots taken, e.g. daily-")
+	flags.Int("retain", 2, "Number of backup snapshots to keep on the source and target")
+	flags.Int("retain-target", 0, "Number of backup snapshots to keep on the target, if different from --retain")
+	flags.Int("keep-hourly", 0, "Also keep the newest snapshot of each of this many hours")
+	flags.Int("keep-daily", 0, "Also keep the newest snapshot of each of this many days")
+	flags.Int("keep-weekly", 0, "Also keep the newest snapshot of each of this many weeks")
+	flags.Int("keep-monthly", 0, "Also keep the newest snapshot of each of this many months")
+	flags.Int("keep-yearly", 0, "Also keep the newest snapshot of each of this many years")
+	flags.Int("snapshot-warn", 0, "Warn when a dataset has more than this many snapshots (0 to disable)")
+	flags.Int("nice", 0, "Run send and receive with this niceness")
+	flags.String("ionice", "", "Run send and receive in this I/O class: idle, best-effort[:level] or realtime[:level]")
+	flags.StringArray("systemd-property", nil, "Run send and receive in a systemd scope with this unit property, e.g. CPUQuota=50% (repeatable)")
+	flags.String("log-dir", "", "Write the stderr of each send and receive to a session log per dataset in this directory")
+	flags.Int("log-retain", zfs.DefaultLogRetain, "Number of session logs to keep per dataset (0 to keep all)")
+	flags.Bool("check-pool-errors", false, "Fail the run if the target pool's read, write or checksum error counters increased since the last run")
+	flags.String("smart-check", "", "Check SMART health of the target pool's disks first: warn or refuse")
+	flags.String("root-check", "", "Check whether zfs runs as root on the target when delegation would do: warn or refuse")
+	flags.Bool("explain", false, "Log why each send is full or incremental and why each snapshot is kept or destroyed")
+	flags.Bool("profile", false, "Log the time spent in each phase per source and dataset at the end of the run")
+	flags.String("file-target", "", "Store send streams as files under this directory instead of receiving them into ZFS")
+	flags.String("relay", "", "Replicate the latest snapshots received by the upstream job with this owner instead of taking new ones")
+	flags.Bool("print-commands", false, "Print every command and pipeline as it would be executed")
+	flags.String("progress", "auto", "Progress display: auto, pv, internal or none")
+	flags.String("estimate-threshold", "", "Skip the size estimate for incrementals with less than this much written since the base, e.g. 64M")
+	flags.Bool("no-estimate", false, "Skip estimating the send size before each backup")
+	flags.String("record", "", "Record all commands and their output to a replay fixture file")
+	flags.String("journal", "", "Record each change in this intent journal file before making it")
+	flags.StringP("source-command", "S", "zfs", "Source ZFS command")
+	flags.StringP("target-command", "T", "zfs", "Target ZFS command")
+	flags.String("target-host", "", "Run the target command on this host over ssh")
+	flags.String("target-user", "", "User to log in to the target host as")
+	flags.String("source-host", "", "Run the source command on this host over ssh, to pull backups from it")
+	flags.String("source-user", "", "User to log in to the source host as")
+	flags.Int("ssh-port", 0, "Port of the ssh server on the source and target hosts")
+	flags.String("ssh-identity", "", "Private key file for logging in to the source and target hosts")
+	flags.Bool("native-ssh", false, "Connect to the source and target hosts in-process instead of running ssh")
+	flags.StringArray("ssh-known-hosts", nil, "Known hosts file for --native-ssh (default ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts)")
+	flags.String("target-prune-command", "", "Target ZFS command for destroying old snapshots (default: the target command)")
 }
@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Validate the installation end to end on throwaway pools",
+	Long: `Create two small file-backed zpools, run a full and an incremental
+backup between them, restore the backup, check snapshot pruning and
+verify the data at every step. Everything is torn down afterwards.
+Must be run as root.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := refuseReadOnly(cmd); err != nil {
+			return err
+		}
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("selftest must be run as root")
+		}
+		debug, _ := cmd.Flags().GetBool("debug")
+		st := &selftest{
+			out:    cmd.OutOrStdout(),
+			suffix: fmt.Sprintf("%d", os.Getpid()),
+		}
+		logger := newLogger(cmd, debug)
+
+		dir, err := os.MkdirTemp("", "zfsbackup-selftest-")
+		if err != nil {
+			return fmt.Errorf("error creating temporary directory: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		st.dir = dir
+		defer st.teardown()
+
+		if err := st.setup(); err != nil {
+			return err
+		}
+
+		b, err := zfs.NewBackup(st.dstPool(), zfs.WithLogger(logger))
+		if err != nil {
+			return err
+		}
+		src, err := zfs.ParseSource(st.srcFS())
+		if err != nil {
+			return err
+		}
+		steps := []struct {
+			name string
+			fn   func() error
+		}{
+			{"full backup", func() error { return st.backupAndVerify(b, src) }},
+			{"incremental backup", func() error { return st.backupAndVerify(b, src) }},
+			{"prune", func() error { return st.prune(b, src) }},
+			{"restore", st.restore},
+		}
+		for _, step := range steps {
+			st.printf("%s... ", step.name)
+			if err := step.fn(); err != nil {
+				st.printf("FAILED\n")
+				return fmt.Errorf("selftest %s: %w", step.name, err)
+			}
+			st.printf("ok\n")
+		}
+		st.printf("selftest passed\n")
+		return nil
+	},
+}
+
+type selftest struct {
+	out    io.Writer
+	dir    string
+	suffix string
+	pools  []string
+}
+
+func (st *selftest) printf(format string, args ...any) {
+	fmt.Fprintf(st.out, format, args...)
+}
+
+func (st *selftest) srcPool() string { return "zfsbackup-selftest-src-" + st.suffix }
+func (st *selftest) dstPool() string { return "zfsbackup-selftest-dst-" + st.suffix }
+func (st *selftest) srcFS() string   { return st.srcPool() + "/data" }
+func (st *selftest) dstFS() string   { return st.dstPool() + "/" + st.srcFS() }
+
+func (st *selftest) mountpoint(fs string) string {
+	return filepath.Join(st.dir, "mnt", fs)
+}
+
+func (st *selftest) run(args ...string) (string, error) {
+	c := exec.Command(args[0], args[1:]...)
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = &out
+	if err := c.Run(); err != nil {
+		return "", fmt.Errorf("%s: %s: %w", strings.Join(args, " "), strings.TrimSpace(out.String()), err)
+	}
+	return out.String(), nil
+}
+
+func (st *selftest) setup() error {
+	for _, pool := range []string{st.srcPool(), st.dstPool()} {
+		vdev := filepath.Join(st.dir, pool+".img")
+		f, err := os.Create(vdev)
+		if err != nil {
+			return fmt.Errorf("error creating vdev file: %w", err)
+		}
+		err = f.Truncate(128 << 20)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error sizing vdev file: %w", err)
+		}
+		if _, err := st.run("zpool", "create", "-m", st.mountpoint(pool), pool, vdev); err != nil {
+			return err
+		}
+		st.pools = append(st.pools, pool)
+	}
+	if _, err := st.run("zfs", "create", st.srcFS()); err != nil {
+		return err
+	}
+	// Full receives need the target's parent dataset to exist.
+	_, err := st.run("zfs", "create", "-p", st.dstPool()+"/"+st.srcPool())
+	return err
+}
+
+func (st *selftest) teardown() {
+	for i := len(st.pools) - 1; i >= 0; i-- {
+		if _, err := st.run("zpool", "destroy", "-f", st.pools[i]); err != nil {
+			st.printf("warning: %v\n", err)
+		}
+	}
+}
+
+// writeData appends a chunk of random data to the test file on the source.
+func (st *selftest) writeData() error {
+	f, err := os.OpenFile(filepath.Join(st.mountpoint(st.srcFS()), "data"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(f, rand.Reader, 4<<20)
+	return err
+}
+
+func checksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// verify compares the test file on the source with the copy in fs.
+func (st *selftest) verify(fs string) error {
+	want, err := checksum(filepath.Join(st.mountpoint(st.srcFS()), "data"))
+	if err != nil {
+		return err
+	}
+	got, err := checksum(filepath.Join(st.mountpoint(fs), "data"))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, got) {
+		return fmt.Errorf("data in %s does not match source", fs)
+	}
+	return nil
+}
+
+func (st *selftest) backupAndVerify(b *zfs.Backup, src zfs.Source) error {
+	if err := st.writeData(); err != nil {
+		return fmt.Errorf("error writing test data: %w", err)
+	}
+	// Snapshot names have one-second resolution.
+	time.Sleep(time.Second)
+	if err := b.RunBackup([]zfs.Source{src}); err != nil {
+		return err
+	}
+	// The target is received with -F but may not be mounted yet.
+	if _, err := st.run("zfs", "mount", st.dstFS()); err != nil && !strings.Contains(err.Error(), "already mounted") {
+		return err
+	}
+	return st.verify(st.dstFS())
+}
+
+func (st *selftest) prune(b *zfs.Backup, src zfs.Source) error {
+	if err := st.backupAndVerify(b, src); err != nil {
+		return err
+	}
+	for _, fs := range []string{st.srcFS(), st.dstFS()} {
+		out, err := st.run("zfs", "list", "-H", "-o", "name", "-t", "snapshot", fs)
+		if err != nil {
+			return err
+		}
+		if n := len(strings.Fields(out)); n != 2 {
+			return fmt.Errorf("expected 2 snapshots on %s after pruning, found %d", fs, n)
+		}
+	}
+	return nil
+}
+
+func (st *selftest) restore() error {
+	out, err := st.run("zfs", "list", "-H", "-o", "name", "-t", "snapshot", "-s", "creation", st.dstFS())
+	if err != nil {
+		return err
+	}
+	snaps := strings.Fields(out)
+	if len(snaps) == 0 {
+		return fmt.Errorf("no snapshots to restore from")
+	}
+	restored := st.srcPool() + "/restored"
+	send := exec.Command("zfs", "send", snaps[len(snaps)-1])
+	recv := exec.Command("zfs", "receive", restored)
+	pipe, err := send.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	recv.Stdin = pipe
+	var sendStderr, recvStderr bytes.Buffer
+	send.Stderr = &sendStderr
+	recv.Stderr = &recvStderr
+	if err := recv.Start(); err != nil {
+		return err
+	}
+	if err := send.Run(); err != nil {
+		recv.Wait()
+		return fmt.Errorf("error sending %s: %s: %w", snaps[len(snaps)-1], strings.TrimSpace(sendStderr.String()), err)
+	}
+	if err := recv.Wait(); err != nil {
+		return fmt.Errorf("error receiving %s: %s: %w", restored, strings.TrimSpace(recvStderr.String()), err)
+	}
+	return st.verify(restored)
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jamesmcdonald/zfsbackup/util"
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+	"github.com/spf13/cobra"
+)
+
+var snapshotsCmd = &cobra.Command{
+	Use:   "snapshots [flags] <dataset>",
+	Short: "List the backup snapshots of a dataset",
+	Long: `List the backup snapshots of a dataset with their creation time, the
+space each one holds on its own (USED) and the data it references. The
+dataset is read with the target command if it is under the target
+filesystem, and with the source command otherwise.
+
+With --diff, the changes between each pair of adjacent snapshots are
+listed as well, to find when a file changed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+		diff, _ := cmd.Flags().GetBool("diff")
+
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		snaps, err := b.Snapshots(args[0])
+		if err != nil {
+			return err
+		}
+		var shown []zfs.SnapshotInfo
+		for _, s := range snaps {
+			if all || s.Owned {
+				shown = append(shown, s)
+			}
+		}
+
+		out := cmd.OutOrStdout()
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SNAPSHOT\tCREATED\tUSED\tREFER")
+		for _, s := range shown {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Created.Format(time.DateTime), util.HumanBytes(s.Used), util.HumanBytes(s.Referenced))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if !diff {
+			return nil
+		}
+		for i := 1; i < len(shown); i++ {
+			lines, err := b.DiffSnapshots(shown[i-1].Name, shown[i].Name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "\n%s -> %s: %d change(s)\n", shown[i-1].Name, shown[i].Name, len(lines))
+			for _, l := range lines {
+				fmt.Fprintf(out, "  %s\n", l)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	addBackupFlags(snapshotsCmd.Flags())
+	registerBackupCompletions(snapshotsCmd)
+	snapshotsCmd.ValidArgsFunction = completeDatasets("source-command", false, 1)
+	snapshotsCmd.Flags().Bool("all", false, "Include snapshots not created by zfsbackup with this owner")
+	snapshotsCmd.Flags().Bool("diff", false, "Show the changes between adjacent snapshots")
+	rootCmd.AddCommand(snapshotsCmd)
+}
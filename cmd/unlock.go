@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock [flags] [<dataset>]",
+	Short: "Release holds placed by --hold-target",
+	Long: `Release the zfsbackup holds on every snapshot of a target dataset and
+its descendants, so they can be pruned again. The dataset defaults to
+the target filesystem.
+
+Run this with a target command for an identity that is allowed to
+release holds, e.g. -T 'ssh admin@backuphost zfs', while the identity
+used for backups is only delegated hold and receive.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		b, closeBackup, err := newBackup(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeBackup()
+
+		vol, _ := cmd.Flags().GetString("target-fs")
+		if len(args) > 0 {
+			vol = args[0]
+		}
+		return b.Unlock(vol)
+	},
+}
+
+func init() {
+	addBackupFlags(unlockCmd.Flags())
+	registerBackupCompletions(unlockCmd)
+	unlockCmd.ValidArgsFunction = completeDatasets("target-command", false, 1)
+	rootCmd.AddCommand(unlockCmd)
+}
@@ -0,0 +1,145 @@
+// Package snapshots manages ZFS snapshots, holds and bookmarks on a local
+// or remote endpoint, independently of backup orchestration. Commands are
+// run with the same plumbing and error classification as zfsbackup.
+package snapshots
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamesmcdonald/zfsbackup/zfs"
+)
+
+// Endpoint runs zfs commands through Command, e.g. {"zfs"} locally or
+// {"ssh", "root@host", "zfs"} on another host.
+type Endpoint struct {
+	Command []string
+}
+
+// Local returns an Endpoint running zfs on this host.
+func Local() Endpoint {
+	return Endpoint{Command: []string{"zfs"}}
+}
+
+// Snapshot describes an existing snapshot.
+type Snapshot struct {
+	Name       string
+	Created    time.Time
+	Used       int64 // space freed if only this snapshot were destroyed
+	Referenced int64
+}
+
+// destroyBatchSize is the maximum number of snapshots destroyed with one
+// zfs destroy command.
+const destroyBatchSize = 64
+
+func (e Endpoint) run(op string, args ...string) ([]string, error) {
+	if len(e.Command) == 0 {
+		return nil, fmt.Errorf("endpoint has no command")
+	}
+	lines, stderr, err := zfs.Exec(append(slices.Clone(e.Command), args...))
+	if err != nil {
+		return nil, &zfs.CommandError{Op: op, Stderr: stderr, Class: zfs.ClassifyStderr(stderr), Err: err}
+	}
+	return lines, nil
+}
+
+// Create takes snap, of the form vol@name, of vol and all its descendants if
+// recursive is set, with the given user properties.
+func (e Endpoint) Create(snap string, recursive bool, props map[string]string) error {
+	args := []string{"snapshot"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	for _, k := range slices.Sorted(maps.Keys(props)) {
+		args = append(args, "-o", k+"="+props[k])
+	}
+	_, err := e.run("creating snapshot", append(args, snap)...)
+	return err
+}
+
+// List returns the snapshots of vol, and of its descendants if recursive
+// is set, oldest first.
+func (e Endpoint) List(vol string, recursive bool) ([]Snapshot, error) {
+	depth := []string{"-d", "1"}
+	if recursive {
+		depth = []string{"-r"}
+	}
+	args := append([]string{"list", "-H", "-p", "-o", "name,creation,used,referenced", "-t", "snapshot"}, depth...)
+	lines, err := e.run("listing snapshots", append(args, "-s", "creation", vol)...)
+	if err != nil {
+		return nil, err
+	}
+	var snaps []Snapshot
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		cols := strings.Split(l, "\t")
+		if len(cols) != 4 {
+			return nil, fmt.Errorf("malformed snapshot line %q", l)
+		}
+		var nums [3]int64
+		for i := range nums {
+			if nums[i], err = strconv.ParseInt(cols[i+1], 10, 64); err != nil {
+				return nil, fmt.Errorf("malformed snapshot line %q: %w", l, err)
+			}
+		}
+		snaps = append(snaps, Snapshot{Name: cols[0], Created: time.Unix(nums[0], 0), Used: nums[1], Referenced: nums[2]})
+	}
+	return snaps, nil
+}
+
+// Destroy destroys snaps, which may belong to different datasets. The
+// snapshots of each dataset are destroyed together using the comma syntax
+// of zfs destroy.
+func (e Endpoint) Destroy(snaps ...string) error {
+	byVol := make(map[string][]string)
+	var vols []string
+	for _, s := range snaps {
+		vol, name, ok := strings.Cut(s, "@")
+		if !ok || name == "" {
+			return fmt.Errorf("%q is not a snapshot", s)
+		}
+		if _, seen := byVol[vol]; !seen {
+			vols = append(vols, vol)
+		}
+		byVol[vol] = append(byVol[vol], name)
+	}
+	for _, vol := range vols {
+		for batch := range slices.Chunk(byVol[vol], destroyBatchSize) {
+			if _, err := e.run("destroying snapshots", "destroy", vol+"@"+strings.Join(batch, ",")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Hold places the user hold tag on snaps.
+func (e Endpoint) Hold(tag string, snaps ...string) error {
+	if len(snaps) == 0 {
+		return nil
+	}
+	_, err := e.run("holding snapshots", append([]string{"hold", tag}, snaps...)...)
+	return err
+}
+
+// Release removes the user hold tag from snaps.
+func (e Endpoint) Release(tag string, snaps ...string) error {
+	if len(snaps) == 0 {
+		return nil
+	}
+	_, err := e.run("releasing snapshots", append([]string{"release", tag}, snaps...)...)
+	return err
+}
+
+// Bookmark creates bookmark, of the form vol#name, from snap.
+func (e Endpoint) Bookmark(snap, bookmark string) error {
+	_, err := e.run("creating bookmark", "bookmark", snap, bookmark)
+	return err
+}
@@ -0,0 +1,128 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Units selects binary (IEC, powers of 1024) or decimal (SI, powers of
+// 1000) byte units.
+type Units int
+
+const (
+	IEC Units = iota
+	SI
+)
+
+const (
+	kB = 1 << (10 * (iota + 1))
+	mB
+	gB
+	tB
+	pB
+	eB
+)
+
+type unit struct {
+	size   int64
+	suffix string
+}
+
+var iecUnits = []unit{
+	{eB, "EiB"},
+	{pB, "PiB"},
+	{tB, "TiB"},
+	{gB, "GiB"},
+	{mB, "MiB"},
+	{kB, "kiB"},
+}
+
+var siUnits = []unit{
+	{1e18, "EB"},
+	{1e15, "PB"},
+	{1e12, "TB"},
+	{1e9, "GB"},
+	{1e6, "MB"},
+	{1e3, "kB"},
+}
+
+// HumanBytes formats size using IEC units, e.g. "1.50 GiB".
+func HumanBytes(size int64) string {
+	return FormatBytes(size, IEC)
+}
+
+// FormatBytes formats size using the given units.
+func FormatBytes(size int64, units Units) string {
+	table := iecUnits
+	if units == SI {
+		table = siUnits
+	}
+	for _, u := range table {
+		if size >= u.size {
+			return format(size, u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
+func format(size int64, unit int64, suffix string) string {
+	return fmt.Sprintf("%.2f %s", float64(size)/float64(unit), suffix)
+}
+
+// multipliers maps lower-case unit suffixes to their size in bytes. Bare
+// single-letter suffixes are binary, matching zfs conventions.
+var multipliers = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   kB,
+	"m":   mB,
+	"g":   gB,
+	"t":   tB,
+	"p":   pB,
+	"e":   eB,
+	"kib": kB,
+	"mib": mB,
+	"gib": gB,
+	"tib": tB,
+	"pib": pB,
+	"eib": eB,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+	"eb":  1e18,
+}
+
+// ParseBytes parses a byte size such as "512", "10GiB", "1.5 TB" or "100M".
+// IEC suffixes (KiB, MiB, ...) and bare letters (K, M, G, ...) are powers
+// of 1024; SI suffixes (kB, MB, GB, ...) are powers of 1000. Suffixes are
+// case-insensitive.
+func ParseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	num, suffix := s[:i], strings.ToLower(strings.TrimSpace(s[i:]))
+	if num == "" {
+		return 0, fmt.Errorf("invalid size %q: no number", s)
+	}
+	mult, ok := multipliers[suffix]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, s[i:])
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	v := f * float64(mult)
+	if v >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return int64(v), nil
+}
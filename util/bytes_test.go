@@ -0,0 +1,97 @@
+package util
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{" 512 B ", 512, false},
+		{"100M", 100 << 20, false},
+		{"1k", 1 << 10, false},
+		{"10GiB", 10 << 30, false},
+		{"10gib", 10 << 30, false},
+		{"1kB", 1000, false},
+		{"1KB", 1000, false},
+		{"1.5 TB", 1500000000000, false},
+		{"1.5TiB", 3 << 39, false},
+		{"0.5K", 512, false},
+		{".25MB", 250000, false},
+		{"1.0000001k", 1024, false},
+		{"9EB", 9e18, false},
+		{"7.5EiB", 15 << 59, false},
+		{"8EiB", 0, true},
+		{"10EB", 0, true},
+		{"9999999999999999999", 0, true},
+		{"", 0, true},
+		{"GiB", 0, true},
+		{"-1G", 0, true},
+		{"1.2.3G", 0, true},
+		{"12X", 0, true},
+		{"12 KiBs", 0, true},
+		{"1e3", 0, true},
+		{"10 G B", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBytes(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBytes(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		size  int64
+		units Units
+		want  string
+	}{
+		{0, IEC, "0 B"},
+		{1023, IEC, "1023 B"},
+		{1024, IEC, "1.00 kiB"},
+		{1536, IEC, "1.50 kiB"},
+		{10 << 30, IEC, "10.00 GiB"},
+		{1000, IEC, "1000 B"},
+		{999, SI, "999 B"},
+		{1000, SI, "1.00 kB"},
+		{1024, SI, "1.02 kB"},
+		{1500000000000, SI, "1.50 TB"},
+		{10 << 30, SI, "10.74 GB"},
+		{math.MaxInt64, IEC, "8.00 EiB"},
+		{math.MaxInt64, SI, "9.22 EB"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.size, tt.units); got != tt.want {
+			t.Errorf("FormatBytes(%d, %d) = %q, want %q", tt.size, tt.units, got, tt.want)
+		}
+	}
+}
+
+// TestFormatParseBytes checks that formatted sizes parse back to within
+// the two decimals shown.
+func TestFormatParseBytes(t *testing.T) {
+	for _, size := range []int64{1, 1000, 1 << 20, 123456789, 5 << 40, 1 << 62} {
+		for _, units := range []Units{IEC, SI} {
+			s := FormatBytes(size, units)
+			got, err := ParseBytes(s)
+			if err != nil {
+				t.Errorf("ParseBytes(FormatBytes(%d)) = %v", size, err)
+				continue
+			}
+			if d := math.Abs(float64(got-size)) / float64(size); d > 0.005 {
+				t.Errorf("ParseBytes(%q) = %d, want about %d", s, got, size)
+			}
+		}
+	}
+}
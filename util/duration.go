@@ -0,0 +1,48 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// HumanDuration formats d for reports, e.g. "850ms", "12.3s", "4m 05s" or
+// "2d 03h". Only the two most significant units are shown above a minute.
+func HumanDuration(d time.Duration) string {
+	// The magnitude is taken as a uint64, since -d overflows for the most
+	// negative Duration.
+	sign, abs := "", uint64(d)
+	if d < 0 {
+		sign, abs = "-", -abs
+	}
+	// Round to the precision shown before choosing the unit, so 59.96s
+	// becomes "1m 00s" rather than "60.0s".
+	if ms := round(abs, time.Millisecond); ms < 1000 {
+		return sign + (time.Duration(ms) * time.Millisecond).String()
+	}
+	if tenths := round(abs, 100*time.Millisecond); tenths < 600 {
+		return fmt.Sprintf("%s%d.%ds", sign, tenths/10, tenths%10)
+	}
+
+	secs := round(abs, time.Second)
+	parts := []struct {
+		n      uint64
+		suffix string
+	}{
+		{secs / (24 * 60 * 60), "d"},
+		{secs / (60 * 60) % 24, "h"},
+		{secs / 60 % 60, "m"},
+		{secs % 60, "s"},
+	}
+	for len(parts) > 2 && parts[0].n == 0 {
+		parts = parts[1:]
+	}
+	out := []string{fmt.Sprintf("%d%s", parts[0].n, parts[0].suffix)}
+	out = append(out, fmt.Sprintf("%02d%s", parts[1].n, parts[1].suffix))
+	return sign + strings.Join(out, " ")
+}
+
+// round returns abs in units of unit, rounded half up.
+func round(abs uint64, unit time.Duration) uint64 {
+	return (abs + uint64(unit)/2) / uint64(unit)
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "0s"},
+		{850 * time.Millisecond, "850ms"},
+		{999400 * time.Microsecond, "999ms"},
+		{999600 * time.Microsecond, "1.0s"},
+		{12300 * time.Millisecond, "12.3s"},
+		{59940 * time.Millisecond, "59.9s"},
+		{59960 * time.Millisecond, "1m 00s"},
+		{-59960 * time.Millisecond, "-1m 00s"},
+		{4*time.Minute + 5*time.Second, "4m 05s"},
+		{4*time.Minute + 5*time.Second + 600*time.Millisecond, "4m 06s"},
+		{2*time.Hour + 3*time.Minute, "2h 03m"},
+		{2*24*time.Hour + 3*time.Hour + 59*time.Minute, "2d 03h"},
+		{-12300 * time.Millisecond, "-12.3s"},
+		{-(4*time.Minute + 5*time.Second), "-4m 05s"},
+		{math.MaxInt64, "106751d 23h"},
+		{math.MinInt64, "-106751d 23h"},
+	}
+	for _, tt := range tests {
+		if got := HumanDuration(tt.d); got != tt.want {
+			t.Errorf("HumanDuration(%d) = %q, want %q", int64(tt.d), got, tt.want)
+		}
+	}
+}
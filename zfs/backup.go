@@ -1,53 +1,171 @@
+// Package zfs replicates ZFS filesystems to a target filesystem using
+// snapshots and zfs send/receive.
+//
+// Create a Backup with NewBackup and functional options, parse source
+// specifications with ParseSource, and run them with RunBackup.
 package zfs
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jamesmcdonald/zfsbackup/util"
 )
 
+// Source is a filesystem to back up, optionally including its descendants.
 type Source struct {
 	vol     string
 	recurse bool
+	retain  int // snapshots to keep, or 0 for the Backup's setting
 }
 
 func (s Source) String() string {
+	str := s.vol
 	if s.recurse {
-		return s.vol + "/..."
+		str += "/..."
 	}
-	return s.vol
+	if s.retain > 0 {
+		str += ",retain=" + strconv.Itoa(s.retain)
+	}
+	return str
+}
+
+// Recursive reports whether s covers the descendants of its dataset too.
+func (s Source) Recursive() bool {
+	return s.recurse
 }
 
-// ParseSource parses a source specification.
-// "pool/data/..." → {vol: "pool/data", recurse: true}
-// "pool/data"     → {vol: "pool/data", recurse: false}
+// Overlaps reports whether s and other cover a dataset in common, so
+// backups of both snapshot it.
+func (s Source) Overlaps(other Source) bool {
+	return s.vol == other.vol ||
+		s.recurse && strings.HasPrefix(other.vol, s.vol+"/") ||
+		other.recurse && strings.HasPrefix(s.vol, other.vol+"/")
+}
+
+// ParseSource parses a source specification, optionally followed by
+// comma-separated settings for this source.
+// "pool/data/..."          → {vol: "pool/data", recurse: true}
+// "pool/data"              → {vol: "pool/data", recurse: false}
+// "pool/data/...,retain=7" → {vol: "pool/data", recurse: true, retain: 7}
 func ParseSource(s string) (Source, error) {
-	recurse := strings.HasSuffix(s, "/...")
-	vol := strings.TrimSuffix(s, "/...")
+	spec, settings, _ := strings.Cut(s, ",")
+	recurse := strings.HasSuffix(spec, "/...")
+	vol := strings.TrimSuffix(spec, "/...")
 	if vol == "" {
 		return Source{}, fmt.Errorf("source volume cannot be empty")
 	}
-	return Source{vol: vol, recurse: recurse}, nil
+	src := Source{vol: vol, recurse: recurse}
+	if settings == "" {
+		return src, nil
+	}
+	for _, setting := range strings.Split(settings, ",") {
+		key, value, _ := strings.Cut(setting, "=")
+		switch key {
+		case "retain":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return Source{}, fmt.Errorf("invalid retain %q: must be a positive number", value)
+			}
+			src.retain = n
+		default:
+			return Source{}, fmt.Errorf("unknown source setting %q", key)
+		}
+	}
+	return src, nil
 }
 
+// Backup replicates sources to datasets under a target filesystem.
 type Backup struct {
-	target    string
-	dryrun    bool
-	sourceCmd []string
-	targetCmd []string
-	logger    *slog.Logger
+	target         string
+	dryrun         bool
+	debug          bool
+	sourceCmd      []string
+	targetCmd      []string
+	targetPruneCmd []string
+	logger         *slog.Logger
+	cmdOut         io.Writer
+	progress       ProgressMode
+	pvPath         string
+	noEstimate     bool
+	unmount        bool
+
+	preSnapshot       []string
+	postSnapshot      []string
+	hookTimeout       time.Duration
+	priority          []string
+	deadline          time.Time
+	deferred          []string
+	diffSummary       bool
+	diffTop           int
+	labels            map[string]string
+	owner             string
+	sweepOrphans      bool
+	hostNamespace     string
+	niceWrap          []string
+	systemdProps      []string
+	logDir            string
+	logRetain         int
+	smartCheck        SmartMode
+	explainPlan       bool
+	index             *datasetIndex
+	memo              *queryMemo
+	profiling         bool
+	profile           *runProfile
+	estimateThreshold int64
+	divergence        DivergencePolicy
+	checkPoolErrors   bool
+	relayOwner        string
+	backend           Target
+	producer          StreamSource
+	results           []SourceResult
+	retain            int
+	retainTarget      int
+	retention         RetentionPolicy
+	rootCheck         RootMode
+	sshSource         *sshEndpoint
+	sshTarget         *sshEndpoint
+	sshClients        *sshClients
+	readOnly          bool
+	journal           *journal
+	job               string
+	snapshotPrefix    string
+	maxDatasets       int
+	maxSnapshots      int
+	excludeEphemeral  bool
+	honorAutoSnapshot bool
+	targetReadonly    bool
+	atomicSnapshots   bool
+	holdTarget        bool
+	checkDrift        bool
+	syncHistory       bool
+	historyPattern    string
+	snapshotWarn      int
+	nDatasets         int
+	nSnapshots        int
+	recorder          *json.Encoder
+	replay            []recordEntry
+	replaying         bool
+	mu                sync.Mutex // guards recorder, replay and cmdOut
 }
 
+// BackupOption configures a Backup in NewBackup.
 type BackupOption func(*Backup) error
 
+// WithDryRunOption skips every command that changes state. Read-only
+// queries still run so the backup can be planned.
 func WithDryRunOption() BackupOption {
 	return func(b *Backup) error {
 		b.dryrun = true
@@ -55,6 +173,17 @@ func WithDryRunOption() BackupOption {
 	}
 }
 
+// WithDebugOption echoes every executed command and logs debug messages
+// at info level, regardless of the logger's level.
+func WithDebugOption() BackupOption {
+	return func(b *Backup) error {
+		b.debug = true
+		return nil
+	}
+}
+
+// WithSourceCommandOption sets the zfs command used on the source, e.g.
+// []string{"sudo", "zfs"}. The default is "zfs".
 func WithSourceCommandOption(cmd []string) BackupOption {
 	return func(b *Backup) error {
 		b.sourceCmd = cmd
@@ -62,6 +191,8 @@ func WithSourceCommandOption(cmd []string) BackupOption {
 	}
 }
 
+// WithTargetCommandOption sets the zfs command used on the target, e.g.
+// []string{"ssh", "backuphost", "zfs"}. The default is "zfs".
 func WithTargetCommandOption(cmd []string) BackupOption {
 	return func(b *Backup) error {
 		b.targetCmd = cmd
@@ -69,6 +200,99 @@ func WithTargetCommandOption(cmd []string) BackupOption {
 	}
 }
 
+// WithTargetPruneCommandOption sets a separate zfs command for destroying
+// old snapshots on the target, e.g. []string{"ssh", "pruner@backuphost",
+// "zfs"}. This lets the identity used for receives be delegated only
+// create and receive, while a rarely-used one holds destroy. The default
+// is the target command.
+func WithTargetPruneCommandOption(cmd []string) BackupOption {
+	return func(b *Backup) error {
+		b.targetPruneCmd = cmd
+		return nil
+	}
+}
+
+// WithPrintCommandsOption writes every write command and pipeline to w,
+// shell-quoted, as it would be executed. This also applies in dry-run mode.
+func WithPrintCommandsOption(w io.Writer) BackupOption {
+	return func(b *Backup) error {
+		b.cmdOut = w
+		return nil
+	}
+}
+
+// WithProgressOption selects how send progress is displayed. The default is ProgressAuto.
+func WithProgressOption(mode ProgressMode) BackupOption {
+	return func(b *Backup) error {
+		if _, err := ParseProgressMode(string(mode)); err != nil {
+			return err
+		}
+		b.progress = mode
+		return nil
+	}
+}
+
+// WithNoEstimateOption skips the `zfs send -n -P` size estimate before each
+// send. Progress is then shown without a total.
+func WithNoEstimateOption() BackupOption {
+	return func(b *Backup) error {
+		b.noEstimate = true
+		return nil
+	}
+}
+
+// WithUnmountTargetOption unmounts a mounted target dataset before
+// receiving into it and mounts it again afterwards.
+func WithUnmountTargetOption() BackupOption {
+	return func(b *Backup) error {
+		b.unmount = true
+		return nil
+	}
+}
+
+// WithAtomicSnapshotsOption snapshots every dataset of every source,
+// including all descendants of recursive sources, in a single atomic zfs
+// snapshot command. Use it for applications whose data spans several
+// datasets, such as a database and its write-ahead log.
+func WithAtomicSnapshotsOption() BackupOption {
+	return func(b *Backup) error {
+		b.atomicSnapshots = true
+		return nil
+	}
+}
+
+// WithSnapshotWarnOption warns when a source or target dataset has more
+// than threshold snapshots in total, counting those made by other tools.
+// Ballooning snapshot counts slow down zfs list and usually mean cleanup
+// is broken somewhere.
+func WithSnapshotWarnOption(threshold int) BackupOption {
+	return func(b *Backup) error {
+		if threshold < 0 {
+			return fmt.Errorf("snapshot warning threshold cannot be negative")
+		}
+		b.snapshotWarn = threshold
+		return nil
+	}
+}
+
+// WithTargetReadonlyOption sets readonly=on on every received dataset.
+func WithTargetReadonlyOption() BackupOption {
+	return func(b *Backup) error {
+		b.targetReadonly = true
+		return nil
+	}
+}
+
+// WithDriftCheckOption warns when a target dataset has been written to
+// since its latest snapshot, before receiving into it.
+func WithDriftCheckOption() BackupOption {
+	return func(b *Backup) error {
+		b.checkDrift = true
+		return nil
+	}
+}
+
+// WithLogger sets the logger. The default is slog.Default().
 func WithLogger(logger *slog.Logger) BackupOption {
 	return func(b *Backup) error {
 		b.logger = logger
@@ -76,6 +300,8 @@ func WithLogger(logger *slog.Logger) BackupOption {
 	}
 }
 
+// NewBackup returns a Backup that replicates into target, which must not
+// be empty. Each source filesystem fs is received as target/fs.
 func NewBackup(target string, opts ...BackupOption) (*Backup, error) {
 	if target == "" {
 		return nil, fmt.Errorf("target filesystem cannot be empty")
@@ -85,21 +311,77 @@ func NewBackup(target string, opts ...BackupOption) (*Backup, error) {
 		sourceCmd: []string{"zfs"},
 		targetCmd: []string{"zfs"},
 		logger:    slog.Default(),
+		progress:  ProgressAuto,
+		owner:     DefaultOwner,
+		memo:      newQueryMemo(),
+		retain:    defaultRetain,
 	}
 	for _, opt := range opts {
 		if err := opt(b); err != nil {
 			return nil, fmt.Errorf("error applying option: %w", err)
 		}
 	}
+	if err := b.expandTemplates(); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(b.snapshotPrefix, "/@# ") {
+		return nil, fmt.Errorf("invalid snapshot prefix %q", b.snapshotPrefix)
+	}
+	if b.producer == nil {
+		b.producer = &zfsSource{b: b}
+	}
+	if b.backend == nil {
+		b.backend = &zfsTarget{b: b}
+	} else if opts := b.zfsTargetOnly(); len(opts) > 0 {
+		return nil, fmt.Errorf("%s need a ZFS target", strings.Join(opts, ", "))
+	}
 	if len(b.sourceCmd) == 0 {
 		return nil, fmt.Errorf("source command cannot be empty")
 	}
 	if len(b.targetCmd) == 0 {
 		return nil, fmt.Errorf("target command cannot be empty")
 	}
+	if b.sweepOrphans && b.owner == DefaultOwner {
+		return nil, fmt.Errorf("sweeping orphans needs an owner specific to the target instead of the default %q", DefaultOwner)
+	}
+	if b.sshClients != nil && b.sshSource == nil && b.sshTarget == nil {
+		return nil, fmt.Errorf("native ssh needs a source or target host")
+	}
+	if b.progress == ProgressAuto || b.progress == ProgressPV {
+		pvPath, err := exec.LookPath("pv")
+		if err == nil {
+			b.pvPath = pvPath
+		} else if b.progress == ProgressPV {
+			return nil, fmt.Errorf("progress mode pv requested but pv not found: %w", err)
+		}
+	}
+	if len(b.labels) > 0 {
+		b.logger = b.logger.With("labels", b.labels)
+	}
+	if b.job != "" {
+		b.logger = b.logger.With("job", b.job)
+	}
+	if b.hostNamespace != "" {
+		b.target = fmt.Sprintf("%s/%s", strings.TrimSuffix(b.target, "/"), b.hostNamespace)
+	}
 	return b, nil
 }
 
+// logDebug logs at debug level, or at info level if WithDebugOption is set.
+func (b *Backup) logDebug(msg string, args ...any) {
+	level := slog.LevelDebug
+	if b.debug {
+		level = slog.LevelInfo
+	}
+	b.logger.Log(context.Background(), level, msg, args...)
+}
+
+// Target returns the target filesystem, with templates resolved and the
+// host namespace applied.
+func (b *Backup) Target() string {
+	return b.target
+}
+
 func (b *Backup) isTargetVolume(vol string) bool {
 	target := strings.TrimSuffix(b.target, "/")
 	return strings.HasPrefix(vol, target+"/")
@@ -115,11 +397,10 @@ func (b *Backup) buildCommand(isTarget bool, args ...string) []string {
 	return append(base, args...)
 }
 
+// wrapCmdError wraps the failure of a command run for operation in a
+// classified *CommandError.
 func (b *Backup) wrapCmdError(operation string, stderr string, err error) error {
-	if stderr != "" {
-		return fmt.Errorf("error %s: %s: %w", operation, stderr, err)
-	}
-	return fmt.Errorf("error %s: %w", operation, err)
+	return &CommandError{Op: operation, Stderr: stderr, Class: ClassifyStderr(stderr), Err: err}
 }
 
 func splitSnapshot(fullName string) (vol, snap string) {
@@ -130,120 +411,264 @@ func splitSnapshot(fullName string) (vol, snap string) {
 	return fullName, ""
 }
 
-// execCmd always executes a single command, regardless of dry-run mode.
-func (b *Backup) execCmd(args []string) ([]string, string, error) {
+// newCommand returns an exec.Cmd for args running in the C locale, so zfs
+// output and error messages can be parsed regardless of the user's locale.
+func newCommand(args []string) *exec.Cmd {
 	c := exec.Command(args[0], args[1:]...)
-	var stdoutBuf, stderrBuf bytes.Buffer
-	c.Stdout = &stdoutBuf
-	c.Stderr = &stderrBuf
-
-	err := c.Run()
-
-	var stdoutLines []string
-	if stdoutBuf.Len() > 0 {
-		stdoutLines = strings.Split(strings.TrimRight(stdoutBuf.String(), "\n"), "\n")
-	}
-
-	if err == nil {
-		return stdoutLines, "", nil
-	}
+	c.Env = append(os.Environ(), "LC_ALL=C")
+	return c
+}
 
-	stderrStr := strings.TrimSpace(stderrBuf.String())
-	if stderrStr == "" {
-		stderrStr = err.Error()
-	}
-	return stdoutLines, stderrStr, err
+// Exec runs a single command in the C locale and returns its output lines
+// and, if it failed, its stderr. Output lines and stderr are bounded as
+// for every command zfsbackup runs. It is exported so other tools can
+// reuse the plumbing; Backup runs it only through its dry-run, record and
+// replay handling.
+func Exec(args []string) ([]string, string, error) {
+	return runProcess(localProcess{newCommand(args)})
 }
 
 // execPipeline always executes a pipeline of commands, regardless of dry-run mode.
-func (b *Backup) execPipeline(allCmds [][]string) ([]string, string, error) {
+// If meter is not nil, the output of the first command is copied through it.
+// If sessionLog is not nil, the stderr and exit status of every stage are
+// written to it.
+func (b *Backup) execPipeline(allCmds [][]string, meter *progressMeter, sessionLog io.Writer) ([]string, string, error) {
 	if len(allCmds) < 2 {
 		return nil, "", fmt.Errorf("pipeline needs at least 2 commands")
 	}
 
-	var cmds []*exec.Cmd
+	var cmds []process
 	for _, cmdArgs := range allCmds {
 		if len(cmdArgs) == 0 {
 			return nil, "", fmt.Errorf("empty command in pipeline")
 		}
-		cmds = append(cmds, exec.Command(cmdArgs[0], cmdArgs[1:]...))
+		cmds = append(cmds, b.newProcess(cmdArgs))
 	}
 
+	var meterIn io.ReadCloser
+	var meterOut io.WriteCloser
 	for i := 0; i < len(cmds)-1; i++ {
-		stdout, err := cmds[i].StdoutPipe()
+		stdout, err := cmds[i].stdoutPipe()
 		if err != nil {
 			return nil, "", fmt.Errorf("error setting up pipe: %w", err)
 		}
-		cmds[i+1].Stdin = stdout
+		if i == 0 && meter != nil {
+			stdin, err := cmds[1].stdinPipe()
+			if err != nil {
+				return nil, "", fmt.Errorf("error setting up pipe: %w", err)
+			}
+			meterIn, meterOut = stdout, stdin
+			continue
+		}
+		cmds[i+1].setStdin(stdout)
 	}
 
-	// Route pv stderr to the terminal so progress is visible.
+	// Route pv stderr to the terminal so progress is visible, and capture
+	// the stderr of every other stage.
+	stderrBufs := make([]*bytes.Buffer, len(cmds))
 	for i, cmd := range cmds {
-		if i > 0 && i < len(cmds)-1 && len(cmd.Args) > 0 && strings.HasSuffix(cmd.Args[0], "pv") {
-			cmd.Stderr = os.Stderr
+		if i > 0 && i < len(cmds)-1 && strings.HasSuffix(allCmds[i][0], "pv") {
+			cmd.setStderr(os.Stderr)
+			continue
 		}
+		stderrBufs[i] = &bytes.Buffer{}
+		cmd.setStderr(stderrBufs[i])
 	}
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	cmds[len(cmds)-1].Stdout = &stdoutBuf
-	cmds[len(cmds)-1].Stderr = &stderrBuf
+	var stdoutBuf bytes.Buffer
+	cmds[len(cmds)-1].setStdout(&stdoutBuf)
 
 	for i, cmd := range cmds {
-		if err := cmd.Start(); err != nil {
+		if err := cmd.start(); err != nil {
+			for _, started := range cmds[:i] {
+				started.kill()
+				started.wait()
+			}
 			return nil, "", fmt.Errorf("error starting command %d: %w", i, err)
 		}
 	}
 
-	var errs []error
+	// Wait for all stages at once, so a failing stage can stop the stages
+	// feeding it instead of leaving them to run until they fill the pipe.
+	var meterErr error
+	meterDone := make(chan struct{})
+	if meter != nil {
+		go func() {
+			defer close(meterDone)
+			meterErr = meter.copy(meterOut, meterIn)
+			// Close both ends so neither neighbour blocks if the other side failed.
+			meterOut.Close()
+			meterIn.Close()
+		}()
+	} else {
+		close(meterDone)
+	}
+	// Waiting for a stage closes its stdout, so a stage whose output is
+	// read in this process, by the meter or because it or the next stage
+	// runs over an ssh session, is only waited for once the reader is done.
+	read := make([]chan struct{}, len(cmds))
+	readByNext := make([]bool, len(cmds))
+	for i := range cmds {
+		switch {
+		case i == 0 && meter != nil:
+			read[i] = meterDone
+		case i < len(cmds)-1 && (isRemote(cmds[i]) || isRemote(cmds[i+1])):
+			read[i], readByNext[i] = make(chan struct{}), true
+		default:
+			read[i] = make(chan struct{})
+			close(read[i])
+		}
+	}
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result)
 	for i, cmd := range cmds {
-		if err := cmd.Wait(); err != nil {
-			errs = append(errs, fmt.Errorf("command %d failed: %w", i, err))
+		go func() {
+			<-read[i]
+			err := cmd.wait()
+			if i > 0 && readByNext[i-1] {
+				close(read[i-1])
+			}
+			results <- result{i, err}
+		}()
+	}
+	waitErrs := make([]error, len(cmds))
+	done := make([]bool, len(cmds))
+	killed := make([]bool, len(cmds))
+	for range cmds {
+		r := <-results
+		done[r.i] = true
+		waitErrs[r.i] = r.err
+		if r.err == nil || killed[r.i] {
+			continue
+		}
+		for j := range r.i {
+			if !done[j] && !killed[j] {
+				b.logDebug("stopping upstream pipeline stage", "stage", stageName(allCmds[j]), "failed", stageName(allCmds[r.i]))
+				cmds[j].kill()
+				killed[j] = true
+			}
 		}
 	}
+	<-meterDone
+
+	var pipeErr PipelineError
+	for i, err := range waitErrs {
+		if err == nil {
+			continue
+		}
+		stage := PipelineStage{Index: i, Name: stageName(allCmds[i]), Cmd: allCmds[i], ExitCode: exitCode(err), Err: err}
+		if stderrBufs[i] != nil {
+			stage.Stderr = strings.TrimSpace(strings.ToValidUTF8(stderrBufs[i].String(), "\uFFFD"))
+		}
+		pipeErr.Failed = append(pipeErr.Failed, stage)
+	}
+	pipeErr.Failed = rootCauses(pipeErr.Failed, killed)
+
+	if sessionLog != nil {
+		stderrs := make([][]byte, len(cmds))
+		for i, buf := range stderrBufs {
+			if buf != nil {
+				stderrs[i] = buf.Bytes()
+			}
+		}
+		writeSessionLog(sessionLog, allCmds, stderrs, waitErrs)
+	}
 
 	var stdoutLines []string
 	if stdoutBuf.Len() > 0 {
 		stdoutLines = strings.Split(strings.TrimRight(stdoutBuf.String(), "\n"), "\n")
 	}
-	stderrStr := strings.TrimSpace(stderrBuf.String())
-
-	if len(errs) == 0 {
-		return stdoutLines, "", nil
+	if len(pipeErr.Failed) > 0 {
+		stderrStr := pipeErr.Stderr()
+		if stderrStr == "" {
+			stderrStr = pipeErr.Error()
+		}
+		return stdoutLines, stderrStr, &pipeErr
 	}
-
-	err := errs[0]
-	if stderrStr == "" {
-		stderrStr = err.Error()
+	if meterErr != nil {
+		return stdoutLines, meterErr.Error(), fmt.Errorf("progress meter failed: %w", meterErr)
 	}
-	return stdoutLines, stderrStr, err
+	return stdoutLines, "", nil
 }
 
 // query runs a read-only command. Always executes, even in dry-run mode.
+// Results are memoized for the rest of the run until a write touches a
+// dataset the query mentions.
 func (b *Backup) query(args ...string) ([]string, string, error) {
-	return b.execCmd(args)
+	if r, ok := b.memo.get(args); ok {
+		return r.stdout, r.stderr, r.err
+	}
+	stdout, stderr, err := b.exec([][]string{args}, nil, nil)
+	b.memo.put(memoResult{args: args, stdout: stdout, stderr: stderr, err: err})
+	return stdout, stderr, err
+}
+
+// printCommands writes cmds as a single shell pipeline if command printing
+// is enabled, in the form they are run, so the line can be pasted into a
+// shell.
+func (b *Backup) printCommands(cmds ...[]string) {
+	if b.cmdOut == nil {
+		return
+	}
+	shellCmds := make([][]string, len(cmds))
+	for i, c := range cmds {
+		shellCmds[i] = b.shellCommand(c)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintln(b.cmdOut, quotePipeline(shellCmds))
 }
 
 // run executes a write command. Skipped in dry-run mode.
 func (b *Backup) run(args ...string) ([]string, string, error) {
+	defer b.memo.invalidate(args)
+	b.printCommands(args)
 	if b.dryrun {
 		b.logger.Info("dry run: skip", "args", args)
 		return nil, "", nil
 	}
-	return b.execCmd(args)
+	cmds := [][]string{args}
+	return b.journaled(cmds, func() ([]string, string, error) {
+		return b.exec(cmds, nil, nil)
+	})
 }
 
 // pipeline executes a write pipeline. Skipped in dry-run mode.
-func (b *Backup) pipeline(cmds [][]string) ([]string, string, error) {
+func (b *Backup) pipeline(cmds [][]string, meter *progressMeter, sessionLog io.Writer) ([]string, string, error) {
+	defer b.memo.invalidate(cmds[len(cmds)-1])
+	b.printCommands(cmds...)
 	if b.dryrun {
 		b.logger.Info("dry run: skip", "cmds", cmds)
 		return nil, "", nil
 	}
-	return b.execPipeline(cmds)
+	return b.journaled(cmds, func() ([]string, string, error) {
+		return b.exec(cmds, meter, sessionLog)
+	})
 }
 
 func (b *Backup) listSnapshots(vol string) ([]string, error) {
-	args := b.buildCommand(b.isTargetVolume(vol), "list", "-H", "-o", "name", "-t", "snapshot", "-s", "creation", vol)
-	snaps, stderr, err := b.query(args...)
+	return b.listSnapshotsOn(b.isTargetVolume(vol), vol)
+}
+
+// listSnapshotsOn is listSnapshots for vol on the target if isTarget is
+// set, or on the source otherwise.
+func (b *Backup) listSnapshotsOn(isTarget bool, vol string) ([]string, error) {
+	if indexed, ok := b.indexedSnapshots(vol); ok {
+		snaps := make([]string, len(indexed))
+		for i, s := range indexed {
+			snaps[i] = s.name
+		}
+		return snaps, nil
+	}
+	args := b.buildCommand(isTarget, "list", "-H", "-o", "name", "-t", "snapshot", "-d", "1", "-s", "creation", vol)
+	var snaps []string
+	stderr, err := b.queryEach(func(name string) error {
+		snaps = append(snaps, name)
+		return nil
+	}, args...)
 	if err != nil {
 		return nil, b.wrapCmdError("listing snapshots", stderr, err)
 	}
@@ -259,7 +684,26 @@ func (b *Backup) getLatestMatchingSnapshot(source, target string) (string, error
 	if err != nil {
 		return "", err
 	}
+	return latestCommonSnapshot(sourceSnaps, targetSnaps, target)
+}
+
+// latestBackedUpSnapshot returns the newest snapshot of fs that the
+// target also has for targetVol.
+func (b *Backup) latestBackedUpSnapshot(fs, targetVol string) (string, error) {
+	sourceSnaps, err := b.producer.ListSnapshots(fs)
+	if err != nil {
+		return "", err
+	}
+	targetSnaps, err := b.backend.ListSnapshots(targetVol)
+	if err != nil {
+		return "", err
+	}
+	return latestCommonSnapshot(sourceSnaps, targetSnaps, targetVol)
+}
 
+// latestCommonSnapshot returns the newest of sourceSnaps whose name is
+// also in targetSnaps, the snapshots of target.
+func latestCommonSnapshot(sourceSnaps, targetSnaps []string, target string) (string, error) {
 	for i := len(sourceSnaps) - 1; i >= 0; i-- {
 		_, snapPart := splitSnapshot(sourceSnaps[i])
 		if snapPart == "" {
@@ -270,46 +714,97 @@ func (b *Backup) getLatestMatchingSnapshot(source, target string) (string, error
 			return sourceSnaps[i], nil
 		}
 	}
-	return "", fmt.Errorf("no matching snapshot found")
+	return "", errNoMatchingSnapshot
 }
 
 func (b *Backup) listFilesystems(vol string) ([]string, error) {
 	args := b.buildCommand(false, "list", "-H", "-o", "name", "-r", "-t", "filesystem,volume", vol)
-	lines, stderr, err := b.query(args...)
+	var filesystems []string
+	stderr, err := b.queryEach(func(name string) error {
+		filesystems = append(filesystems, name)
+		return nil
+	}, args...)
 	if err != nil {
 		return nil, b.wrapCmdError("listing filesystems", stderr, err)
 	}
-	return lines, nil
+	return filesystems, nil
 }
 
-func (b *Backup) datasetExists(vol string) bool {
-	args := b.buildCommand(b.isTargetVolume(vol), "list", "-H", "-t", "filesystem,volume", vol)
-	_, _, err := b.query(args...)
-	return err == nil
+// datasetExists reports whether vol exists. Failures other than zfs
+// reporting that the dataset doesn't exist, such as permission errors or
+// a broken ssh connection, are returned as errors.
+func (b *Backup) datasetExists(vol string) (bool, error) {
+	return b.datasetExistsOn(b.isTargetVolume(vol), vol)
 }
 
-// createSnapshot creates a snapshot on vol and returns just the snapshot name (timestamp).
-func (b *Backup) createSnapshot(vol string, recurse bool) (string, error) {
-	snapName := time.Now().Format("2006-01-02T15:04:05")
-	if b.dryrun {
-		b.logger.Info("dry run: would create snapshot", "snapshot", snapName, "vol", vol, "recurse", recurse)
-		return snapName, nil
+// datasetExistsOn is datasetExists for vol on the target if isTarget is
+// set, or on the source otherwise.
+func (b *Backup) datasetExistsOn(isTarget bool, vol string) (bool, error) {
+	if exists, ok := b.indexedExists(vol); ok {
+		return exists, nil
+	}
+	args := b.buildCommand(isTarget, "list", "-H", "-t", "filesystem,volume", vol)
+	_, stderr, err := b.query(args...)
+	if err == nil {
+		return true, nil
+	}
+	if isNotFoundError(stderr) {
+		return false, nil
 	}
+	return false, b.wrapCmdError(fmt.Sprintf("checking whether %s exists", vol), stderr, err)
+}
 
-	b.logger.Info("creating snapshot", "vol", vol, "snapshot", snapName, "recurse", recurse)
+// createSnapshot creates the snapshot vol@snapName.
+func (b *Backup) createSnapshot(vol, snapName string, recurse bool) error {
 	snap := fmt.Sprintf("%s@%s", vol, snapName)
 	args := []string{"snapshot"}
 	if recurse {
 		args = append(args, "-r")
 	}
+	for _, prop := range b.snapshotProps() {
+		args = append(args, "-o", prop)
+	}
 	args = append(args, snap)
+	cmdArgs := b.buildCommand(false, args...)
+
+	if b.dryrun {
+		b.logger.Info("dry run: would create snapshot", "snapshot", snapName, "vol", vol, "recurse", recurse)
+		b.printCommands(cmdArgs)
+		return nil
+	}
+
+	b.logger.Info("creating snapshot", "vol", vol, "snapshot", snapName, "recurse", recurse)
+	_, stderr, err := b.run(cmdArgs...)
+	if err != nil {
+		return b.wrapCmdError("creating snapshot", stderr, err)
+	}
+	return nil
+}
 
+// createAtomicSnapshot snapshots every dataset in vols with one zfs
+// snapshot command, which ZFS applies atomically.
+func (b *Backup) createAtomicSnapshot(vols []string, snapName string) error {
+	args := []string{"snapshot"}
+	for _, prop := range b.snapshotProps() {
+		args = append(args, "-o", prop)
+	}
+	for _, vol := range vols {
+		args = append(args, fmt.Sprintf("%s@%s", vol, snapName))
+	}
 	cmdArgs := b.buildCommand(false, args...)
+
+	if b.dryrun {
+		b.logger.Info("dry run: would create atomic snapshot", "snapshot", snapName, "vols", len(vols))
+		b.printCommands(cmdArgs)
+		return nil
+	}
+
+	b.logger.Info("creating atomic snapshot", "snapshot", snapName, "vols", len(vols))
 	_, stderr, err := b.run(cmdArgs...)
 	if err != nil {
-		return "", b.wrapCmdError("creating snapshot", stderr, err)
+		return b.wrapCmdError("creating snapshot", stderr, err)
 	}
-	return snapName, nil
+	return nil
 }
 
 // dryrunSingleBackup estimates the send size using zfs send -n -P. Always runs via query.
@@ -324,16 +819,9 @@ func (b *Backup) dryrunSingleBackup(startSnap, endSnap string) (int64, error) {
 	if err != nil {
 		return 0, b.wrapCmdError("estimating backup size", stderr, err)
 	}
-	var size int64
-	for _, l := range lines {
-		parts := strings.Split(strings.TrimSpace(l), "\t")
-		if parts[0] == "size" {
-			size, err = strconv.ParseInt(parts[1], 10, 64)
-			if err != nil {
-				return 0, fmt.Errorf("size parse error: %w", err)
-			}
-			break
-		}
+	size, err := parseSendSize(lines)
+	if err != nil {
+		return 0, fmt.Errorf("size parse error: %w", err)
 	}
 	if size == 0 {
 		return 0, fmt.Errorf("backup size 0")
@@ -341,175 +829,758 @@ func (b *Backup) dryrunSingleBackup(startSnap, endSnap string) (int64, error) {
 	return size, nil
 }
 
+// sendPipeline builds the send | [pv |] receive pipeline for a single filesystem.
+func (b *Backup) sendPipeline(fs, startSnap, endSnap string, size int64) [][]string {
+	sendArgs := b.producer.SendCommand(startSnap, endSnap)
+	receiveArgs := b.backend.ReceiveCommand(fmt.Sprintf("%s/%s", b.target, fs), startSnap, endSnap)
+
+	allCmds := [][]string{sendArgs}
+	if b.pvPath != "" {
+		pv := []string{b.pvPath}
+		if size > 0 {
+			pv = append(pv, "-s", strconv.FormatInt(size, 10))
+		}
+		allCmds = append(allCmds, pv)
+		b.logDebug("using pv for progress", "size", size)
+	}
+	allCmds[0] = b.throttle(sendArgs)
+	return append(allCmds, b.throttle(receiveArgs))
+}
+
+// sendMeter returns the internal progress meter to use for a send, or nil.
+func (b *Backup) sendMeter(size int64) *progressMeter {
+	if b.progress == ProgressInternal || (b.progress == ProgressAuto && b.pvPath == "") {
+		b.logDebug("using internal progress meter", "size", size)
+		return newProgressMeter(os.Stderr, size)
+	}
+	return nil
+}
+
 func (b *Backup) runSingleBackup(fs, startSnap, endSnap string, size int64) error {
 	b.logger.Info("backup starting", "fs", fs, "start", startSnap, "end", endSnap)
 
-	var sendArgs []string
-	if startSnap != "" {
-		sendArgs = b.buildCommand(false, "send", "-i", startSnap, endSnap)
-	} else {
-		sendArgs = b.buildCommand(false, "send", endSnap)
+	targetVol := fmt.Sprintf("%s/%s", b.target, fs)
+	if b.unmount && startSnap != "" {
+		remount, err := b.unmountTarget(targetVol)
+		if err != nil {
+			return err
+		}
+		if remount {
+			defer b.mountTarget(targetVol)
+		}
 	}
-	receiveArgs := b.buildCommand(true, "receive", "-F", fmt.Sprintf("%s/%s", b.target, fs))
 
-	allCmds := [][]string{sendArgs}
-	pvPath, pvErr := exec.LookPath("pv")
-	if pvErr == nil && size > 0 {
-		allCmds = append(allCmds, []string{pvPath, "-s", strconv.FormatInt(size, 10)})
-		b.logger.Debug("using pv for progress", "size", size)
+	logFile, err := b.openSessionLog(fs, endSnap)
+	if err != nil {
+		return err
 	}
-	allCmds = append(allCmds, receiveArgs)
-
-	_, stderr, err := b.pipeline(allCmds)
+	var sessionLog io.Writer
+	if logFile != nil {
+		defer logFile.Close()
+		sessionLog = logFile
+	}
+	_, stderr, err := b.pipeline(b.sendPipeline(fs, startSnap, endSnap, size), b.sendMeter(size), sessionLog)
+	b.invalidate(targetVol, false)
 	if err != nil {
-		return b.wrapCmdError("during backup", stderr, err)
+		if isBusyError(stderr) {
+			return &TargetBusyError{Dataset: targetVol, Stderr: stderr, Unmount: b.unmount, Err: err}
+		}
+		err = b.wrapCmdError("during backup", stderr, err)
+		if logFile != nil {
+			err = fmt.Errorf("%w (session log: %s)", err, logFile.Name())
+		}
+		return err
+	}
+
+	_, snapName := splitSnapshot(endSnap)
+	targetSnap := fmt.Sprintf("%s@%s", targetVol, snapName)
+	if b.isZFSTarget() {
+		if err := b.setSnapshotProps(targetSnap); err != nil {
+			return err
+		}
+	}
+	if b.holdTarget {
+		if err := b.holdSnapshot(targetSnap); err != nil {
+			return err
+		}
 	}
 
 	b.logger.Info("backup complete", "fs", fs, "start", startSnap, "end", endSnap)
+	if b.diffSummary && startSnap != "" {
+		b.logDiffSummary(fs, startSnap, endSnap)
+	}
 	return nil
 }
 
-func (b *Backup) deleteSnapshot(snap string, recurse bool) error {
-	args := []string{"destroy"}
-	if recurse {
-		args = append(args, "-r")
+// unmountTarget unmounts vol if it is mounted, reporting whether it was.
+func (b *Backup) unmountTarget(vol string) (bool, error) {
+	lines, stderr, err := b.query(b.buildCommand(true, "get", "-H", "-o", "value", "mounted", vol)...)
+	if err != nil {
+		return false, b.wrapCmdError("checking target mount", stderr, err)
 	}
-	args = append(args, snap)
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "yes" {
+		return false, nil
+	}
+	b.logger.Info("unmounting target", "vol", vol)
+	_, stderr, err = b.run(b.buildCommand(true, "unmount", vol)...)
+	if err != nil {
+		return false, &TargetBusyError{Dataset: vol, Stderr: stderr, Unmount: b.unmount, Err: err}
+	}
+	return true, nil
+}
 
-	cmdArgs := b.buildCommand(b.isTargetVolume(snap), args...)
-	b.logger.Info("deleting snapshot", "snap", snap)
-	_, stderr, err := b.run(cmdArgs...)
+// mountTarget mounts vol again after a receive. Failures are only logged,
+// since the data has been received either way.
+func (b *Backup) mountTarget(vol string) {
+	b.logger.Info("mounting target", "vol", vol)
+	_, stderr, err := b.run(b.buildCommand(true, "mount", vol)...)
+	if err != nil {
+		b.logger.Warn("error remounting target", "vol", vol, "err", b.wrapCmdError("mounting target", stderr, err))
+	}
+}
+
+// warnDrift warns if vol has been written to since its latest snapshot,
+// which means the backup copy was modified outside zfsbackup.
+func (b *Backup) warnDrift(vol string) {
+	lines, stderr, err := b.query(b.buildCommand(true, "get", "-H", "-p", "-o", "value", "written", vol)...)
+	if err != nil {
+		b.logger.Warn("error checking target for changes", "vol", vol, "err", b.wrapCmdError("getting written", stderr, err))
+		return
+	}
+	if len(lines) == 0 {
+		return
+	}
+	written, err := parseBytes(lines[0])
 	if err != nil {
-		return b.wrapCmdError("deleting snapshot", stderr, err)
+		b.logger.Warn("error checking target for changes", "vol", vol, "err", err)
+		return
+	}
+	if written > 0 {
+		b.logger.Warn("target was modified since the last receive; the changes will be rolled back", "vol", vol, "written", util.HumanBytes(written))
+	}
+}
+
+// defaultRetain is the number of owned snapshots kept on each side
+// unless WithRetainOption is given.
+const defaultRetain = 2
+
+// WithRetainOption sets the number of owned backup snapshots kept on the
+// source and target after each backup. Sources can override it with a
+// ",retain=N" setting.
+func WithRetainOption(n int) BackupOption {
+	return func(b *Backup) error {
+		if n < 1 {
+			return fmt.Errorf("retain must be at least 1")
+		}
+		b.retain = n
+		return nil
+	}
+}
+
+// WithRetainTargetOption sets the number of owned backup snapshots kept on
+// the target separately from the source, e.g. to keep a long history on
+// the backup pool and only a few snapshots on the source. It overrides
+// per-source retain settings on the target.
+func WithRetainTargetOption(n int) BackupOption {
+	return func(b *Backup) error {
+		if n < 1 {
+			return fmt.Errorf("target retain must be at least 1")
+		}
+		b.retainTarget = n
+		return nil
+	}
+}
+
+// retainFor returns the number of snapshots to keep for src.
+func (b *Backup) retainFor(src Source) int {
+	if src.retain > 0 {
+		return src.retain
+	}
+	return b.retain
+}
+
+// retainTargetFor returns the number of snapshots to keep for src on the
+// target.
+func (b *Backup) retainTargetFor(src Source) int {
+	if b.retainTarget > 0 {
+		return b.retainTarget
+	}
+	return b.retainFor(src)
+}
+
+// destroyBatchSize is the maximum number of snapshots destroyed with one
+// zfs destroy command, to keep command lines short.
+const destroyBatchSize = 64
+
+// deleteSnapshots destroys snaps, which must all be snapshots of the same
+// dataset, using the comma syntax of zfs destroy to remove up to
+// destroyBatchSize snapshots per command.
+func (b *Backup) deleteSnapshots(snaps []string, recurse bool) error {
+	for batch := range slices.Chunk(snaps, destroyBatchSize) {
+		vol, _ := splitSnapshot(batch[0])
+		names := make([]string, len(batch))
+		for i, snap := range batch {
+			snapVol, name := splitSnapshot(snap)
+			if snapVol != vol {
+				return fmt.Errorf("can't destroy snapshots of %s and %s together", vol, snapVol)
+			}
+			names[i] = name
+		}
+
+		args := []string{"destroy"}
+		if recurse {
+			args = append(args, "-r")
+		}
+		args = append(args, fmt.Sprintf("%s@%s", vol, strings.Join(names, ",")))
+
+		var cmdArgs []string
+		if b.isTargetVolume(vol) && len(b.targetPruneCmd) > 0 {
+			cmdArgs = append(slices.Clone(b.targetPruneCmd), args...)
+		} else {
+			cmdArgs = b.buildCommand(b.isTargetVolume(vol), args...)
+		}
+		b.logger.Info("deleting snapshots", "vol", vol, "snaps", names)
+		_, stderr, err := b.run(cmdArgs...)
+		b.invalidate(vol, recurse)
+		if err != nil {
+			return b.wrapCmdError("deleting snapshots", stderr, err)
+		}
 	}
 	return nil
 }
 
-func isBackupSnapshot(snapshotName string) bool {
+// snapshotTimeLayout is the time format of backup snapshot names, after
+// the snapshot prefix.
+const snapshotTimeLayout = "2006-01-02T15:04:05"
+
+// WithSnapshotPrefixOption puts prefix in front of the timestamp in the
+// name of every snapshot taken, e.g. "daily-2006-01-02T15:04:05". Only
+// snapshots with the prefix count as backup snapshots for cleanup.
+func WithSnapshotPrefixOption(prefix string) BackupOption {
+	return func(b *Backup) error {
+		b.snapshotPrefix = prefix
+		return nil
+	}
+}
+
+// snapshotName returns the name of a backup snapshot taken at t.
+func (b *Backup) snapshotName(t time.Time) string {
+	return b.snapshotPrefix + t.Format(snapshotTimeLayout)
+}
+
+func (b *Backup) isBackupSnapshot(snapshotName string) bool {
+	_, ok := b.snapshotTime(snapshotName)
+	return ok
+}
+
+// snapshotTime returns the time in the name of a backup snapshot, and
+// false if snapshotName isn't one.
+func (b *Backup) snapshotTime(snapshotName string) (time.Time, bool) {
 	parts := strings.Split(snapshotName, "@")
 	if len(parts) != 2 {
-		return false
+		return time.Time{}, false
 	}
-	const layout = "2006-01-02T15:04:05"
-	_, err := time.Parse(layout, parts[1])
-	return err == nil
+	stamp, ok := strings.CutPrefix(parts[1], b.snapshotPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(snapshotTimeLayout, stamp, time.Local)
+	return t, err == nil
+}
+
+// latestCommonNames returns the name of the latest snapshot common to fs
+// and targetVol, and if recurse is set, that of each descendant of fs
+// with a target too, since a recursive destroy of a name destroys it on
+// every descendant. A descendant whose send failed can have an older one
+// than fs.
+func (b *Backup) latestCommonNames(fs, targetVol string, recurse bool) ([]string, error) {
+	datasets := []string{fs}
+	if recurse {
+		var err error
+		if datasets, err = b.listFilesystems(fs); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	for _, ds := range datasets {
+		dsTarget := targetVol + strings.TrimPrefix(ds, fs)
+		if ds != fs {
+			exists, err := b.backend.Exists(dsTarget)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+		}
+		common, err := b.latestBackedUpSnapshot(ds, dsTarget)
+		if err != nil && !errors.Is(err, errNoMatchingSnapshot) {
+			return nil, err
+		}
+		if _, name := splitSnapshot(common); name != "" && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
 }
 
-func (b *Backup) cleanSnapshots(vol string, retain int, recurse bool) error {
-	snaps, err := b.listSnapshots(vol)
+// cleanSnapshots destroys the owned backup snapshots of vol beyond the
+// newest retain. Snapshots named in keep are never destroyed.
+func (b *Backup) cleanSnapshots(vol string, retain int, keep []string, recurse bool) error {
+	snaps, owned, err := b.listOwnedSnapshots(vol)
 	if err != nil {
 		return err
 	}
-	b.logger.Info("cleaning snapshots", "vol", vol, "retain", retain, "snaps", len(snaps))
+	logArgs := []any{"vol", vol, "retain", retain, "snaps", len(snaps)}
+	if !b.retention.IsZero() {
+		logArgs = append(logArgs, "policy", b.retention.String())
+	}
+	b.logger.Info("cleaning snapshots", logArgs...)
+	if b.snapshotWarn > 0 && len(snaps) > b.snapshotWarn {
+		b.logger.Warn("snapshot count over threshold, check for broken cleanup", "vol", vol, "snaps", len(snaps), "threshold", b.snapshotWarn)
+	}
 	if retain < 1 {
 		b.logger.Warn("retain too low, retaining 1 snap", "retain", retain)
 		retain = 1
 	}
 	if len(snaps) <= retain {
-		b.logger.Debug("not cleaning snaps", "snaps", len(snaps), "retain", retain)
+		b.logDebug("not cleaning snaps", "snaps", len(snaps), "retain", retain)
 		return nil
 	}
 	saved := 0
+	buckets := b.retention.tracker()
+	var doomed []string
 	for i := len(snaps) - 1; i >= 0; i-- {
 		snap := snaps[i]
-		if !isBackupSnapshot(snap) {
-			b.logger.Debug("skipping non-backup snapshot", "snap", snap)
+		taken, ok := b.snapshotTime(snap)
+		if !ok {
+			b.logDebug("skipping non-backup snapshot", "snap", snap)
+			b.explain("keep snapshot", "snap", snap, "reason", "name is not a zfsbackup timestamp with the snapshot prefix")
+			continue
+		}
+		if !owned[snap] {
+			b.logDebug("skipping non-backup snapshot", "snap", snap)
+			b.explain("keep snapshot", "snap", snap, "reason", "no "+ownerProperty+"="+b.owner+" marker")
 			continue
 		}
+		kept := buckets.keep(taken)
 		if saved < retain {
-			b.logger.Debug("retaining snapshot", "snap", snap)
+			b.logDebug("retaining snapshot", "snap", snap)
+			b.explain("keep snapshot", "snap", snap, "reason", fmt.Sprintf("one of the newest %d owned snapshots", retain))
 			saved++
 			continue
 		}
-		if err := b.deleteSnapshot(snap, recurse); err != nil {
-			return err
+		if len(kept) > 0 {
+			b.logDebug("retaining snapshot", "snap", snap, "buckets", kept)
+			b.explain("keep snapshot", "snap", snap, "reason", "newest in its "+strings.Join(kept, ", ")+" period")
+			continue
+		}
+		if _, name := splitSnapshot(snap); slices.Contains(keep, name) {
+			b.logDebug("retaining latest common snapshot", "snap", snap)
+			b.explain("keep snapshot", "snap", snap, "reason", "latest snapshot common to source and target")
+			continue
+		}
+		if b.holdTarget && b.isTargetVolume(snap) {
+			held, err := b.isHeld(snap)
+			if err != nil {
+				return err
+			}
+			if held {
+				b.logger.Info("skipping held snapshot", "snap", snap)
+				b.explain("keep snapshot", "snap", snap, "reason", "held")
+				continue
+			}
 		}
+		reason := fmt.Sprintf("older than the newest %d owned snapshots", retain)
+		if !b.retention.IsZero() {
+			reason += " and not the newest in a retained period"
+		}
+		b.explain("destroy snapshot", "snap", snap, "reason", reason)
+		doomed = append(doomed, snap)
 	}
-	return nil
+	// Destroy oldest first, so an interrupted cleanup never leaves a gap
+	// behind newer snapshots.
+	slices.Reverse(doomed)
+	return b.deleteSnapshots(doomed, recurse)
 }
 
 func (b *Backup) backupFilesystem(fs, snapName string) error {
 	fsSnap := fmt.Sprintf("%s@%s", fs, snapName)
 	targetVol := fmt.Sprintf("%s/%s", b.target, fs)
 
+	stopMatch := b.startPhase(fs, "match")
+	exists, err := b.backend.Exists(targetVol)
+	if err != nil {
+		return err
+	}
 	var startSnap string
-	if b.datasetExists(targetVol) {
-		var err error
-		startSnap, err = b.getLatestMatchingSnapshot(fs, targetVol)
-		if err != nil {
-			b.logger.Warn("no matching snapshot found, performing full backup", "fs", fs, "err", err)
+	if exists {
+		if b.isZFSTarget() {
+			primary, err := b.isPrimary(targetVol)
+			if err != nil {
+				return err
+			}
+			if primary {
+				return fmt.Errorf("target %s was promoted to primary, refusing to overwrite it", targetVol)
+			}
+		}
+		startSnap, err = b.latestBackedUpSnapshot(fs, targetVol)
+		if errors.Is(err, errNoMatchingSnapshot) {
+			b.logger.Warn("no matching snapshot found, performing full backup", "fs", fs)
+			b.explain("full send", "fs", fs, "reason", "target has no snapshot in common with the source")
+		} else if err != nil {
+			return err
+		} else {
+			b.explain("incremental send", "fs", fs, "base", startSnap, "reason", "newest source snapshot that also exists on the target")
+		}
+		if startSnap != "" {
+			if err := b.checkDivergence(fs, targetVol, startSnap, snapName); err != nil {
+				return err
+			}
+		}
+		if b.checkDrift {
+			b.warnDrift(targetVol)
 		}
 	} else {
 		b.logger.Info("target does not exist, performing full backup", "fs", fs)
+		b.explain("full send", "fs", fs, "reason", "target "+targetVol+" does not exist")
 	}
+	stopMatch()
 
-	size, err := b.dryrunSingleBackup(startSnap, fsSnap)
+	if startSnap == fsSnap {
+		b.logger.Info("already replicated", "fs", fs, "snapshot", fsSnap)
+		return nil
+	}
+	if !b.syncHistory {
+		return b.sendSnapshot(fs, targetVol, startSnap, fsSnap)
+	}
+	steps, err := b.historySteps(fs, startSnap, fsSnap)
 	if err != nil {
-		if b.dryrun {
+		return err
+	}
+	for _, snap := range steps {
+		if err := b.sendSnapshot(fs, targetVol, startSnap, snap); err != nil {
+			return err
+		}
+		startSnap = snap
+	}
+	return nil
+}
+
+// sendSnapshot sends endSnap of fs to targetVol, incrementally from
+// startSnap if it is set.
+func (b *Backup) sendSnapshot(fs, targetVol, startSnap, endSnap string) error {
+	var size int64
+	if b.noEstimate {
+		b.logDebug("skipping size estimate", "fs", fs)
+	} else if b.belowEstimateThreshold(fs, startSnap) {
+		b.logDebug("skipping size estimate, written below threshold", "fs", fs, "threshold", util.HumanBytes(b.estimateThreshold))
+	} else {
+		var err error
+		stop := b.startPhase(fs, "estimate")
+		size, err = b.dryrunSingleBackup(startSnap, endSnap)
+		stop()
+		if err != nil {
+			if !b.dryrun {
+				return err
+			}
 			// The new snapshot doesn't exist yet in dry-run, so estimation may fail.
 			// Log intent without size.
-			if startSnap != "" {
-				b.logger.Info("dry run: would send incremental", "fs", fs, "from", startSnap, "to", fsSnap)
-			} else {
-				b.logger.Info("dry run: would send full", "fs", fs, "to", targetVol)
-			}
-			return nil
+			b.logDebug("size estimate failed", "fs", fs, "err", err)
 		}
-		return err
 	}
 
 	if b.dryrun {
+		msg := "dry run: would send full"
+		attrs := []any{"fs", fs, "to", targetVol}
 		if startSnap != "" {
-			b.logger.Info("dry run: would send incremental", "fs", fs, "from", startSnap, "to", fsSnap, "size", util.HumanBytes(size))
-		} else {
-			b.logger.Info("dry run: would send full", "fs", fs, "to", targetVol, "size", util.HumanBytes(size))
+			msg = "dry run: would send incremental"
+			attrs = []any{"fs", fs, "from", startSnap, "to", endSnap}
+		}
+		if size > 0 {
+			attrs = append(attrs, "size", util.HumanBytes(size))
 		}
+		b.logger.Info(msg, attrs...)
+		b.printCommands(b.sendPipeline(fs, startSnap, endSnap, size)...)
 		return nil
 	}
 
-	b.logger.Info("estimated backup size", "fs", fs, "size", size, "human_size", util.HumanBytes(size))
-	return b.runSingleBackup(fs, startSnap, fsSnap, size)
+	if size > 0 {
+		b.logger.Info("estimated backup size", "fs", fs, "size", size, "human_size", util.HumanBytes(size))
+	}
+	defer b.startPhase(fs, "send")()
+	return b.runSingleBackup(fs, startSnap, endSnap, size)
 }
 
-func (b *Backup) backupSource(src Source) error {
-	snapName, err := b.createSnapshot(src.vol, src.recurse)
-	if err != nil {
-		return err
+// WithLimitsOption aborts a run before snapshotting a source that would
+// take the run over maxDatasets replicated datasets or maxSnapshots
+// created snapshots. Zero means no limit.
+func WithLimitsOption(maxDatasets, maxSnapshots int) BackupOption {
+	return func(b *Backup) error {
+		if maxDatasets < 0 || maxSnapshots < 0 {
+			return fmt.Errorf("limits cannot be negative")
+		}
+		b.maxDatasets = maxDatasets
+		b.maxSnapshots = maxSnapshots
+		return nil
 	}
+}
 
-	var filesystems []string
+// checkLimits counts a source's datasets to replicate and snapshots to
+// create against the run limits.
+func (b *Backup) checkLimits(src Source, datasets, snapshots int) error {
+	if b.maxDatasets > 0 && b.nDatasets+datasets > b.maxDatasets {
+		return fmt.Errorf("source %s has %d datasets, which would exceed the limit of %d datasets per run (%d already done)", src, datasets, b.maxDatasets, b.nDatasets)
+	}
+	if b.maxSnapshots > 0 && b.nSnapshots+snapshots > b.maxSnapshots {
+		return fmt.Errorf("source %s would create %d snapshots, which would exceed the limit of %d snapshots per run (%d already created)", src, snapshots, b.maxSnapshots, b.nSnapshots)
+	}
+	b.nDatasets += datasets
+	b.nSnapshots += snapshots
+	return nil
+}
+
+// sourcePlan is a source whose datasets have been listed and checked,
+// ready to be snapshotted and replicated.
+type sourcePlan struct {
+	src         Source
+	filesystems []string // datasets to replicate, in order
+	all         []string // every dataset covered by the snapshot
+	snapName    string
+	replicated  int
+}
+
+// planSource lists the datasets of src and checks them against the run
+// limits. It returns nil if the deadline has already passed.
+func (b *Backup) planSource(src Source) (*sourcePlan, error) {
+	if b.pastDeadline() {
+		b.deferWork(src.String())
+		return nil, nil
+	}
+
+	all := []string{src.vol}
 	if src.recurse {
-		filesystems, err = b.listFilesystems(src.vol)
+		var err error
+		all, err = b.listFilesystems(src.vol)
 		if err != nil {
-			return err
+			return nil, err
 		}
-	} else {
-		filesystems = []string{src.vol}
 	}
+	filesystems := all
+	if src.recurse {
+		filtered, err := b.filterFilesystems(src.vol, all)
+		if err != nil {
+			return nil, err
+		}
+		filesystems, err = b.excludeOptOuts(src.vol, filtered)
+		if err != nil {
+			return nil, err
+		}
+		filesystems = b.orderFilesystems(filesystems)
+	}
+	if err := b.checkLimits(src, len(filesystems), len(all)); err != nil {
+		return nil, err
+	}
+	return &sourcePlan{src: src, filesystems: filesystems, all: all}, nil
+}
 
-	for _, fs := range filesystems {
-		if err := b.backupFilesystem(fs, snapName); err != nil {
-			return err
+// snapshotSources snapshots every planned source with the same snapshot
+// name, in parallel, between the snapshot hooks. This gives all sources a
+// near-identical consistency point however long replication takes.
+func (b *Backup) snapshotSources(plans []*sourcePlan) error {
+	for _, plan := range plans {
+		defer b.startPhase(plan.src.String(), "snapshot")()
+	}
+	now, err := b.now()
+	if err != nil {
+		return err
+	}
+	snapName := b.snapshotName(now)
+	if b.atomicSnapshots {
+		var vols []string
+		seen := make(map[string]bool)
+		for _, plan := range plans {
+			plan.snapName = snapName
+			for _, vol := range plan.all {
+				if !seen[vol] {
+					seen[vol] = true
+					vols = append(vols, vol)
+				}
+			}
 		}
-		if err := b.cleanSnapshots(fs, 2, src.recurse); err != nil {
+		return b.withSnapshotHooks(func() error {
+			return b.createAtomicSnapshot(vols, snapName)
+		})
+	}
+	return b.withSnapshotHooks(func() error {
+		errs := make([]error, len(plans))
+		var wg sync.WaitGroup
+		for i, plan := range plans {
+			plan.snapName = snapName
+			snap := func() {
+				errs[i] = b.createSnapshot(plan.src.vol, snapName, plan.src.recurse)
+			}
+			// Replays must see commands in the recorded order.
+			if b.replaying {
+				snap()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				snap()
+			}()
+		}
+		wg.Wait()
+		return errors.Join(errs...)
+	})
+}
+
+// replicateSource sends each dataset of a snapshotted source and cleans
+// up old snapshots.
+func (b *Backup) replicateSource(plan *sourcePlan) error {
+	src, filesystems, snapName := plan.src, plan.filesystems, plan.snapName
+	stop := b.startPhase(src.String(), "index")
+	err := b.indexSource(plan)
+	stop()
+	if err != nil {
+		return err
+	}
+	defer func() { b.index = nil }()
+	for i, fs := range filesystems {
+		if b.pastDeadline() {
+			b.deferWork(filesystems[i:]...)
+			break
+		}
+		if err := b.backupFilesystem(fs, snapName); errors.Is(err, errKeptTarget) {
+			continue
+		} else if err != nil {
 			return err
 		}
 		targetVol := fmt.Sprintf("%s/%s", b.target, fs)
-		if b.datasetExists(targetVol) {
-			if err := b.cleanSnapshots(targetVol, 2, src.recurse); err != nil {
-				return err
-			}
+		if err := b.pruneFilesystem(fs, targetVol, snapName, b.retainFor(src), b.retainTargetFor(src), src.recurse); err != nil {
+			return err
 		}
+		plan.replicated++
 	}
 	return nil
 }
 
-// RunBackup backs up each source in order, failing fast on any error.
+// pruneFilesystem sweeps orphans if enabled and cleans up old snapshots of
+// fs and its target after a successful replication. The latest snapshot
+// common to both is kept on both sides whatever the retention, as the next
+// incremental send needs it, and so is that of every descendant if
+// recurse is set.
+func (b *Backup) pruneFilesystem(fs, targetVol, snapName string, retain, retainTarget int, recurse bool) error {
+	defer b.startPhase(fs, "prune")()
+	if b.sweepOrphans && !b.dryrun {
+		if err := b.sweep(fs, targetVol, snapName); err != nil {
+			return err
+		}
+	}
+	exists, err := b.backend.Exists(targetVol)
+	if err != nil {
+		return err
+	}
+	var keep []string
+	if exists {
+		if keep, err = b.latestCommonNames(fs, targetVol, recurse); err != nil {
+			return err
+		}
+	}
+	if err := b.cleanSnapshots(fs, retain, keep, recurse); err != nil {
+		return err
+	}
+	if exists {
+		return b.backend.Prune(targetVol, retainTarget, keep, recurse)
+	}
+	return nil
+}
+
+// resetRun clears the state of a previous run, RunBackup, Estimate or
+// CheckConfig, before planning a new one, so per-run limits count from
+// zero and nothing is reported twice.
+func (b *Backup) resetRun() {
+	b.deferred = nil
+	b.results = nil
+	b.nDatasets, b.nSnapshots = 0, 0
+	b.memo = newQueryMemo()
+}
+
+// RunBackup snapshots all sources together and then replicates them in
+// order. Errors before the snapshots are taken stop the run; after that, a
+// source that fails to replicate doesn't stop the others, and all
+// failures are returned joined. Results reports the outcome per source.
+// If a deadline is set and passes, the remaining datasets are skipped and
+// a *DeadlineError lists them.
 func (b *Backup) RunBackup(sources []Source) error {
+	if _, ok := b.producer.(*zfsSource); !ok {
+		return fmt.Errorf("backups need a ZFS source")
+	}
+	b.resetRun()
+	if err := b.checkJournal(); err != nil {
+		return err
+	}
+	if b.profiling {
+		b.profile = &runProfile{timings: make(map[string]map[string]time.Duration)}
+		defer b.logProfile()
+	}
+
+	var plans []*sourcePlan
 	for _, src := range sources {
-		if err := b.backupSource(src); err != nil {
+		stop := b.startPhase(src.String(), "list")
+		plan, err := b.planSource(src)
+		stop()
+		if err != nil {
 			return err
 		}
+		if plan != nil {
+			plans = append(plans, plan)
+		}
 	}
-	return nil
+	if len(plans) > 0 {
+		if err := b.checkSSHHosts(); err != nil {
+			return err
+		}
+		if err := b.checkRoot(); err != nil {
+			return err
+		}
+		if err := b.checkSmart(); err != nil {
+			return err
+		}
+		if err := b.ensureHostNamespace(plans); err != nil {
+			return err
+		}
+		if b.relayOwner != "" {
+			if err := b.relaySnapshots(plans); err != nil {
+				return err
+			}
+		} else if err := b.snapshotSources(plans); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, plan := range plans {
+		deferred := len(b.deferred)
+		err := b.replicateSource(plan)
+		if err != nil {
+			b.logger.Error("source failed", "source", plan.src.String(), "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", plan.src, err))
+		}
+		b.results = append(b.results, SourceResult{
+			Source:   plan.src,
+			Datasets: plan.replicated,
+			Deferred: len(b.deferred) > deferred,
+			Err:      err,
+		})
+	}
+	if len(plans) > 0 {
+		if err := b.checkPoolErrorCounters(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(b.deferred) > 0 {
+		errs = append(errs, &DeadlineError{Deadline: b.deadline, Deferred: b.deferred})
+	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,139 @@
+package zfs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Check is the outcome of one offline check of the configuration.
+type Check struct {
+	Name   string
+	Err    error
+	Detail string
+}
+
+// String formats c as a single status line.
+func (c Check) String() string {
+	status := "ok"
+	if c.Err != nil {
+		status = "FAIL"
+	}
+	s := fmt.Sprintf("%-4s  %s", status, c.Name)
+	if c.Detail != "" {
+		s += ": " + c.Detail
+	}
+	if c.Err != nil {
+		s += " (" + strings.TrimSpace(c.Err.Error()) + ")"
+	}
+	return s
+}
+
+// CheckConfig verifies the sources and options against the live systems
+// without snapshotting or sending anything: both endpoints are reachable,
+// the target pool or directory and every source dataset exist, every
+// source and priority pattern matches at least one dataset, the target
+// command isn't root if that is refused, the journal has no stale
+// entries, and the run
+// limits and snapshot warning threshold are consistent with retention.
+func (b *Backup) CheckConfig(sources []Source) []Check {
+	b.resetRun()
+	var checks []Check
+	add := func(name, detail string, err error) {
+		checks = append(checks, Check{Name: name, Detail: detail, Err: err})
+	}
+
+	sides := []bool{false}
+	if b.isZFSTarget() {
+		sides = append(sides, true)
+	}
+	for _, isTarget := range sides {
+		side := "source"
+		if isTarget {
+			side = "target"
+		}
+		e := b.ProbeEndpoint(isTarget)
+		var err error
+		if e.Error != "" {
+			err = fmt.Errorf("%s", e.Error)
+		}
+		add(side+" reachable", quoteCommand(e.Command), err)
+	}
+
+	if b.isZFSTarget() {
+		pool := b.targetPool()
+		exists, err := b.datasetExistsOn(true, pool)
+		if err == nil && !exists {
+			err = fmt.Errorf("target pool %s does not exist", pool)
+		}
+		add("target pool", pool, err)
+		if b.rootCheck == RootRefuse {
+			add("target privileges", quoteCommand(b.targetCmd), b.checkRoot())
+		}
+	} else {
+		exists, err := b.backend.Exists("")
+		if err == nil && !exists {
+			err = fmt.Errorf("target directory does not exist")
+		}
+		add("target directory", "", err)
+	}
+
+	if b.journal != nil {
+		stale, err := b.staleJournalEntries()
+		if err == nil && len(stale) > 0 {
+			err = fmt.Errorf("%d change(s) were in flight when an earlier run died", len(stale))
+		}
+		add("journal", b.journal.path, err)
+	}
+
+	var planned []string
+	for _, src := range sources {
+		exists, err := b.datasetExistsOn(false, src.vol)
+		if err == nil && !exists {
+			err = fmt.Errorf("source dataset %s does not exist", src.vol)
+		}
+		add("source exists", src.String(), err)
+		if err != nil {
+			continue
+		}
+		plan, err := b.planSource(src)
+		if err == nil && plan != nil && len(plan.filesystems) == 0 {
+			err = fmt.Errorf("no datasets left to replicate after exclusions")
+		}
+		detail := src.String()
+		if plan != nil {
+			detail = fmt.Sprintf("%s: %d dataset(s)", src, len(plan.filesystems))
+			planned = append(planned, plan.filesystems...)
+		}
+		add("source datasets", detail, err)
+	}
+
+	for _, p := range b.priority {
+		if p == "*" {
+			continue
+		}
+		var err error
+		if !matchesAny(p, planned) {
+			err = fmt.Errorf("priority pattern %q matches no dataset", p)
+		}
+		add("priority pattern", p, err)
+	}
+
+	for _, src := range sources {
+		if retain := max(b.retainFor(src), b.retainTargetFor(src)) + b.retention.Total(); b.snapshotWarn > 0 && b.snapshotWarn < retain {
+			add("retention", src.String(),
+				fmt.Errorf("snapshot warning threshold %d is below the up to %d snapshots kept, every run will warn", b.snapshotWarn, retain))
+		}
+	}
+	return checks
+}
+
+// matchesAny reports whether pattern matches any of names.
+func matchesAny(pattern string, names []string) bool {
+	for _, n := range names {
+		if ok, _ := path.Match(pattern, n); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package zfs
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// CleanupAction is one repair of something a crashed run left behind,
+// found by PlanCleanup.
+type CleanupAction struct {
+	// Entry is the stale journal entry the action repairs.
+	Entry       JournalEntry
+	Description string
+	// Manual is set if the entry can't be repaired automatically and
+	// needs to be checked by hand.
+	Manual bool
+	apply  func() error
+}
+
+func (a CleanupAction) String() string {
+	return a.Description
+}
+
+// Apply makes the repair. Manual actions do nothing.
+func (a CleanupAction) Apply() error {
+	if a.apply == nil {
+		return nil
+	}
+	return a.apply()
+}
+
+// PlanCleanup finds what the stale entries of the journal left behind
+// and returns the actions that repair it, without changing anything:
+//
+//   - a zfsbackup hold whose placing or releasing was interrupted, which
+//     is placed or released according to WithHoldTargetOption
+//   - a snapshot taken by the run that never reached the target, which is
+//     destroyed on the source, dataset by dataset for recursive snapshots
+//
+// Receives are not resumable (zfsbackup doesn't receive with -s), so an
+// interrupted one leaves no partial state on the target. Destroys and
+// other changes either happened or didn't and need no repair. Anything else is returned as a manual action.
+func (b *Backup) PlanCleanup() ([]CleanupAction, error) {
+	if b.journal == nil {
+		return nil, fmt.Errorf("cleanup needs a journal")
+	}
+	if !b.isZFSTarget() {
+		return nil, fmt.Errorf("cleanup needs a ZFS target")
+	}
+	stale, err := b.staleJournalEntries()
+	if err != nil {
+		return nil, err
+	}
+	var actions []CleanupAction
+	// A snapshot can be named by the entries of both its creation and
+	// its send.
+	destroyed := make(map[string]bool)
+	for _, e := range stale {
+		var found []CleanupAction
+		var err error
+		switch e.Operation {
+		case "zfs send":
+			found, err = b.planReceiveCleanup(e, destroyed)
+		case "zfs snapshot":
+			found, err = b.planOrphanCleanup(e, e.Snapshots, destroyed)
+		case "zfs hold", "zfs release":
+			found, err = b.planHoldCleanup(e)
+		case "zfs destroy":
+			b.logDebug("interrupted destroy needs no cleanup", "dataset", e.Dataset)
+		default:
+			found = []CleanupAction{{Entry: e, Manual: true, Description: fmt.Sprintf("check by hand: %s", e.Command)}}
+		}
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, found...)
+	}
+	return actions, nil
+}
+
+// planReceiveCleanup treats the snapshot an interrupted send was sending
+// like an orphan.
+func (b *Backup) planReceiveCleanup(e JournalEntry, destroyed map[string]bool) ([]CleanupAction, error) {
+	if len(e.Snapshots) == 0 {
+		return nil, nil
+	}
+	return b.planOrphanCleanup(e, e.Snapshots[len(e.Snapshots)-1:], destroyed)
+}
+
+// planOrphanCleanup destroys the snapshots of snaps, and of the datasets
+// below them if they were taken recursively, that are owned by this
+// Backup but missing on the target, unless they are in destroyed already.
+func (b *Backup) planOrphanCleanup(e JournalEntry, snaps []string, destroyed map[string]bool) ([]CleanupAction, error) {
+	recursive := strings.Contains(" "+e.Command+" ", " -r ")
+	var actions []CleanupAction
+	for _, snap := range snaps {
+		vol, name := splitSnapshot(snap)
+		if b.isTargetVolume(vol) || name == "" {
+			continue
+		}
+		datasets := []string{vol}
+		if recursive {
+			var err error
+			if datasets, err = b.listFilesystems(vol); err != nil {
+				return nil, err
+			}
+		}
+		for _, fs := range datasets {
+			fsSnap := fs + "@" + name
+			if destroyed[fsSnap] {
+				continue
+			}
+			orphan, err := b.isOrphan(fs, name)
+			if err != nil {
+				return nil, err
+			}
+			if !orphan {
+				continue
+			}
+			destroyed[fsSnap] = true
+			actions = append(actions, CleanupAction{
+				Entry:       e,
+				Description: fmt.Sprintf("destroy %s, which never reached the target", fsSnap),
+				apply: func() error {
+					return b.deleteSnapshots([]string{fsSnap}, false)
+				},
+			})
+		}
+	}
+	return actions, nil
+}
+
+// isOrphan reports whether fs@name exists on the source, is owned by this
+// Backup and is missing on the target.
+func (b *Backup) isOrphan(fs, name string) (bool, error) {
+	snaps, owned, err := b.listOwnedSnapshots(fs)
+	if err != nil {
+		return false, err
+	}
+	snap := fs + "@" + name
+	if !slices.Contains(snaps, snap) || !owned[snap] {
+		return false, nil
+	}
+	targetVol := fmt.Sprintf("%s/%s", b.target, fs)
+	exists, err := b.datasetExistsOn(true, targetVol)
+	if err != nil || !exists {
+		return err == nil, err
+	}
+	targetSnaps, err := b.listSnapshotsOn(true, targetVol)
+	if err != nil {
+		return false, err
+	}
+	return !slices.Contains(targetSnaps, targetVol+"@"+name), nil
+}
+
+// planHoldCleanup places or releases the zfsbackup hold on the snapshots
+// of an interrupted hold or release, according to WithHoldTargetOption.
+func (b *Backup) planHoldCleanup(e JournalEntry) ([]CleanupAction, error) {
+	var actions []CleanupAction
+	for _, snap := range e.Snapshots {
+		exists, err := b.datasetExistsOn(true, snap)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		held, err := b.hasHold(snap)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case b.holdTarget && !held:
+			actions = append(actions, CleanupAction{
+				Entry:       e,
+				Description: fmt.Sprintf("place the %s hold on %s", holdTag, snap),
+				apply:       func() error { return b.holdSnapshot(snap) },
+			})
+		case !b.holdTarget && held:
+			args := b.buildCommand(true, "release", holdTag, snap)
+			actions = append(actions, CleanupAction{
+				Entry:       e,
+				Description: fmt.Sprintf("release the stale %s hold on %s", holdTag, snap),
+				apply: func() error {
+					if _, stderr, err := b.run(args...); err != nil {
+						return b.wrapCmdError("releasing hold", stderr, err)
+					}
+					return nil
+				},
+			})
+		}
+	}
+	return actions, nil
+}
+
+// hasHold reports whether the target snapshot snap has the zfsbackup hold.
+func (b *Backup) hasHold(snap string) (bool, error) {
+	lines, stderr, err := b.query(b.buildCommand(true, "holds", "-H", snap)...)
+	if err != nil {
+		return false, b.wrapCmdError("listing holds", stderr, err)
+	}
+	for _, l := range parseNames(lines) {
+		cols := strings.Split(l, "\t")
+		if len(cols) >= 2 && strings.TrimSpace(cols[1]) == holdTag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,82 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+)
+
+// Copy replicates the snapshot chain of fromVol, read from the stream
+// source, to toVol on the target, one snapshot at a time, e.g. to move
+// archived stream files back onto ZFS for a fast restore, or a ZFS backup
+// out to stream files. If toVol already exists, copying continues after
+// the latest snapshot it has in common with fromVol, so an interrupted
+// copy can be run again. Stream files must keep their modification times,
+// which give their order.
+func (b *Backup) Copy(fromVol, toVol string) error {
+	snaps, err := b.producer.ListSnapshots(fromVol)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		return fmt.Errorf("%s has no snapshots to copy", fromVol)
+	}
+
+	exists, err := b.backend.Exists(toVol)
+	if err != nil {
+		return err
+	}
+	next, prev := 0, ""
+	if exists {
+		targetSnaps, err := b.backend.ListSnapshots(toVol)
+		if err != nil {
+			return err
+		}
+		common, err := latestCommonSnapshot(snaps, targetSnaps, toVol)
+		if errors.Is(err, errNoMatchingSnapshot) && len(targetSnaps) > 0 {
+			return fmt.Errorf("%s already exists but has no snapshot in common with %s", toVol, fromVol)
+		} else if err == nil {
+			prev = common
+			next = slices.Index(snaps, common) + 1
+		}
+	} else if err := b.ensureParent(toVol); err != nil {
+		return err
+	}
+	if next == len(snaps) {
+		b.logger.Info("already copied", "from", fromVol, "to", toVol, "snapshot", prev)
+		return nil
+	}
+
+	for _, snap := range snaps[next:] {
+		cmds := [][]string{b.throttle(b.producer.SendCommand(prev, snap))}
+		if b.pvPath != "" {
+			cmds = append(cmds, []string{b.pvPath})
+		}
+		cmds = append(cmds, b.throttle(b.backend.ReceiveCommand(toVol, prev, snap)))
+		b.logger.Info("copying", "from", fromVol, "to", toVol, "base", prev, "snapshot", snap)
+		if _, stderr, err := b.pipeline(cmds, b.sendMeter(0), nil); err != nil {
+			return b.wrapCmdError(fmt.Sprintf("copying %s", snap), stderr, err)
+		}
+		prev = snap
+	}
+	return nil
+}
+
+// ensureParent creates the parent dataset of vol on a ZFS target if it is
+// missing, since zfs receive doesn't create parents.
+func (b *Backup) ensureParent(vol string) error {
+	parent := path.Dir(vol)
+	if !b.isZFSTarget() || parent == "." {
+		return nil
+	}
+	exists, err := b.datasetExistsOn(true, parent)
+	if err != nil || exists {
+		return err
+	}
+	b.logger.Info("creating parent dataset", "dataset", parent)
+	if _, stderr, err := b.run(b.buildCommand(true, "create", "-p", "-o", "canmount=off", parent)...); err != nil {
+		return b.wrapCmdError(fmt.Sprintf("creating %s", parent), stderr, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DeadlineError is returned by RunBackup when the deadline passed before
+// every dataset was replicated.
+type DeadlineError struct {
+	Deadline time.Time
+	Deferred []string
+}
+
+func (e *DeadlineError) Error() string {
+	return fmt.Sprintf("deadline %s passed, deferred %d datasets: %s",
+		e.Deadline.Format(time.RFC3339), len(e.Deferred), strings.Join(e.Deferred, ", "))
+}
+
+// WithDeadlineOption stops starting new work once deadline has passed.
+// The dataset being replicated at the time is finished; the rest are
+// skipped and reported in a DeadlineError.
+func WithDeadlineOption(deadline time.Time) BackupOption {
+	return func(b *Backup) error {
+		b.deadline = deadline
+		return nil
+	}
+}
+
+// ParseDeadline parses a deadline relative to now: a duration such as
+// "3h30m", a clock time such as "06:00" (the next occurrence), or an
+// RFC 3339 timestamp.
+func ParseDeadline(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	if t, err := time.ParseInLocation("15:04", s, now.Location()); err == nil {
+		deadline := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !deadline.After(now) {
+			deadline = deadline.AddDate(0, 0, 1)
+		}
+		return deadline, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid deadline %q (want a duration, HH:MM or RFC 3339 time)", s)
+}
+
+func (b *Backup) pastDeadline() bool {
+	return !b.deadline.IsZero() && time.Now().After(b.deadline)
+}
+
+// deferWork records datasets skipped because the deadline passed.
+func (b *Backup) deferWork(names ...string) {
+	b.logger.Warn("deadline passed, deferring", "deadline", b.deadline, "datasets", names)
+	b.deferred = append(b.deferred, names...)
+}
@@ -0,0 +1,108 @@
+package zfs
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+// diffSummary counts the changes reported by `zfs diff -H -F`.
+type diffSummary struct {
+	changes map[string]int // keyed by change: added, removed, modified, renamed
+	types   map[string]int // keyed by file type: file, directory, ...
+	dirs    map[string]int // changes per parent directory
+}
+
+var diffChanges = map[string]string{
+	"+": "added",
+	"-": "removed",
+	"M": "modified",
+	"R": "renamed",
+}
+
+var diffTypes = map[string]string{
+	"F": "file",
+	"/": "directory",
+	"@": "symlink",
+	"B": "block",
+	"C": "char",
+	"|": "fifo",
+	"=": "socket",
+	">": "door",
+	"P": "port",
+}
+
+// parseDiff summarises `zfs diff -H -F` output. Lines it does not
+// understand are counted as "unknown" rather than failing the backup.
+func parseDiff(lines []string) diffSummary {
+	s := diffSummary{
+		changes: map[string]int{},
+		types:   map[string]int{},
+		dirs:    map[string]int{},
+	}
+	for _, l := range lines {
+		if l == "" {
+			continue
+		}
+		cols := strings.Split(l, "\t")
+		if len(cols) < 3 {
+			s.changes["unknown"]++
+			continue
+		}
+		change, ok := diffChanges[cols[0]]
+		if !ok {
+			change = "unknown"
+		}
+		ftype, ok := diffTypes[cols[1]]
+		if !ok {
+			ftype = "unknown"
+		}
+		s.changes[change]++
+		s.types[ftype]++
+		// For renames the new name is last.
+		s.dirs[path.Dir(cols[len(cols)-1])]++
+	}
+	return s
+}
+
+// topDirs returns up to n directories with the most changes.
+func (s diffSummary) topDirs(n int) []string {
+	dirs := slices.Collect(maps.Keys(s.dirs))
+	slices.SortFunc(dirs, func(a, b string) int {
+		return cmp.Or(s.dirs[b]-s.dirs[a], strings.Compare(a, b))
+	})
+	dirs = dirs[:min(n, len(dirs))]
+	for i, d := range dirs {
+		dirs[i] = fmt.Sprintf("%s (%d)", d, s.dirs[d])
+	}
+	return dirs
+}
+
+// WithDiffSummaryOption runs `zfs diff` between the previous and new
+// snapshot of each incrementally replicated dataset and logs a summary of
+// the changes, including the top directories by number of changes.
+func WithDiffSummaryOption(top int) BackupOption {
+	return func(b *Backup) error {
+		if top < 0 {
+			return fmt.Errorf("diff summary top count cannot be negative")
+		}
+		b.diffSummary = true
+		b.diffTop = top
+		return nil
+	}
+}
+
+// logDiffSummary logs the changes between startSnap and endSnap on the source.
+func (b *Backup) logDiffSummary(fs, startSnap, endSnap string) {
+	lines, stderr, err := b.query(b.buildCommand(false, "diff", "-H", "-F", startSnap, endSnap)...)
+	if err != nil {
+		b.logger.Warn("error summarising changes", "fs", fs, "err", b.wrapCmdError("running zfs diff", stderr, err))
+		return
+	}
+	s := parseDiff(lines)
+	b.logger.Info("changes since last backup", "fs", fs, "from", startSnap, "to", endSnap,
+		"changes", s.changes, "types", s.types, "top_dirs", s.topDirs(b.diffTop))
+}
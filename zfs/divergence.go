@@ -0,0 +1,172 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jamesmcdonald/zfsbackup/util"
+)
+
+// DivergencePolicy says what to do when a target dataset has changed past
+// the snapshot it shares with the source.
+type DivergencePolicy string
+
+const (
+	// DivergenceIgnore receives with -F without checking, rolling back
+	// any changes on the target.
+	DivergenceIgnore DivergencePolicy = ""
+	// DivergenceFail stops with a *DivergenceError.
+	DivergenceFail DivergencePolicy = "fail"
+	// DivergenceKeepSource overwrites the target's changes.
+	DivergenceKeepSource DivergencePolicy = "keep-source"
+	// DivergenceKeepTarget skips the dataset, leaving the target alone.
+	DivergenceKeepTarget DivergencePolicy = "keep-target"
+	// DivergenceSaveTarget copies the target's current state to a new
+	// dataset next to it before overwriting it.
+	DivergenceSaveTarget DivergencePolicy = "save-target"
+)
+
+// ParseDivergencePolicy parses an --on-divergence value.
+func ParseDivergencePolicy(s string) (DivergencePolicy, error) {
+	switch p := DivergencePolicy(s); p {
+	case DivergenceIgnore, DivergenceFail, DivergenceKeepSource, DivergenceKeepTarget, DivergenceSaveTarget:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid divergence policy %q: must be fail, keep-source, keep-target or save-target", s)
+}
+
+// WithDivergenceOption checks each target dataset for changes past the
+// snapshot it shares with the source before an incremental receive, and
+// applies policy if it has diverged.
+func WithDivergenceOption(policy DivergencePolicy) BackupOption {
+	return func(b *Backup) error {
+		b.divergence = policy
+		return nil
+	}
+}
+
+// Divergence describes what each side has beyond their common snapshot.
+type Divergence struct {
+	Dataset         string
+	Target          string
+	Base            string // common snapshot name, without the dataset
+	SourceSnapshots []string
+	SourceWritten   int64
+	TargetSnapshots []string
+	TargetWritten   int64
+}
+
+func (d *Divergence) diverged() bool {
+	return len(d.TargetSnapshots) > 0 || d.TargetWritten > 0
+}
+
+func (d *Divergence) logArgs() []any {
+	return []any{
+		"fs", d.Dataset, "target", d.Target, "base", d.Base,
+		"source_snapshots", len(d.SourceSnapshots), "source_written", util.HumanBytes(d.SourceWritten),
+		"target_snapshots", strings.Join(d.TargetSnapshots, ","), "target_written", util.HumanBytes(d.TargetWritten),
+	}
+}
+
+// DivergenceError is returned when a target has diverged from its source
+// and the policy is DivergenceFail.
+type DivergenceError struct {
+	Divergence
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("target %s has diverged from %s since @%s: target has %d newer snapshot(s) and %s written, source has %d newer snapshot(s) and %s written (choose --on-divergence keep-source, keep-target or save-target)",
+		e.Target, e.Dataset, e.Base,
+		len(e.TargetSnapshots), util.HumanBytes(e.TargetWritten),
+		len(e.SourceSnapshots), util.HumanBytes(e.SourceWritten))
+}
+
+// errKeptTarget is returned by backupFilesystem when a diverged target
+// was left alone under DivergenceKeepTarget.
+var errKeptTarget = errors.New("diverged target kept")
+
+// changesSince returns the snapshots of vol newer than the snapshot base
+// and the bytes written to vol since base.
+func (b *Backup) changesSince(isTarget bool, vol, base string) ([]string, int64, error) {
+	snaps, err := b.listSnapshots(vol)
+	if err != nil {
+		return nil, 0, err
+	}
+	var newer []string
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if _, name := splitSnapshot(snaps[i]); name == base {
+			break
+		}
+		newer = append([]string{snaps[i]}, newer...)
+	}
+
+	lines, stderr, err := b.query(b.buildCommand(isTarget, "get", "-H", "-p", "-o", "value", "written@"+base, vol)...)
+	if err != nil {
+		return nil, 0, b.wrapCmdError("getting written", stderr, err)
+	}
+	if len(lines) == 0 {
+		return nil, 0, fmt.Errorf("no written@%s value for %s", base, vol)
+	}
+	written, err := parseBytes(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid written@%s for %s: %w", base, vol, err)
+	}
+	return newer, written, nil
+}
+
+// checkDivergence applies the divergence policy to targetVol before an
+// incremental receive from startSnap. It returns errKeptTarget if the
+// dataset should be skipped.
+func (b *Backup) checkDivergence(fs, targetVol, startSnap, snapName string) error {
+	if b.divergence == DivergenceIgnore {
+		return nil
+	}
+	_, base := splitSnapshot(startSnap)
+	d := Divergence{Dataset: fs, Target: targetVol, Base: base}
+	var err error
+	if d.TargetSnapshots, d.TargetWritten, err = b.changesSince(true, targetVol, base); err != nil {
+		return err
+	}
+	if !d.diverged() {
+		return nil
+	}
+	if d.SourceSnapshots, d.SourceWritten, err = b.changesSince(false, fs, base); err != nil {
+		return err
+	}
+
+	switch b.divergence {
+	case DivergenceFail:
+		return &DivergenceError{d}
+	case DivergenceKeepTarget:
+		b.logger.Warn("target has diverged, keeping it and skipping the dataset", d.logArgs()...)
+		return errKeptTarget
+	case DivergenceSaveTarget:
+		b.logger.Warn("target has diverged, saving it before overwriting", d.logArgs()...)
+		return b.saveTarget(targetVol, snapName)
+	}
+	b.logger.Warn("target has diverged, overwriting it with the source", d.logArgs()...)
+	return nil
+}
+
+// saveTarget copies the current state of targetVol to a new dataset
+// <targetVol>.diverged-<snapName>. A clone wouldn't survive the receive,
+// which destroys the snapshots it would depend on, so this is a full copy.
+func (b *Backup) saveTarget(targetVol, snapName string) error {
+	suffix := "diverged-" + snapName
+	snap := fmt.Sprintf("%s@%s", targetVol, suffix)
+	saved := fmt.Sprintf("%s.%s", targetVol, suffix)
+
+	b.logger.Info("saving diverged target", "vol", targetVol, "saved", saved)
+	if _, stderr, err := b.run(b.buildCommand(true, "snapshot", snap)...); err != nil {
+		return b.wrapCmdError("snapshotting diverged target", stderr, err)
+	}
+	cmds := [][]string{
+		b.throttle(b.buildCommand(true, "send", snap)),
+		b.throttle(b.buildCommand(true, "receive", "-u", saved)),
+	}
+	if _, stderr, err := b.pipeline(cmds, nil, nil); err != nil {
+		return b.wrapCmdError("saving diverged target", stderr, err)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// TargetBusyError is returned when a receive fails because the target
+// dataset is busy or mounted.
+type TargetBusyError struct {
+	Dataset string
+	Stderr  string
+	Unmount bool // the target is already unmounted around receives
+	Err     error
+}
+
+func (e *TargetBusyError) Error() string {
+	hint := "stop whatever is using it or enable unmounting the target around receives"
+	if e.Unmount {
+		hint = "stop whatever is using it"
+	}
+	return fmt.Sprintf("target %s is busy or mounted: %s (%s)", e.Dataset, e.Stderr, hint)
+}
+
+func (e *TargetBusyError) Unwrap() error {
+	return e.Err
+}
+
+// PipelineStage describes a failed stage of a pipeline.
+type PipelineStage struct {
+	Index    int      // position in the pipeline, starting at 0
+	Name     string   // send, receive, pv or the command's base name
+	Cmd      []string // full command line
+	Stderr   string   // captured stderr, empty for stages writing to the terminal
+	ExitCode int      // exit code, or -1 if killed by a signal
+	Err      error
+}
+
+// PipelineError is returned when one or more stages of a pipeline fail.
+type PipelineError struct {
+	Failed []PipelineStage
+}
+
+func (e *PipelineError) Error() string {
+	var parts []string
+	for _, s := range e.Failed {
+		parts = append(parts, fmt.Sprintf("%s (command %d) failed: %v", s.Name, s.Index, s.Err))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (e *PipelineError) Unwrap() []error {
+	var errs []error
+	for _, s := range e.Failed {
+		errs = append(errs, s.Err)
+	}
+	return errs
+}
+
+// Stderr returns the stderr of all failed stages, each prefixed with the
+// stage name.
+func (e *PipelineError) Stderr() string {
+	var parts []string
+	for _, s := range e.Failed {
+		if s.Stderr != "" {
+			parts = append(parts, fmt.Sprintf("%s: %s", s.Name, s.Stderr))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// stageName names a pipeline stage for error messages.
+func stageName(cmd []string) string {
+	switch {
+	case slices.Contains(cmd, "send"):
+		return "send"
+	case slices.Contains(cmd, "receive"), slices.Contains(cmd, "recv"):
+		return "receive"
+	}
+	return filepath.Base(cmd[0])
+}
+
+// exitCode returns the exit code of a failed command, local or run over
+// an ssh session, or -1 if it was killed by a signal or didn't run. A
+// failure of the in-process ssh client to connect is 255, like the exit
+// code of ssh.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) && sshErr.Signal() == "" {
+		return sshErr.ExitStatus()
+	}
+	var connErr *sshConnectError
+	if errors.As(err, &connErr) {
+		return 255
+	}
+	var replayErr *replayedError
+	if errors.As(err, &replayErr) {
+		return replayErr.code
+	}
+	return -1
+}
+
+// isBrokenPipe reports whether a stage failed only because the stage it
+// was writing to went away.
+func isBrokenPipe(s PipelineStage) bool {
+	var exitErr *exec.ExitError
+	if errors.As(s.Err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGPIPE {
+			return true
+		}
+	}
+	var sshErr *ssh.ExitError
+	if errors.As(s.Err, &sshErr) && sshErr.Signal() == string(ssh.SIGPIPE) || errors.Is(s.Err, syscall.EPIPE) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(s.Stderr), "broken pipe")
+}
+
+// rootCauses drops the failures of upstream stages that were killed, or
+// hit a broken pipe, because a later stage failed. If nothing else is
+// left, all failures are returned.
+func rootCauses(failed []PipelineStage, killed []bool) []PipelineStage {
+	var causes []PipelineStage
+	for i, s := range failed {
+		downstreamFailed := i < len(failed)-1
+		if downstreamFailed && (killed[s.Index] || isBrokenPipe(s)) {
+			continue
+		}
+		causes = append(causes, s)
+	}
+	if len(causes) == 0 {
+		return failed
+	}
+	return causes
+}
+
+// errNoMatchingSnapshot is returned when source and target have no
+// snapshot in common.
+var errNoMatchingSnapshot = errors.New("no matching snapshot found")
+
+// ErrorClass classifies a failed zfs command by the cause reported on
+// its stderr, so callers can decide whether to retry, alert or give up.
+type ErrorClass string
+
+const (
+	ClassUnknown    ErrorClass = ""
+	ClassNoSpace    ErrorClass = "no-space"
+	ClassPermission ErrorClass = "permission"
+	ClassBusy       ErrorClass = "busy"
+	ClassNotFound   ErrorClass = "not-found"
+	ClassInvalid    ErrorClass = "invalid"
+	ClassConnection ErrorClass = "connection"
+)
+
+// classPatterns maps lower-cased stderr fragments to error classes. They
+// are checked in order, so more specific patterns come first.
+var classPatterns = []struct {
+	class    ErrorClass
+	patterns []string
+}{
+	{ClassBusy, []string{"is busy", "resource busy", "cannot unmount"}},
+	{ClassNoSpace, []string{"out of space", "no space left", "quota exceeded", "insufficient space"}},
+	{ClassPermission, []string{"permission denied", "operation not permitted", "must be root", "insufficient privileges", "unable to open /dev/zfs"}},
+	{ClassConnection, []string{"connection refused", "connection timed out", "connection reset", "connection closed", "could not resolve hostname", "no route to host", "host key verification failed"}},
+	{ClassNotFound, []string{"does not exist", "no such pool", "could not find any snapshots", "command not found"}},
+	{ClassInvalid, []string{"invalid option", "unrecognized option", "invalid property", "bad property", "missing argument", "usage:"}},
+}
+
+// ClassifyStderr returns the class of the failure described by stderr
+// from a zfs command, or ClassUnknown.
+func ClassifyStderr(stderr string) ErrorClass {
+	s := strings.ToLower(stderr)
+	for _, c := range classPatterns {
+		for _, p := range c.patterns {
+			if strings.Contains(s, p) {
+				return c.class
+			}
+		}
+	}
+	return ClassUnknown
+}
+
+// CommandError is returned when a zfs command fails.
+type CommandError struct {
+	Op     string // what was being done, e.g. "listing snapshots"
+	Stderr string
+	Class  ErrorClass
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("error %s: %s: %v", e.Op, e.Stderr, e.Err)
+	}
+	return fmt.Sprintf("error %s: %v", e.Op, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// ClassOf returns the class of the first classified command failure in
+// err's chain. A *TargetBusyError is always ClassBusy.
+func ClassOf(err error) ErrorClass {
+	var busy *TargetBusyError
+	if errors.As(err, &busy) {
+		return ClassBusy
+	}
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.Class
+	}
+	return ClassUnknown
+}
+
+// isNotFoundError reports whether stderr from zfs says a dataset doesn't
+// exist. It is narrower than ClassNotFound, which also covers a missing
+// pool or zfs command: those must fail instead of passing for a target
+// that simply hasn't been created yet.
+func isNotFoundError(stderr string) bool {
+	return strings.Contains(strings.ToLower(stderr), "dataset does not exist")
+}
+
+// isBusyError reports whether stderr from zfs describes a busy or mounted dataset.
+func isBusyError(stderr string) bool {
+	return ClassifyStderr(stderr) == ClassBusy
+}
@@ -0,0 +1,105 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestIsBusyError(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   bool
+	}{
+		{"cannot unmount '/backup/tank/data': Device or resource busy", true},
+		{"cannot receive incremental stream: dataset is busy", true},
+		{"cannot unmount '/backup/tank/data': unmount failed", true},
+		{"cannot receive new filesystem stream: out of space", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isBusyError(tt.stderr); got != tt.want {
+			t.Errorf("isBusyError(%q) = %v, want %v", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestTargetBusyErrorHint(t *testing.T) {
+	const hint = "enable unmounting the target"
+	err := &TargetBusyError{Dataset: "backup/tank/data", Stderr: "dataset is busy"}
+	if !strings.Contains(err.Error(), hint) {
+		t.Errorf("error %q without unmounting doesn't suggest it", err)
+	}
+	err.Unmount = true
+	if strings.Contains(err.Error(), hint) {
+		t.Errorf("error %q suggests unmounting, which is already enabled", err)
+	}
+}
+
+func TestDatasetExistsOn(t *testing.T) {
+	tests := []struct {
+		stderr  string
+		exists  bool
+		wantErr bool
+	}{
+		{"", true, false},
+		{"cannot open 'backup/tank/data': dataset does not exist", false, false},
+		{"cannot open 'backup/tank/data': no such pool 'backup'", false, true},
+		{"sh: 1: zfs: command not found", false, true},
+		{"cannot open 'backup/tank/data': permission denied", false, true},
+	}
+	for _, tt := range tests {
+		e := recordEntry{Cmds: [][]string{{"zfs", "list", "-H", "-t", "filesystem,volume", "backup/tank/data"}}}
+		if tt.stderr != "" {
+			e.Stderr, e.Error, e.Exit = tt.stderr, "exit status 1", 1
+		}
+		b := newReplayBackup(t, "backup", []recordEntry{e})
+		exists, err := b.datasetExistsOn(true, "backup/tank/data")
+		if exists != tt.exists || (err != nil) != tt.wantErr {
+			t.Errorf("stderr %q: exists %v, error %v; want exists %v, error %v", tt.stderr, exists, err, tt.exists, tt.wantErr)
+		}
+	}
+}
+
+func TestClassifyStderr(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   ErrorClass
+	}{
+		{"cannot receive new filesystem stream: out of space", ClassNoSpace},
+		{"cannot create 'backup/tank': quota exceeded", ClassNoSpace},
+		{"cannot destroy snapshots: permission denied", ClassPermission},
+		{"Unable to open /dev/zfs: Permission denied.", ClassPermission},
+		{"ssh: connect to host nas port 22: Connection refused", ClassConnection},
+		{"cannot open 'backup/tank/data': dataset does not exist", ClassNotFound},
+		{"cannot unmount '/backup/tank/data': Device or resource busy", ClassBusy},
+		{"invalid option 'Q'\nusage:\n\tlist [-Hp] ...", ClassInvalid},
+		{"something else went wrong", ClassUnknown},
+		{"", ClassUnknown},
+	}
+	for _, tt := range tests {
+		if got := ClassifyStderr(tt.stderr); got != tt.want {
+			t.Errorf("ClassifyStderr(%q) = %q, want %q", tt.stderr, got, tt.want)
+		}
+	}
+}
+
+func TestClassOf(t *testing.T) {
+	cmdErr := &CommandError{Op: "receiving", Stderr: "out of space", Class: ClassNoSpace, Err: errors.New("exit status 1")}
+	tests := []struct {
+		err  error
+		want ErrorClass
+	}{
+		{nil, ClassUnknown},
+		{errors.New("plain"), ClassUnknown},
+		{cmdErr, ClassNoSpace},
+		{fmt.Errorf("backing up tank/data: %w", cmdErr), ClassNoSpace},
+		{&TargetBusyError{Dataset: "backup/tank/data", Err: cmdErr}, ClassBusy},
+	}
+	for _, tt := range tests {
+		if got := ClassOf(tt.err); got != tt.want {
+			t.Errorf("ClassOf(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
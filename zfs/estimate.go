@@ -0,0 +1,112 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Estimate is the approximate amount of data a backup of one dataset
+// would transfer right now.
+type Estimate struct {
+	Dataset string
+	// Base is the snapshot an incremental send would start from, or ""
+	// for a full send.
+	Base  string
+	Bytes int64
+}
+
+// Estimate reports how much data backing up sources would transfer right
+// now, without creating snapshots or sending anything. Incremental sizes
+// come from the written@<base> property and full sizes from
+// logicalreferenced, so they are approximations.
+func (b *Backup) Estimate(sources []Source) ([]Estimate, error) {
+	b.resetRun()
+	var estimates []Estimate
+	for _, src := range sources {
+		plan, err := b.planSource(src)
+		if err != nil {
+			return nil, err
+		}
+		if plan == nil {
+			continue
+		}
+		for _, fs := range plan.filesystems {
+			e, err := b.estimateFilesystem(fs)
+			if err != nil {
+				return nil, err
+			}
+			estimates = append(estimates, e)
+		}
+	}
+	return estimates, nil
+}
+
+func (b *Backup) estimateFilesystem(fs string) (Estimate, error) {
+	targetVol := fmt.Sprintf("%s/%s", b.target, fs)
+	exists, err := b.backend.Exists(targetVol)
+	if err != nil {
+		return Estimate{}, err
+	}
+	var base string
+	if exists {
+		base, err = b.latestBackedUpSnapshot(fs, targetVol)
+		if errors.Is(err, errNoMatchingSnapshot) {
+			b.logDebug("no matching snapshot, estimating full send", "fs", fs)
+		} else if err != nil {
+			return Estimate{}, err
+		}
+	}
+
+	prop := "logicalreferenced"
+	if base != "" {
+		_, snap := splitSnapshot(base)
+		prop = "written@" + snap
+	}
+	lines, stderr, err := b.query(b.buildCommand(false, "get", "-H", "-p", "-o", "value", prop, fs)...)
+	if err != nil {
+		return Estimate{}, b.wrapCmdError("estimating size", stderr, err)
+	}
+	if len(lines) == 0 {
+		return Estimate{}, fmt.Errorf("no %s value for %s", prop, fs)
+	}
+	size, err := parseBytes(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return Estimate{}, fmt.Errorf("invalid %s for %s: %w", prop, fs, err)
+	}
+	return Estimate{Dataset: fs, Base: base, Bytes: size}, nil
+}
+
+// WithEstimateThresholdOption skips the send size estimate for incremental
+// sends whose dataset has written less than threshold bytes since the
+// base snapshot, since the zfs send -nP pass can double the run time on
+// trees of many small datasets. Those sends have no size for progress.
+func WithEstimateThresholdOption(threshold int64) BackupOption {
+	return func(b *Backup) error {
+		if threshold < 0 {
+			return fmt.Errorf("estimate threshold cannot be negative")
+		}
+		b.estimateThreshold = threshold
+		return nil
+	}
+}
+
+// belowEstimateThreshold reports whether fs has written less than the
+// estimate threshold since startSnap. Errors only cause the estimate to
+// be made as usual.
+func (b *Backup) belowEstimateThreshold(fs, startSnap string) bool {
+	if b.estimateThreshold == 0 || startSnap == "" {
+		return false
+	}
+	_, snap := splitSnapshot(startSnap)
+	lines, stderr, err := b.query(b.buildCommand(false, "get", "-H", "-p", "-o", "value", "written@"+snap, fs)...)
+	if err != nil || len(lines) == 0 {
+		b.logDebug("error getting written, estimating anyway", "fs", fs, "err", b.wrapCmdError("getting written", stderr, err))
+		return false
+	}
+	written, err := parseBytes(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return false
+	}
+	return written < b.estimateThreshold
+}
@@ -0,0 +1,71 @@
+package zfs
+
+import (
+	"testing"
+)
+
+func TestEstimateFullSend(t *testing.T) {
+	b := newReplayBackup(t, "backup", []recordEntry{
+		{
+			Cmds:   [][]string{{"zfs", "list", "-H", "-t", "filesystem,volume", "backup/tank/data"}},
+			Stderr: "cannot open 'backup/tank/data': dataset does not exist",
+			Error:  "exit status 1",
+		},
+		{
+			Cmds:   [][]string{{"zfs", "get", "-H", "-p", "-o", "value", "logicalreferenced", "tank/data"}},
+			Stdout: []string{"4096"},
+		},
+	})
+	src, err := ParseSource("tank/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimates, err := b.Estimate([]Source{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Estimate{Dataset: "tank/data", Bytes: 4096}
+	if len(estimates) != 1 || estimates[0] != want {
+		t.Errorf("Estimate = %+v, want [%+v]", estimates, want)
+	}
+	if len(b.replay) > 0 {
+		t.Errorf("%d fixture entries not replayed, next is %q", len(b.replay), quotePipeline(b.replay[0].Cmds))
+	}
+}
+
+// TestEstimateTwice checks that a second Estimate doesn't count the
+// datasets of the first towards the per-run limits.
+func TestEstimateTwice(t *testing.T) {
+	var entries []recordEntry
+	for range 2 {
+		entries = append(entries,
+			recordEntry{
+				Cmds:   [][]string{{"zfs", "list", "-H", "-t", "filesystem,volume", "backup/tank/data"}},
+				Stderr: "cannot open 'backup/tank/data': dataset does not exist",
+				Error:  "exit status 1",
+				Exit:   1,
+			},
+			recordEntry{
+				Cmds:   [][]string{{"zfs", "get", "-H", "-p", "-o", "value", "logicalreferenced", "tank/data"}},
+				Stdout: []string{"4096"},
+			},
+		)
+	}
+	b := newReplayBackup(t, "backup", entries, WithLimitsOption(1, 0))
+	src, err := ParseSource("tank/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 2 {
+		estimates, err := b.Estimate([]Source{src})
+		if err != nil {
+			t.Fatalf("Estimate %d: %v", i+1, err)
+		}
+		if len(estimates) != 1 || estimates[0].Bytes != 4096 {
+			t.Errorf("Estimate %d = %+v, want 4096 bytes for tank/data", i+1, estimates)
+		}
+	}
+	if len(b.replay) > 0 {
+		t.Errorf("%d fixture entries not replayed, next is %q", len(b.replay), quotePipeline(b.replay[0].Cmds))
+	}
+}
@@ -0,0 +1,19 @@
+package zfs
+
+// WithExplainOption logs the reasoning behind each planned action: why a
+// send is full or incremental and from which base, and why each snapshot
+// is kept or destroyed during cleanup. Combine with WithDryRunOption to
+// debug matching and retention without changing anything.
+func WithExplainOption() BackupOption {
+	return func(b *Backup) error {
+		b.explainPlan = true
+		return nil
+	}
+}
+
+// explain logs an annotation of a planned action if explaining is enabled.
+func (b *Backup) explain(msg string, args ...any) {
+	if b.explainPlan {
+		b.logger.Info("explain: "+msg, args...)
+	}
+}
@@ -0,0 +1,79 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jamesmcdonald/zfsbackup/util"
+)
+
+// Failback replicates a promoted target dataset back to original on the
+// source after a failover, reversing the usual direction. promoted is
+// snapshotted and sent incrementally from the latest snapshot it shares
+// with original. Failback refuses to run if original has snapshots newer
+// than that base, or has been written to since, since receiving would roll
+// those changes back. On success the primary mark is cleared from
+// promoted, so scheduled backups can resume from the failback snapshot.
+func (b *Backup) Failback(promoted, original string) error {
+	for _, d := range []struct {
+		isTarget bool
+		vol      string
+	}{{true, promoted}, {false, original}} {
+		exists, err := b.datasetExistsOn(d.isTarget, d.vol)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("dataset %s does not exist", d.vol)
+		}
+	}
+
+	base, err := b.getLatestMatchingSnapshot(promoted, original)
+	if errors.Is(err, errNoMatchingSnapshot) {
+		return fmt.Errorf("%s and %s have no snapshot in common, cannot fail back incrementally", promoted, original)
+	} else if err != nil {
+		return err
+	}
+	_, baseName := splitSnapshot(base)
+	newer, written, err := b.changesSince(false, original, baseName)
+	if err != nil {
+		return err
+	}
+	if len(newer) > 0 {
+		return fmt.Errorf("%s has diverged: %d snapshot(s) newer than %s (%s)", original, len(newer), base, strings.Join(newer, ", "))
+	}
+	if written > 0 {
+		return fmt.Errorf("%s has diverged: %s written since %s", original, util.HumanBytes(written), base)
+	}
+
+	now, err := b.now()
+	if err != nil {
+		return err
+	}
+	snap := fmt.Sprintf("%s@%s", promoted, b.snapshotName(now))
+	args := []string{"snapshot"}
+	for _, prop := range b.snapshotProps() {
+		args = append(args, "-o", prop)
+	}
+	b.logger.Info("creating failback snapshot", "snapshot", snap)
+	if _, stderr, err := b.run(b.buildCommand(true, append(args, snap)...)...); err != nil {
+		return b.wrapCmdError("creating snapshot", stderr, err)
+	}
+
+	cmds := [][]string{b.throttle(b.buildCommand(true, "send", "-I", base, snap))}
+	if b.pvPath != "" {
+		cmds = append(cmds, []string{b.pvPath})
+	}
+	cmds = append(cmds, b.throttle(b.buildCommand(false, "receive", "-F", original)))
+	b.logger.Info("failing back", "from", promoted, "to", original, "base", base, "snapshot", snap)
+	if _, stderr, err := b.pipeline(cmds, b.sendMeter(0), nil); err != nil {
+		return b.wrapCmdError(fmt.Sprintf("failing back %s", promoted), stderr, err)
+	}
+
+	b.logger.Info("clearing primary mark", "vol", promoted)
+	if _, stderr, err := b.run(b.buildCommand(true, "inherit", roleProperty, promoted)...); err != nil {
+		return b.wrapCmdError("clearing role", stderr, err)
+	}
+	return nil
+}
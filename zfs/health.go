@@ -0,0 +1,261 @@
+package zfs
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SmartMode controls the SMART health check of the target pool's disks.
+type SmartMode string
+
+const (
+	SmartOff    SmartMode = ""
+	SmartWarn   SmartMode = "warn"
+	SmartRefuse SmartMode = "refuse"
+)
+
+// ParseSmartMode parses a SMART check mode: "warn", "refuse" or "" for off.
+func ParseSmartMode(s string) (SmartMode, error) {
+	switch m := SmartMode(s); m {
+	case SmartOff, SmartWarn, SmartRefuse:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid SMART check mode %q: must be warn or refuse", s)
+}
+
+// smartctl exit status bits, see smartctl(8).
+const (
+	smartCheckFailed = 0x07 // command line, device open or SMART command failed
+	smartFailing     = 0x08 // SMART status check returned "DISK FAILING"
+	smartPrefail     = 0x10 // prefail attributes at or below threshold
+)
+
+// WithSmartCheckOption checks the SMART health of the target pool's disks
+// with smartctl before replicating. In SmartRefuse mode a failing disk
+// aborts the run; in SmartWarn mode it is only logged. smartctl must be
+// available next to the target zfs command.
+func WithSmartCheckOption(mode SmartMode) BackupOption {
+	return func(b *Backup) error {
+		b.smartCheck = mode
+		return nil
+	}
+}
+
+// targetTool returns the target command with zfs replaced by name, so
+// tools like zpool run where the target zfs command does, e.g. over ssh.
+func (b *Backup) targetTool(name string, args ...string) ([]string, error) {
+	last := len(b.targetCmd) - 1
+	if filepath.Base(b.targetCmd[last]) != "zfs" {
+		return nil, fmt.Errorf("can't run %s: target command %q doesn't end in zfs", name, quoteCommand(b.targetCmd))
+	}
+	cmd := slices.Clone(b.targetCmd)
+	cmd[last] = name
+	return append(cmd, args...), nil
+}
+
+// targetPool returns the name of the pool holding the target.
+func (b *Backup) targetPool() string {
+	pool, _, _ := strings.Cut(b.target, "/")
+	return pool
+}
+
+// poolDevices lists the leaf devices of pool as absolute paths.
+func (b *Backup) poolDevices(pool string) ([]string, error) {
+	args, err := b.targetTool("zpool", "status", "-P", "-L", pool)
+	if err != nil {
+		return nil, err
+	}
+	lines, stderr, err := b.query(args...)
+	if err != nil {
+		return nil, b.wrapCmdError("getting pool status", stderr, err)
+	}
+	return parsePoolDevices(lines), nil
+}
+
+// parsePoolDevices extracts the device paths from zpool status -P output.
+func parsePoolDevices(lines []string) []string {
+	var devs []string
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "/") {
+			devs = append(devs, fields[0])
+		}
+	}
+	return devs
+}
+
+// checkSmart runs the SMART health check of the target pool's disks.
+func (b *Backup) checkSmart() error {
+	if b.smartCheck == SmartOff {
+		return nil
+	}
+	pool := b.targetPool()
+	devs, err := b.poolDevices(pool)
+	if err != nil {
+		return err
+	}
+	var failing []string
+	for _, dev := range devs {
+		args, err := b.targetTool("smartctl", "-H", dev)
+		if err != nil {
+			return err
+		}
+		_, stderr, err := b.query(args...)
+		if err == nil {
+			b.logDebug("SMART health ok", "device", dev)
+			continue
+		}
+		code := exitCode(err)
+		switch {
+		case code < 0 || code&smartCheckFailed != 0:
+			b.logger.Warn("could not check SMART health", "device", dev, "err", b.wrapCmdError("running smartctl", stderr, err))
+		case code&(smartFailing|smartPrefail) != 0:
+			b.logger.Warn("target disk is failing SMART health check", "pool", pool, "device", dev)
+			failing = append(failing, dev)
+		}
+	}
+	if len(failing) > 0 && b.smartCheck == SmartRefuse {
+		return fmt.Errorf("refusing to back up to pool %s: failing disks %s", pool, strings.Join(failing, ", "))
+	}
+	return nil
+}
+
+// poolErrorsProperty stores the error counters of the target pool's
+// devices seen by the last check, on the pool's root dataset, so new
+// errors can be told apart from old ones.
+const poolErrorsProperty = propertyPrefix + "pool-errors"
+
+// errorCounts holds the read, write and checksum error counters of a
+// pool device.
+type errorCounts [3]int64
+
+// WithPoolErrorCheckOption checks the read, write and checksum error
+// counters in zpool status of the target pool after replicating, and fails
+// the run if any of them increased since the last check. zpool must be
+// available next to the target zfs command.
+func WithPoolErrorCheckOption() BackupOption {
+	return func(b *Backup) error {
+		b.checkPoolErrors = true
+		return nil
+	}
+}
+
+// parsePoolErrors extracts the error counters of every vdev and device
+// from zpool status -p output.
+func parsePoolErrors(lines []string) map[string]errorCounts {
+	counts := make(map[string]errorCounts)
+	inConfig := false
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 5 && fields[0] == "NAME" && fields[2] == "READ" {
+			inConfig = true
+			continue
+		}
+		if !inConfig {
+			continue
+		}
+		if len(fields) == 0 || strings.HasSuffix(fields[0], ":") {
+			inConfig = false
+			continue
+		}
+		if len(fields) < 5 {
+			continue
+		}
+		var c errorCounts
+		ok := true
+		for i := range c {
+			n, err := strconv.ParseInt(fields[2+i], 10, 64)
+			if err != nil {
+				ok = false
+				break
+			}
+			c[i] = n
+		}
+		if ok {
+			counts[fields[0]] = c
+		}
+	}
+	return counts
+}
+
+// formatPoolErrors encodes counts for poolErrorsProperty as
+// name=read/write/cksum pairs separated by commas.
+func formatPoolErrors(counts map[string]errorCounts) string {
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(counts)) {
+		c := counts[name]
+		parts = append(parts, fmt.Sprintf("%s=%d/%d/%d", name, c[0], c[1], c[2]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseStoredPoolErrors decodes a poolErrorsProperty value. Malformed
+// entries are ignored, so they count as zero.
+func parseStoredPoolErrors(s string) map[string]errorCounts {
+	counts := make(map[string]errorCounts)
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		var c errorCounts
+		if _, err := fmt.Sscanf(value, "%d/%d/%d", &c[0], &c[1], &c[2]); err == nil {
+			counts[name] = c
+		}
+	}
+	return counts
+}
+
+// checkPoolErrorCounters compares the target pool's error counters with
+// those stored by the last check, records the current ones and returns an
+// error listing the devices whose counters increased.
+func (b *Backup) checkPoolErrorCounters() error {
+	if !b.checkPoolErrors {
+		return nil
+	}
+	pool := b.targetPool()
+	args, err := b.targetTool("zpool", "status", "-p", pool)
+	if err != nil {
+		return err
+	}
+	lines, stderr, err := b.query(args...)
+	if err != nil {
+		return b.wrapCmdError("getting pool status", stderr, err)
+	}
+	current := parsePoolErrors(lines)
+
+	stored, stderr, err := b.query(b.buildCommand(true, "get", "-H", "-o", "value", poolErrorsProperty, pool)...)
+	if err != nil {
+		return b.wrapCmdError("getting stored pool errors", stderr, err)
+	}
+	var previous map[string]errorCounts
+	if len(stored) > 0 {
+		previous = parseStoredPoolErrors(strings.TrimSpace(stored[0]))
+	}
+
+	var increased []string
+	for _, name := range slices.Sorted(maps.Keys(current)) {
+		c, p := current[name], previous[name]
+		if c[0] > p[0] || c[1] > p[1] || c[2] > p[2] {
+			b.logger.Warn("target pool device has new errors", "pool", pool, "device", name,
+				"read", c[0], "write", c[1], "cksum", c[2],
+				"previous_read", p[0], "previous_write", p[1], "previous_cksum", p[2])
+			increased = append(increased, name)
+		}
+	}
+
+	value := formatPoolErrors(current)
+	if len(stored) == 0 || strings.TrimSpace(stored[0]) != value {
+		if _, stderr, err := b.run(b.buildCommand(true, "set", poolErrorsProperty+"="+value, pool)...); err != nil {
+			return b.wrapCmdError("storing pool errors", stderr, err)
+		}
+	}
+	if len(increased) > 0 {
+		return fmt.Errorf("target pool %s has new read, write or checksum errors on %s; check zpool status before trusting these backups", pool, strings.Join(increased, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package zfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// holdTag is the user hold tag zfsbackup places on target snapshots.
+const holdTag = "zfsbackup"
+
+// WithHoldTargetOption places a hold on every snapshot received on the
+// target. Held snapshots cannot be destroyed, so target pruning skips
+// them until they are released with Unlock. Combined with delegated
+// permissions that don't include release, this stops a compromised
+// source host from destroying the target's history.
+func WithHoldTargetOption() BackupOption {
+	return func(b *Backup) error {
+		b.holdTarget = true
+		return nil
+	}
+}
+
+// holdSnapshot places the zfsbackup hold on a target snapshot.
+func (b *Backup) holdSnapshot(snap string) error {
+	b.logger.Info("holding snapshot", "snap", snap)
+	_, stderr, err := b.run(b.buildCommand(true, "hold", holdTag, snap)...)
+	if err != nil {
+		return b.wrapCmdError("holding snapshot", stderr, err)
+	}
+	return nil
+}
+
+// isHeld reports whether snap has any user holds.
+func (b *Backup) isHeld(snap string) (bool, error) {
+	lines, stderr, err := b.query(b.buildCommand(b.isTargetVolume(snap), "get", "-H", "-p", "-o", "value", "userrefs", snap)...)
+	if err != nil {
+		return false, b.wrapCmdError("checking holds", stderr, err)
+	}
+	if len(lines) == 0 {
+		return false, nil
+	}
+	refs, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return false, fmt.Errorf("invalid userrefs %q for %s", lines[0], snap)
+	}
+	return refs > 0, nil
+}
+
+// Unlock releases the zfsbackup holds on every snapshot of vol and its
+// descendants on the target, so they can be pruned again. Run it with a
+// target command whose identity is allowed to release holds.
+func (b *Backup) Unlock(vol string) error {
+	// Only snapshots with user holds need to be passed to zfs holds.
+	var snaps []string
+	stderr, err := b.queryEach(func(l string) error {
+		name, refs, ok := strings.Cut(l, "\t")
+		if !ok {
+			return fmt.Errorf("malformed userrefs line %q", l)
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(refs)); err == nil && n > 0 {
+			snaps = append(snaps, name)
+		}
+		return nil
+	}, b.buildCommand(true, "list", "-H", "-p", "-o", "name,userrefs", "-t", "snapshot", "-r", vol)...)
+	if err != nil {
+		if stderr == "" {
+			return err
+		}
+		return b.wrapCmdError("listing snapshots", stderr, err)
+	}
+	if len(snaps) == 0 {
+		b.logger.Info("no held snapshots to unlock", "vol", vol)
+		return nil
+	}
+
+	lines, stderr, err := b.query(b.buildCommand(true, append([]string{"holds", "-H"}, snaps...)...)...)
+	if err != nil {
+		return b.wrapCmdError("listing holds", stderr, err)
+	}
+	var held []string
+	for _, l := range parseNames(lines) {
+		cols := strings.Split(l, "\t")
+		if len(cols) >= 2 && strings.TrimSpace(cols[1]) == holdTag {
+			held = append(held, strings.TrimSpace(cols[0]))
+		}
+	}
+	if len(held) == 0 {
+		b.logger.Info("no held snapshots to unlock", "vol", vol)
+		return nil
+	}
+
+	b.logger.Info("releasing holds", "vol", vol, "snaps", len(held))
+	_, stderr, err = b.run(b.buildCommand(true, append([]string{"release", holdTag}, held...)...)...)
+	if err != nil {
+		return b.wrapCmdError("releasing holds", stderr, err)
+	}
+	return nil
+}
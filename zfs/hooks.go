@@ -0,0 +1,126 @@
+package zfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultHookTimeout is used when WithSnapshotHooksOption is given no timeout.
+const DefaultHookTimeout = 5 * time.Minute
+
+// hookWaitDelay is how long a hook's output is read after the hook exited
+// or was killed, for commands it left running in the background.
+const hookWaitDelay = 5 * time.Second
+
+// WithSnapshotHooksOption runs shell commands once around the snapshots
+// of a run, for example to stop a service that cannot be quiesced
+// otherwise. Each hook runs with sh -c and is killed after timeout. Post
+// hooks always run once any pre hook has been attempted, even if a pre
+// hook or the snapshot failed or the run is stopped with SIGINT or
+// SIGTERM.
+func WithSnapshotHooksOption(pre, post []string, timeout time.Duration) BackupOption {
+	return func(b *Backup) error {
+		if timeout < 0 {
+			return fmt.Errorf("hook timeout cannot be negative")
+		}
+		if timeout == 0 {
+			timeout = DefaultHookTimeout
+		}
+		b.preSnapshot = pre
+		b.postSnapshot = post
+		b.hookTimeout = timeout
+		return nil
+	}
+}
+
+// runHook runs a single hook command. Skipped in dry-run mode.
+func (b *Backup) runHook(stage, hook string) error {
+	args := []string{"sh", "-c", hook}
+	b.printCommands(args)
+	if b.dryrun || b.replaying {
+		b.logger.Info("dry run: skip hook", "stage", stage, "hook", hook)
+		return nil
+	}
+
+	b.logger.Info("running hook", "stage", stage, "hook", hook)
+	ctx, cancel := context.WithTimeout(context.Background(), b.hookTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Kill the hook's whole process group on timeout, not just sh, so
+	// commands it started can't keep running and holding its output open.
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	c.WaitDelay = hookWaitDelay
+	var out bytes.Buffer
+	c.Stdout = &out
+	c.Stderr = &out
+	err := c.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook %q timed out after %s", stage, hook, b.hookTimeout)
+	}
+	if errors.Is(err, exec.ErrWaitDelay) {
+		b.logger.Warn("hook left commands running in the background with its output open", "stage", stage, "hook", hook)
+		err = nil
+	}
+	if err != nil {
+		return b.wrapCmdError(fmt.Sprintf("running %s hook %q", stage, hook), strings.TrimSpace(out.String()), err)
+	}
+	return nil
+}
+
+// withSnapshotHooks runs fn between the pre and post snapshot hooks. Post
+// hooks all run even if fn or an earlier hook fails. If there are post
+// hooks, SIGINT and SIGTERM are held meanwhile, so stopping the run, e.g.
+// with systemctl stop, can't leave a service stopped by a pre hook down:
+// no further pre hook or fn is started, the post hooks run, and the run
+// then fails.
+func (b *Backup) withSnapshotHooks(fn func() error) error {
+	var caught os.Signal
+	interrupted := func() bool { return false }
+	if len(b.postSnapshot) > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+		interrupted = func() bool {
+			if caught == nil {
+				select {
+				case caught = <-sigs:
+					b.logger.Warn("interrupted, running post-snapshot hooks before stopping", "signal", caught)
+				default:
+				}
+			}
+			return caught != nil
+		}
+	}
+
+	var err error
+	for _, hook := range b.preSnapshot {
+		if interrupted() {
+			break
+		}
+		if err = b.runHook("pre-snapshot", hook); err != nil {
+			break
+		}
+	}
+	if err == nil && !interrupted() {
+		err = fn()
+	}
+	errs := []error{err}
+	for _, hook := range b.postSnapshot {
+		errs = append(errs, b.runHook("post-snapshot", hook))
+	}
+	if interrupted() {
+		errs = append(errs, fmt.Errorf("interrupted by %s", caught))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newHookBackup returns a Backup running the given snapshot hooks.
+func newHookBackup(t *testing.T, pre, post []string, timeout time.Duration) *Backup {
+	t.Helper()
+	b, err := NewBackup("backup",
+		WithSnapshotHooksOption(pre, post, timeout),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSnapshotHooks(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "log")
+	echo := func(s string) string { return "echo " + s + " >>" + log }
+	tests := []struct {
+		name    string
+		pre     []string
+		post    []string
+		fnErr   error
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "in order",
+			pre:  []string{echo("pre1"), echo("pre2")},
+			post: []string{echo("post1"), echo("post2")},
+			want: "pre1 pre2 snapshot post1 post2",
+		},
+		{
+			name:    "failed pre hook",
+			pre:     []string{"exit 3", echo("pre2")},
+			post:    []string{echo("post")},
+			want:    "post",
+			wantErr: true,
+		},
+		{
+			name:    "failed snapshot",
+			pre:     []string{echo("pre")},
+			post:    []string{"exit 1", echo("post2")},
+			fnErr:   errors.New("snapshot failed"),
+			want:    "pre snapshot post2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(log)
+			b := newHookBackup(t, tt.pre, tt.post, time.Minute)
+			err := b.withSnapshotHooks(func() error {
+				f, err := os.OpenFile(log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if _, err := f.WriteString("snapshot\n"); err != nil {
+					return err
+				}
+				return tt.fnErr
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error %v, want error %v", err, tt.wantErr)
+			}
+			out, _ := os.ReadFile(log)
+			if got := strings.Join(strings.Fields(string(out)), " "); got != tt.want {
+				t.Errorf("ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotHookTimeout(t *testing.T) {
+	b := newHookBackup(t, []string{"exec sleep 10"}, nil, 100*time.Millisecond)
+	start := time.Now()
+	err := b.withSnapshotHooks(func() error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("hook killed after %s", d)
+	}
+}
+
+// TestSnapshotHookTimeoutChildren checks that the processes a timed out
+// hook started are killed with it, so they can't hold its output open and
+// keep the run waiting.
+func TestSnapshotHookTimeoutChildren(t *testing.T) {
+	b := newHookBackup(t, []string{"sleep 10; true"}, nil, 100*time.Millisecond)
+	start := time.Now()
+	err := b.withSnapshotHooks(func() error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("hook killed after %s", d)
+	}
+}
+
+// TestSnapshotHooksSignal sends SIGTERM to the test process from a pre
+// hook and checks that the post hook still runs, and nothing after the
+// interrupted pre hook does.
+func TestSnapshotHooksSignal(t *testing.T) {
+	dir := t.TempDir()
+	pre := []string{
+		fmt.Sprintf("kill -TERM %d; sleep 0.2", os.Getpid()),
+		"touch " + filepath.Join(dir, "pre"),
+	}
+	post := []string{"touch " + filepath.Join(dir, "post")}
+	b, err := NewBackup("backup",
+		WithSnapshotHooksOption(pre, post, time.Minute),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotted := false
+	err = b.withSnapshotHooks(func() error {
+		snapshotted = true
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("error %v, want an interruption", err)
+	}
+	if snapshotted {
+		t.Error("snapshot taken after the signal")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pre")); err == nil {
+		t.Error("second pre hook ran after the signal")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "post")); err != nil {
+		t.Errorf("post hook didn't run: %v", err)
+	}
+}
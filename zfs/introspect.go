@@ -0,0 +1,35 @@
+package zfs
+
+import "strings"
+
+// Endpoint describes the zfs installation reached by the source or target
+// command.
+type Endpoint struct {
+	Command []string `json:"command"`
+	Version []string `json:"version,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// ProbeEndpoint runs zfs version through the target command if isTarget
+// is set, or the source command otherwise. Failures are reported in the
+// Endpoint rather than returned, so an unreachable endpoint can still be
+// described.
+func (b *Backup) ProbeEndpoint(isTarget bool) Endpoint {
+	args := b.buildCommand(isTarget, "version")
+	e := Endpoint{Command: args[:len(args)-1]}
+	lines, stderr, err := b.query(args...)
+	if err != nil && b.sshEndpointOf(isTarget) != nil {
+		e.Error = b.sshError(isTarget, stderr, err).Error()
+		return e
+	}
+	if err != nil {
+		e.Error = b.wrapCmdError("getting zfs version", stderr, err).Error()
+		return e
+	}
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			e.Version = append(e.Version, l)
+		}
+	}
+	return e
+}
@@ -0,0 +1,367 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// JournalEntry is a change recorded in the intent journal before it is
+// made. A second entry with the same ID and Done set marks it finished.
+type JournalEntry struct {
+	ID        string    `json:"id"`
+	PID       int       `json:"pid,omitempty"`
+	BootID    string    `json:"boot_id,omitempty"` // boot of the host, so a reused PID after a reboot isn't mistaken for the process
+	Start     uint64    `json:"start,omitempty"`   // start time of the process in clock ticks since boot
+	Time      time.Time `json:"time,omitzero"`
+	Operation string    `json:"op,omitempty"`
+	Dataset   string    `json:"dataset,omitempty"`
+	Snapshots []string  `json:"snapshots,omitempty"`
+	Command   string    `json:"command,omitempty"`
+	Done      bool      `json:"done,omitempty"`
+}
+
+// Stale reports whether the process that made e is gone, so e was still in
+// flight when it crashed or was killed. A process with the same PID
+// started after a reboot, or later in the same boot, is a different one.
+// Processes are looked up on the local host, so a journal must not be
+// shared between hosts.
+func (e JournalEntry) Stale() bool {
+	if id := bootID(); e.BootID != "" && id != "" && id != e.BootID {
+		return true
+	}
+	if start := processStart(e.PID); e.Start != 0 && start != 0 && start != e.Start {
+		return true
+	}
+	p, err := os.FindProcess(e.PID)
+	if err != nil {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err != nil && !errors.Is(err, os.ErrPermission)
+}
+
+// bootID returns the identifier the kernel gave the current boot, or ""
+// where there is none.
+func bootID() string {
+	id, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(id))
+}
+
+// processStart returns the start time of process pid in clock ticks since
+// boot, or 0 if it isn't running or /proc isn't available.
+func processStart(pid int) uint64 {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name in parentheses may contain spaces, so the fields
+	// are counted from after it: starttime is field 22, the 20th of them.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+	return start
+}
+
+func (e JournalEntry) String() string {
+	s := fmt.Sprintf("%s %s", e.Time.Local().Format(time.DateTime), e.Operation)
+	if e.Dataset != "" {
+		s += " " + e.Dataset
+	}
+	if len(e.Snapshots) > 0 {
+		s += " (" + strings.Join(e.Snapshots, ", ") + ")"
+	}
+	return s
+}
+
+// journal appends entries to the intent journal file. Each write is
+// synced before the change it describes is made.
+type journal struct {
+	path  string
+	boot  string
+	start uint64
+	mu    sync.Mutex
+	next  int
+}
+
+// WithJournalOption records every change in the intent journal at path
+// before making it, and marks it done once it completes, so the changes
+// in flight when the host crashed can be found afterwards. Dry runs
+// write nothing. Stale entries are logged at the start of every run until
+// cleared with ClearJournal.
+func WithJournalOption(path string) BackupOption {
+	return func(b *Backup) error {
+		if path == "" {
+			return fmt.Errorf("journal path cannot be empty")
+		}
+		b.journal = &journal{path: path, boot: bootID(), start: processStart(os.Getpid())}
+		return nil
+	}
+}
+
+// lockJournal takes an exclusive lock on the journal at path, held until
+// the returned function is called. The lock is taken on a separate file,
+// since ClearJournal replaces the journal itself.
+func lockJournal(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal lock: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking journal: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+func (j *journal) append(e JournalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o750); err != nil {
+		return fmt.Errorf("error creating journal directory: %w", err)
+	}
+	unlock, err := lockJournal(j.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("error opening journal: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing journal: %w", err)
+	}
+	return f.Close()
+}
+
+// begin records cmds as in flight and returns the function that marks
+// them done.
+func (j *journal) begin(cmds [][]string) (func() error, error) {
+	j.mu.Lock()
+	j.next++
+	id := fmt.Sprintf("%d-%d-%d", os.Getpid(), time.Now().Unix(), j.next)
+	j.mu.Unlock()
+
+	e := describeChange(cmds)
+	e.ID, e.PID, e.BootID, e.Start, e.Time = id, os.Getpid(), j.boot, j.start, time.Now()
+	if err := j.append(e); err != nil {
+		return nil, err
+	}
+	return func() error {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return j.append(JournalEntry{ID: id, Done: true})
+	}, nil
+}
+
+// describeChange fills in the operation, dataset and snapshots of the
+// change made by cmds. A pipeline is described by its zfs send and the
+// dataset received into.
+func describeChange(cmds [][]string) JournalEntry {
+	e := JournalEntry{Command: quotePipeline(cmds)}
+	for _, args := range cmds {
+		i := findTool(args)
+		if i < 0 {
+			continue
+		}
+		verb := args[i+1]
+		if e.Operation == "" {
+			e.Operation = filepath.Base(args[i]) + " " + verb
+		}
+		for j := i + 2; j < len(args); j++ {
+			arg := args[j]
+			if arg == "-o" {
+				j++
+				continue
+			}
+			if strings.HasPrefix(arg, "-") || (verb == "set" && strings.Contains(arg, "=")) {
+				continue
+			}
+			if vol, _, ok := strings.Cut(arg, "@"); ok {
+				e.Snapshots = append(e.Snapshots, arg)
+				if e.Dataset == "" {
+					e.Dataset = vol
+				}
+			} else {
+				e.Dataset = arg
+			}
+		}
+	}
+	return e
+}
+
+// ReadJournal returns the entries of the journal at path that were never
+// marked done, oldest first. A missing journal has none.
+func ReadJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %w", err)
+	}
+	defer f.Close()
+
+	var pending []JournalEntry
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A crash while appending leaves a truncated last line.
+			continue
+		}
+		if e.Done {
+			if i, ok := index[e.ID]; ok {
+				pending[i].Done = true
+			}
+			continue
+		}
+		index[e.ID] = len(pending)
+		pending = append(pending, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading journal: %w", err)
+	}
+	var open []JournalEntry
+	for _, e := range pending {
+		if !e.Done {
+			open = append(open, e)
+		}
+	}
+	return open, nil
+}
+
+// ClearJournal rewrites the journal at path with only the entries still
+// in flight in running processes, dropping finished and stale ones, and
+// returns the number of stale entries dropped. The journal is locked
+// throughout, so entries appended meanwhile by running processes aren't
+// lost.
+func ClearJournal(path string) (int, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	unlock, err := lockJournal(path)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	entries, err := ReadJournal(path)
+	if err != nil {
+		return 0, err
+	}
+	var keep []byte
+	stale := 0
+	for _, e := range entries {
+		if e.Stale() {
+			stale++
+			continue
+		}
+		line, err := json.Marshal(e)
+		if err != nil {
+			return 0, err
+		}
+		keep = append(append(keep, line...), '\n')
+	}
+	tmp := path + ".tmp." + strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(tmp, keep, 0o640); err != nil {
+		return 0, fmt.Errorf("error writing journal: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("error replacing journal: %w", err)
+	}
+	return stale, nil
+}
+
+// journaled makes the change cmds with fn, recorded in the journal if
+// one is set. The change is marked done even if it failed, since it is no
+// longer in flight.
+func (b *Backup) journaled(cmds [][]string, fn func() ([]string, string, error)) ([]string, string, error) {
+	if b.journal == nil || b.replaying {
+		return fn()
+	}
+	done, err := b.journal.begin(cmds)
+	if err != nil {
+		return nil, "", err
+	}
+	stdout, stderr, err := fn()
+	if jerr := done(); jerr != nil {
+		b.logger.Warn("could not mark change done in journal", "cmd", quotePipeline(cmds), "err", jerr)
+	}
+	return stdout, stderr, err
+}
+
+// staleJournalEntries returns the entries of b's journal whose process is
+// gone.
+func (b *Backup) staleJournalEntries() ([]JournalEntry, error) {
+	if b.journal == nil {
+		return nil, nil
+	}
+	entries, err := ReadJournal(b.journal.path)
+	if err != nil {
+		return nil, err
+	}
+	var stale []JournalEntry
+	for _, e := range entries {
+		if e.Stale() {
+			stale = append(stale, e)
+		}
+	}
+	return stale, nil
+}
+
+// checkJournal logs every stale journal entry, so operators see what was
+// in flight when an earlier run died. If nothing is in flight, the
+// finished entries are dropped so the journal doesn't grow forever.
+func (b *Backup) checkJournal() error {
+	if b.journal == nil {
+		return nil
+	}
+	entries, err := ReadJournal(b.journal.path)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		if _, err := os.Stat(b.journal.path); err != nil || b.dryrun {
+			return nil
+		}
+		_, err := ClearJournal(b.journal.path)
+		return err
+	}
+	for _, e := range entries {
+		if !e.Stale() {
+			continue
+		}
+		b.logger.Warn("change was in flight when an earlier run died, check its state and clear the journal",
+			"op", e.Operation, "dataset", e.Dataset, "snapshots", e.Snapshots, "since", e.Time, "journal", b.journal.path)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package zfs
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	b, err := NewBackup("backup", WithJournalOption(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapDone, err := b.journal.begin([][]string{{"zfs", "snapshot", "tank/data@b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.journal.begin([][]string{{"zfs", "send", "-i", "tank/data@a", "tank/data@b"}, {"zfs", "receive", "-F", "backup/tank/data"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := snapDone(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An entry of a process that is gone.
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := json.Marshal(JournalEntry{ID: "dead-1", PID: dead.Process.Pid, Operation: "zfs destroy", Dataset: "tank/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d entries in flight, want 2: %v", len(entries), entries)
+	}
+	send := entries[0]
+	if send.Operation != "zfs send" || send.Dataset != "backup/tank/data" || !slices.Equal(send.Snapshots, []string{"tank/data@a", "tank/data@b"}) {
+		t.Errorf("send entry %+v", send)
+	}
+	if send.Stale() {
+		t.Error("entry of this process is stale")
+	}
+	if !entries[1].Stale() {
+		t.Error("entry of a finished process isn't stale")
+	}
+
+	stale, err := ClearJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 1 {
+		t.Errorf("ClearJournal dropped %d stale entries, want 1", stale)
+	}
+	entries, err = ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != send.ID {
+		t.Errorf("entries after clearing %v, want only the send", entries)
+	}
+}
+
+func TestJournalEntryStale(t *testing.T) {
+	pid := os.Getpid()
+	boot, start := bootID(), processStart(pid)
+	if boot == "" || start == 0 {
+		t.Skip("no boot ID or process start time on this system")
+	}
+	tests := []struct {
+		name  string
+		entry JournalEntry
+		want  bool
+	}{
+		{"running", JournalEntry{PID: pid, BootID: boot, Start: start}, false},
+		{"without boot and start", JournalEntry{PID: pid}, false},
+		{"earlier boot", JournalEntry{PID: pid, BootID: "00000000-0000-0000-0000-000000000000", Start: start}, true},
+		{"reused pid", JournalEntry{PID: pid, BootID: boot, Start: start + 1}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.entry.Stale(); got != tt.want {
+			t.Errorf("%s: Stale() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestClearJournalConcurrentAppend checks that entries appended while the
+// journal is cleared survive the clear.
+func TestClearJournalConcurrentAppend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j := &journal{path: path, boot: bootID(), start: processStart(os.Getpid())}
+
+	const writers, n = 4, 100
+	var wg sync.WaitGroup
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range n {
+				if _, err := j.begin([][]string{{"zfs", "snapshot", "tank/data@a"}}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	cleared := make(chan struct{})
+	go func() {
+		defer close(cleared)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := ClearJournal(path); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-cleared
+
+	entries, err := ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != writers*n {
+		t.Errorf("%d entries in flight after clearing, want %d", len(entries), writers*n)
+	}
+}
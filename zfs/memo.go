@@ -0,0 +1,70 @@
+package zfs
+
+import (
+	"strings"
+	"sync"
+)
+
+// queryMemo caches the results of read-only queries within a run, keyed
+// by the full command line including the source or target command, so
+// repeated lookups don't cost another ssh round-trip. Writes invalidate
+// every cached query mentioning the written dataset, its ancestors or its
+// descendants.
+type queryMemo struct {
+	mu      sync.Mutex
+	results map[string]memoResult
+}
+
+type memoResult struct {
+	args   []string
+	stdout []string
+	stderr string
+	err    error
+}
+
+func newQueryMemo() *queryMemo {
+	return &queryMemo{results: make(map[string]memoResult)}
+}
+
+func (m *queryMemo) get(args []string) (memoResult, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.results[quoteCommand(args)]
+	return r, ok
+}
+
+func (m *queryMemo) put(r memoResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[quoteCommand(r.args)] = r
+}
+
+// invalidate drops the cached queries affected by a write command.
+func (m *queryMemo) invalidate(write []string) {
+	if len(write) == 0 {
+		return
+	}
+	written, _ := splitSnapshot(write[len(write)-1])
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, r := range m.results {
+		if mentionsRelated(r.args, written) {
+			delete(m.results, key)
+		}
+	}
+}
+
+// mentionsRelated reports whether any argument in args names vol, one of
+// its ancestors or one of its descendants, or a snapshot of those.
+func mentionsRelated(args []string, vol string) bool {
+	for _, a := range args {
+		if strings.HasPrefix(a, "-") {
+			continue
+		}
+		v, _ := splitSnapshot(a)
+		if v == vol || strings.HasPrefix(vol, v+"/") || strings.HasPrefix(v, vol+"/") {
+			return true
+		}
+	}
+	return false
+}
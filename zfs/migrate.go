@@ -0,0 +1,78 @@
+package zfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Migrate replicates every backup chain under from, read with the source
+// command, to the target, for moving backups to new hardware. Each child
+// of from is sent with send -R, so all its snapshots and descendants are
+// kept. Children already present on the target are updated incrementally
+// from their latest common snapshot, so an interrupted migration can be
+// run again.
+func (b *Backup) Migrate(from string) error {
+	from = strings.TrimSuffix(from, "/")
+	lines, stderr, err := b.query(b.buildCommand(false, "list", "-H", "-o", "name", "-d", "1", "-t", "filesystem,volume", from)...)
+	if err != nil {
+		return b.wrapCmdError("listing datasets to migrate", stderr, err)
+	}
+	for _, child := range parseNames(lines) {
+		if child == from {
+			continue
+		}
+		if err := b.migrateDataset(child, fmt.Sprintf("%s/%s", b.target, strings.TrimPrefix(child, from+"/"))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDataset replicates vol with all its snapshots and descendants to
+// targetVol.
+func (b *Backup) migrateDataset(vol, targetVol string) error {
+	snaps, err := b.listSnapshots(vol)
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		b.logger.Warn("no snapshots to migrate", "vol", vol)
+		return nil
+	}
+	latest := snaps[len(snaps)-1]
+
+	exists, err := b.datasetExistsOn(true, targetVol)
+	if err != nil {
+		return err
+	}
+	var base string
+	if exists {
+		base, err = b.getLatestMatchingSnapshot(vol, targetVol)
+		if errors.Is(err, errNoMatchingSnapshot) {
+			return fmt.Errorf("%s already exists but has no snapshot in common with %s", targetVol, vol)
+		} else if err != nil {
+			return err
+		}
+		if base == latest {
+			b.logger.Info("already migrated", "vol", vol, "target", targetVol)
+			return nil
+		}
+	}
+
+	sendArgs := []string{"send", "-R"}
+	if base != "" {
+		sendArgs = append(sendArgs, "-I", base)
+	}
+	cmds := [][]string{b.throttle(b.buildCommand(false, append(sendArgs, latest)...))}
+	if b.pvPath != "" {
+		cmds = append(cmds, []string{b.pvPath})
+	}
+	cmds = append(cmds, b.throttle(b.buildCommand(true, "receive", "-u", "-F", targetVol)))
+
+	b.logger.Info("migrating", "vol", vol, "target", targetVol, "base", base, "snapshot", latest, "snapshots", len(snaps))
+	if _, stderr, err := b.pipeline(cmds, b.sendMeter(0), nil); err != nil {
+		return b.wrapCmdError(fmt.Sprintf("migrating %s", vol), stderr, err)
+	}
+	return nil
+}
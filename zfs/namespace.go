@@ -0,0 +1,47 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WithHostNamespaceOption receives every dataset under <target>/<host>
+// instead of directly under the target, so several hosts can back up to
+// the same pool without colliding. The host dataset is created with
+// canmount=off if it doesn't exist.
+func WithHostNamespaceOption(host string) BackupOption {
+	return func(b *Backup) error {
+		if host == "" || strings.ContainsAny(host, "/@# ") {
+			return fmt.Errorf("invalid host namespace %q", host)
+		}
+		b.hostNamespace = host
+		return nil
+	}
+}
+
+// ensureHostNamespace creates the host-level parent dataset on the target
+// with canmount=off, and below it the datasets the target of each source
+// in plans is received into, since zfs receive doesn't create parents.
+// b.target already includes the host when this is called.
+func (b *Backup) ensureHostNamespace(plans []*sourcePlan) error {
+	if b.hostNamespace == "" {
+		return nil
+	}
+	exists, err := b.datasetExistsOn(true, b.target)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		cmdArgs := b.buildCommand(true, "create", "-p", "-o", "canmount=off", b.target)
+		b.logger.Info("creating host namespace", "dataset", b.target)
+		if _, stderr, err := b.run(cmdArgs...); err != nil {
+			return b.wrapCmdError(fmt.Sprintf("creating host namespace %s", b.target), stderr, err)
+		}
+	}
+	for _, plan := range plans {
+		if err := b.ensureParent(fmt.Sprintf("%s/%s", b.target, plan.src.vol)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
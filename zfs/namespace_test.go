@@ -0,0 +1,45 @@
+package zfs
+
+import "testing"
+
+func TestWithHostNamespaceOption(t *testing.T) {
+	b, err := NewBackup("backup/", WithHostNamespaceOption("hostA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.target != "backup/hostA" {
+		t.Errorf("target = %q, want %q", b.target, "backup/hostA")
+	}
+	for _, host := range []string{"", "a/b", "a@b", "a#b", "a b"} {
+		if _, err := NewBackup("backup", WithHostNamespaceOption(host)); err == nil {
+			t.Errorf("WithHostNamespaceOption(%q) succeeded, want an error", host)
+		}
+	}
+}
+
+// TestEnsureHostNamespace checks that a missing host dataset is created,
+// along with its parents, with canmount=off.
+func TestEnsureHostNamespace(t *testing.T) {
+	b := newReplayBackup(t, "backup", []recordEntry{
+		{
+			Cmds:   [][]string{{"zfs", "list", "-H", "-t", "filesystem,volume", "backup/hostA"}},
+			Stderr: "cannot open 'backup/hostA': dataset does not exist",
+			Error:  "exit status 1",
+		},
+		{Cmds: [][]string{{"zfs", "create", "-p", "-o", "canmount=off", "backup/hostA"}}},
+	}, WithHostNamespaceOption("hostA"))
+	if err := b.ensureHostNamespace(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.replay) > 0 {
+		t.Errorf("%d fixture entries not replayed, next is %q", len(b.replay), quotePipeline(b.replay[0].Cmds))
+	}
+}
+
+// TestReplayHostNamespaceFirstRun checks that the first run into a host
+// namespace creates every dataset the receive needs above it.
+func TestReplayHostNamespaceFirstRun(t *testing.T) {
+	if err := replayBackup(t, "host-namespace-first-run", "backup", WithHostNamespaceOption("hostA")); err != nil {
+		t.Fatalf("RunBackup: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package zfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseBytes parses a raw byte count as printed by zfs -p or send -P.
+// It never depends on the locale: only plain decimal digits are accepted.
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "-" {
+		return 0, fmt.Errorf("no byte count")
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte count %q", s)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative byte count %q", s)
+	}
+	return n, nil
+}
+
+// parseSendSize extracts the estimated stream size from `zfs send -n -P`
+// output. Newer ZFS versions print a "size\t<bytes>" summary line; older
+// ones only print a "full" or "incremental" line with the size in the
+// last column.
+func parseSendSize(lines []string) (int64, error) {
+	var fallback string
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		cols := strings.Split(l, "\t")
+		switch cols[0] {
+		case "size":
+			if len(cols) != 2 {
+				return 0, fmt.Errorf("malformed size line %q", l)
+			}
+			return parseBytes(cols[1])
+		case "full", "incremental":
+			if len(cols) >= 3 {
+				fallback = cols[len(cols)-1]
+			}
+		}
+	}
+	if fallback == "" {
+		return 0, fmt.Errorf("no size in send estimate output")
+	}
+	return parseBytes(fallback)
+}
+
+// parseNames returns the non-empty lines of `zfs list -H -o name` output.
+func parseNames(lines []string) []string {
+	var names []string
+	for _, l := range lines {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			names = append(names, l)
+		}
+	}
+	return names
+}
@@ -0,0 +1,131 @@
+package zfs
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"12345", 12345, false},
+		{" 4096\n", 4096, false},
+		{"9223372036854775807", 1<<63 - 1, false},
+		{"9223372036854775808", 0, true},
+		{"", 0, true},
+		{"-", 0, true},
+		{"-1", 0, true},
+		{"1,024", 0, true},
+		{"1.5", 0, true},
+		{"12K", 0, true},
+		{"0x10", 0, true},
+		{"١٢٣", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseBytes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBytes(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBytes(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseSendSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    int64
+		wantErr bool
+	}{
+		{"new full", "full\ttank/data@b\t123456\nsize\t123456\n", 123456, false},
+		{"new incremental", "incremental\ta\ttank/data@b\t2048\nsize\t2048\n", 2048, false},
+		{"new recursive", "full\ttank/data@b\t100\nfull\ttank/data/db@b\t200\nsize\t300\n", 300, false},
+		{"size line wins", "size\t300\nfull\ttank/data@b\t100\n", 300, false},
+		{"old full", "full\ttank/data@b\t123456\n", 123456, false},
+		{"old incremental", "incremental\ta\ttank/data@b\t2048\n", 2048, false},
+		{"old recursive takes the last", "full\ttank/data@b\t100\nfull\ttank/data/db@b\t200\n", 200, false},
+		{"blank lines", "\n\nsize\t42\n\n", 42, false},
+		{"empty", "", 0, true},
+		{"truncated size line", "full\ttank/data@b\t100\nsize", 0, true},
+		{"truncated size value", "size\t", 0, true},
+		{"truncated full line", "full\ttank/data@b", 0, true},
+		{"extra size column", "size\t1\t2", 0, true},
+		{"negative size", "size\t-5", 0, true},
+		{"human size", "size\t1.2G", 0, true},
+		{"garbage", "cannot open 'tank/data@b': dataset does not exist", 0, true},
+		{"garbage last column", "full\ttank/data@b\tlots", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSendSize(strings.Split(tt.out, "\n"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSendSize error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSendSize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNames(t *testing.T) {
+	tests := []struct {
+		out  string
+		want []string
+	}{
+		{"", nil},
+		{"\n\n", nil},
+		{"tank/data\n", []string{"tank/data"}},
+		{"tank/data\ntank/data/db\n", []string{"tank/data", "tank/data/db"}},
+		{" tank/data \n\n\ttank/my data\n", []string{"tank/data", "tank/my data"}},
+	}
+	for _, tt := range tests {
+		if got := parseNames(strings.Split(tt.out, "\n")); !slices.Equal(got, tt.want) {
+			t.Errorf("parseNames(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+func FuzzParseBytes(f *testing.F) {
+	for _, s := range []string{"0", "12345", "-1", "", "-", "1.5", "9223372036854775808"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		n, err := parseBytes(s)
+		if err != nil {
+			return
+		}
+		if n < 0 {
+			t.Errorf("parseBytes(%q) = %d, want a non-negative count", s, n)
+		}
+	})
+}
+
+func FuzzParseSendSize(f *testing.F) {
+	for _, s := range []string{
+		"full\ttank/data@b\t123456\nsize\t123456\n",
+		"incremental\ta\ttank/data@b\t2048\n",
+		"size\t",
+		"full\ttank/data@b",
+		"garbage",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, out string) {
+		n, err := parseSendSize(strings.Split(out, "\n"))
+		if err != nil {
+			return
+		}
+		if n < 0 {
+			t.Errorf("parseSendSize(%q) = %d, want a non-negative size", out, n)
+		}
+	})
+}
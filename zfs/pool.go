@@ -0,0 +1,89 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ImportPool imports pool on the target for removable-media backups,
+// reporting whether it was imported here. A pool that is already
+// imported is left alone.
+func (b *Backup) ImportPool(pool string) (bool, error) {
+	args, err := b.targetTool("zpool", "list", "-H", "-o", "name", pool)
+	if err != nil {
+		return false, err
+	}
+	if _, _, err := b.query(args...); err == nil {
+		b.logger.Info("pool already imported", "pool", pool)
+		return false, nil
+	}
+	args, err = b.targetTool("zpool", "import", pool)
+	if err != nil {
+		return false, err
+	}
+	b.logger.Info("importing pool", "pool", pool)
+	if _, stderr, err := b.run(args...); err != nil {
+		return false, b.wrapCmdError(fmt.Sprintf("importing pool %s", pool), stderr, err)
+	}
+	return true, nil
+}
+
+// ExportPool exports pool on the target so its disks can be removed.
+func (b *Backup) ExportPool(pool string) error {
+	args, err := b.targetTool("zpool", "export", pool)
+	if err != nil {
+		return err
+	}
+	b.logger.Info("exporting pool", "pool", pool)
+	if _, stderr, err := b.run(args...); err != nil {
+		return b.wrapCmdError(fmt.Sprintf("exporting pool %s", pool), stderr, err)
+	}
+	return nil
+}
+
+// bootstrapPoolProps are the pool and root dataset properties used by
+// BootstrapTarget.
+var bootstrapPoolProps = []string{
+	"-o", "ashift=12",
+	"-o", "autotrim=on",
+	"-O", "compression=lz4",
+	"-O", "atime=off",
+	"-O", "xattr=sa",
+	"-O", "canmount=off",
+}
+
+// BootstrapTarget creates a new backup pool on the target from vdevs,
+// which are passed to zpool create as is (e.g. "mirror", "/dev/sdb",
+// "/dev/sdc"), and creates the target filesystem and its parents in it
+// with canmount=off. zpool refuses disks that are in use or carry a pool
+// label, and this doesn't force it.
+func (b *Backup) BootstrapTarget(pool string, vdevs []string) error {
+	if len(vdevs) == 0 {
+		return fmt.Errorf("no devices given for pool %s", pool)
+	}
+	if b.target != pool && !strings.HasPrefix(b.target, pool+"/") {
+		return fmt.Errorf("target filesystem %s is not in pool %s", b.target, pool)
+	}
+	args, err := b.targetTool("zpool", append(append(append([]string{"create"}, bootstrapPoolProps...), pool), vdevs...)...)
+	if err != nil {
+		return err
+	}
+	b.logger.Info("creating pool", "pool", pool, "vdevs", vdevs)
+	if _, stderr, err := b.run(args...); err != nil {
+		return b.wrapCmdError(fmt.Sprintf("creating pool %s", pool), stderr, err)
+	}
+
+	parent := pool
+	for _, part := range strings.Split(strings.TrimPrefix(b.target, pool), "/") {
+		if part == "" {
+			continue
+		}
+		parent += "/" + part
+		b.logger.Info("creating dataset", "dataset", parent)
+		_, stderr, err := b.run(b.buildCommand(true, "create", "-o", "canmount=off", parent)...)
+		if err != nil {
+			return b.wrapCmdError(fmt.Sprintf("creating dataset %s", parent), stderr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RootMode controls the check for running zfs as root on the target.
+type RootMode string
+
+const (
+	RootAllow  RootMode = ""
+	RootWarn   RootMode = "warn"
+	RootRefuse RootMode = "refuse"
+)
+
+// ParseRootMode parses a root check mode: "warn", "refuse" or "" for no
+// check.
+func ParseRootMode(s string) (RootMode, error) {
+	switch m := RootMode(s); m {
+	case RootAllow, RootWarn, RootRefuse:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid root check mode %q: must be warn or refuse", s)
+}
+
+// WithRootCheckOption checks whether the target command runs as root
+// before replicating, since delegated permissions granted with zfs allow
+// are enough unless an option that needs root is set. In RootWarn mode
+// running as root anyway is logged; in RootRefuse mode it aborts the run.
+// The check runs id -u next to the target zfs command.
+func WithRootCheckOption(mode RootMode) BackupOption {
+	return func(b *Backup) error {
+		b.rootCheck = mode
+		return nil
+	}
+}
+
+// rootRequiredBy lists the options set on b that need root on the target.
+func (b *Backup) rootRequiredBy() []string {
+	var opts []string
+	if b.unmount {
+		opts = append(opts, "unmount target")
+	}
+	if b.smartCheck != SmartOff {
+		opts = append(opts, "SMART check")
+	}
+	return opts
+}
+
+// targetIsRoot reports whether the target command runs as root.
+func (b *Backup) targetIsRoot() (bool, error) {
+	args, err := b.targetTool("id", "-u")
+	if err != nil {
+		return false, err
+	}
+	lines, stderr, err := b.query(args...)
+	if err != nil {
+		return false, b.wrapCmdError("getting target user", stderr, err)
+	}
+	return len(lines) > 0 && strings.TrimSpace(lines[0]) == "0", nil
+}
+
+// checkRoot runs the root check of the target command.
+func (b *Backup) checkRoot() error {
+	if b.rootCheck == RootAllow || !b.isZFSTarget() {
+		return nil
+	}
+	root, err := b.targetIsRoot()
+	if err != nil || !root {
+		return err
+	}
+	if required := b.rootRequiredBy(); len(required) > 0 {
+		b.logDebug("running as root on the target", "needed_for", strings.Join(required, ", "))
+		return nil
+	}
+	if b.rootCheck == RootRefuse {
+		return fmt.Errorf("refusing to run as root on the target with %q: delegate the needed permissions with zfs allow and run as an unprivileged user", quoteCommand(b.targetCmd))
+	}
+	b.logger.Warn("running as root on the target although delegated permissions would do, consider zfs allow and an unprivileged user", "command", quoteCommand(b.targetCmd))
+	return nil
+}
@@ -0,0 +1,90 @@
+package zfs
+
+import (
+	"io"
+	"os/exec"
+	"slices"
+)
+
+// process is a command zfsbackup runs: a local process, or a command on a
+// remote host run over an in-process ssh session.
+type process interface {
+	setStdin(r io.Reader)
+	setStdout(w io.Writer)
+	setStderr(w io.Writer)
+	stdoutPipe() (io.ReadCloser, error)
+	stdinPipe() (io.WriteCloser, error)
+	start() error
+	wait() error
+	kill()
+}
+
+// localProcess is a process run with os/exec.
+type localProcess struct {
+	*exec.Cmd
+}
+
+func (p localProcess) setStdin(r io.Reader)  { p.Stdin = r }
+func (p localProcess) setStdout(w io.Writer) { p.Stdout = w }
+func (p localProcess) setStderr(w io.Writer) { p.Stderr = w }
+
+func (p localProcess) stdoutPipe() (io.ReadCloser, error) { return p.StdoutPipe() }
+func (p localProcess) stdinPipe() (io.WriteCloser, error) { return p.StdinPipe() }
+
+func (p localProcess) start() error { return p.Start() }
+func (p localProcess) wait() error  { return p.Wait() }
+func (p localProcess) kill()        { p.Process.Kill() }
+
+// isRemote reports whether p runs over an in-process ssh session, so its
+// input and output are copied by goroutines of this process instead of
+// being handed to a child process.
+func isRemote(p process) bool {
+	_, ok := p.(*sshProcess)
+	return ok
+}
+
+// remoteCommand returns the endpoint of the source or target host args
+// runs on and the command run there, or nil if args runs locally.
+func (b *Backup) remoteCommand(args []string) (*sshEndpoint, []string) {
+	for _, e := range []*sshEndpoint{b.sshSource, b.sshTarget} {
+		if e == nil {
+			continue
+		}
+		login := e.host.login()
+		if len(args) > len(login) && slices.Equal(args[:len(login)], login) {
+			return e, args[len(login):]
+		}
+	}
+	return nil, nil
+}
+
+// shellCommand returns args as it is run: commands on a source or target
+// host have their remote command quoted for ssh.
+func (b *Backup) shellCommand(args []string) []string {
+	if e, remote := b.remoteCommand(args); e != nil {
+		return e.host.command(remote)
+	}
+	return args
+}
+
+// newProcess returns the process running args. Commands on a source or
+// target host have their remote command quoted for ssh, and are run over
+// an in-process ssh session if WithNativeSSHOption is set. Everything
+// else is run with os/exec.
+func (b *Backup) newProcess(args []string) process {
+	if e, remote := b.remoteCommand(args); e != nil && b.sshClients != nil {
+		return b.sshClients.process(e.host, remote)
+	}
+	return localProcess{newCommand(b.shellCommand(args))}
+}
+
+// runProcess runs p and returns its output lines and, if it failed, its
+// stderr.
+func runProcess(p process) ([]string, string, error) {
+	var stdoutLines []string
+	stderr, err := execStream(p, func(line string) error {
+		stdoutLines = append(stdoutLines, line)
+		return nil
+	})
+	return stdoutLines, stderr, err
+}
@@ -0,0 +1,80 @@
+package zfs
+
+import (
+	"sync"
+	"time"
+)
+
+// profilePhases are the phases timed by WithProfileOption, in run order.
+var profilePhases = []string{"list", "snapshot", "index", "match", "estimate", "send", "prune"}
+
+// runProfile accumulates the time spent in each phase per source or
+// dataset.
+type runProfile struct {
+	mu      sync.Mutex
+	names   []string
+	timings map[string]map[string]time.Duration
+}
+
+// WithProfileOption times each phase of the run, per source for listing,
+// snapshotting and indexing and per dataset for matching, estimating,
+// sending and pruning, and logs the timings when the run ends. This shows
+// whether a slow run is spending its time on query round-trips or on
+// transferring data.
+func WithProfileOption() BackupOption {
+	return func(b *Backup) error {
+		b.profiling = true
+		return nil
+	}
+}
+
+// startPhase starts timing phase for name. The returned function stops
+// the timer.
+func (b *Backup) startPhase(name, phase string) func() {
+	p := b.profile
+	if p == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		t, ok := p.timings[name]
+		if !ok {
+			t = make(map[string]time.Duration)
+			p.timings[name] = t
+			p.names = append(p.names, name)
+		}
+		t[phase] += d
+	}
+}
+
+// logProfile logs the phase timings of each source and dataset and the
+// totals per phase.
+func (b *Backup) logProfile() {
+	p := b.profile
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	totals := make(map[string]time.Duration)
+	for _, name := range p.names {
+		attrs := []any{"name", name}
+		for _, phase := range profilePhases {
+			if d, ok := p.timings[name][phase]; ok {
+				attrs = append(attrs, phase, d.Round(time.Millisecond))
+				totals[phase] += d
+			}
+		}
+		b.logger.Info("profile", attrs...)
+	}
+	var attrs []any
+	for _, phase := range profilePhases {
+		if d, ok := totals[phase]; ok {
+			attrs = append(attrs, phase, d.Round(time.Millisecond))
+		}
+	}
+	b.logger.Info("profile total", attrs...)
+}
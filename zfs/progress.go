@@ -0,0 +1,98 @@
+package zfs
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamesmcdonald/zfsbackup/util"
+)
+
+// ProgressMode selects how transfer progress is displayed.
+type ProgressMode string
+
+const (
+	// ProgressAuto uses pv when it is installed and the internal meter otherwise.
+	ProgressAuto ProgressMode = "auto"
+	// ProgressPV always inserts pv into the pipeline.
+	ProgressPV ProgressMode = "pv"
+	// ProgressInternal copies the stream through a built-in meter.
+	ProgressInternal ProgressMode = "internal"
+	// ProgressNone disables progress display.
+	ProgressNone ProgressMode = "none"
+)
+
+// ParseProgressMode parses a --progress flag value.
+func ParseProgressMode(s string) (ProgressMode, error) {
+	switch m := ProgressMode(s); m {
+	case ProgressAuto, ProgressPV, ProgressInternal, ProgressNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid progress mode %q (want auto, pv, internal or none)", s)
+}
+
+// progressMeter counts bytes copied through it and periodically writes a
+// status line to out.
+type progressMeter struct {
+	out   io.Writer
+	total int64
+	n     atomic.Int64
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newProgressMeter(out io.Writer, total int64) *progressMeter {
+	return &progressMeter{out: out, total: total, done: make(chan struct{})}
+}
+
+// copy copies src to dst, counting bytes and reporting progress until src is exhausted.
+func (m *progressMeter) copy(dst io.Writer, src io.Reader) error {
+	m.start = time.Now()
+	m.wg.Add(1)
+	go m.report()
+	_, err := io.Copy(dst, &meterReader{r: src, m: m})
+	close(m.done)
+	m.wg.Wait()
+	return err
+}
+
+func (m *progressMeter) report() {
+	defer m.wg.Done()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.print("\r")
+		case <-m.done:
+			m.print("\r")
+			fmt.Fprintln(m.out)
+			return
+		}
+	}
+}
+
+func (m *progressMeter) print(prefix string) {
+	n := m.n.Load()
+	rate := int64(float64(n) / max(time.Since(m.start).Seconds(), 1e-3))
+	if m.total > 0 {
+		pct := min(100*float64(n)/float64(m.total), 100)
+		fmt.Fprintf(m.out, "%s%s / %s (%.0f%%) %s/s   ", prefix, util.HumanBytes(n), util.HumanBytes(m.total), pct, util.HumanBytes(rate))
+		return
+	}
+	fmt.Fprintf(m.out, "%s%s %s/s   ", prefix, util.HumanBytes(n), util.HumanBytes(rate))
+}
+
+type meterReader struct {
+	r io.Reader
+	m *progressMeter
+}
+
+func (r *meterReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.m.n.Add(int64(n))
+	return n, err
+}
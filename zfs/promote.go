@@ -0,0 +1,53 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// roleProperty marks a target dataset that was promoted to serve as the
+// primary copy. It is inherited, so it protects descendants too.
+const roleProperty = propertyPrefix + "role"
+
+// rolePrimary is the roleProperty value of a promoted dataset.
+const rolePrimary = "primary"
+
+// Promote prepares the target dataset vol to serve as the primary copy
+// after a failover: it clears readonly on vol and its descendants, applies
+// props (e.g. "mountpoint=/srv/data" or "sharenfs=on") and marks vol as
+// primary, so later backups refuse to overwrite it with receive -F.
+func (b *Backup) Promote(vol string, props []string) error {
+	exists, err := b.datasetExistsOn(true, vol)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("target dataset %s does not exist", vol)
+	}
+	for _, p := range props {
+		if k, _, ok := strings.Cut(p, "="); !ok || k == "" {
+			return fmt.Errorf("invalid property %q: must be name=value", p)
+		}
+	}
+
+	b.logger.Info("clearing readonly", "vol", vol)
+	if _, stderr, err := b.run(b.buildCommand(true, "inherit", "-r", "readonly", vol)...); err != nil {
+		return b.wrapCmdError("clearing readonly", stderr, err)
+	}
+	set := append([]string{"set", "readonly=off", roleProperty + "=" + rolePrimary}, props...)
+	b.logger.Info("promoting to primary", "vol", vol, "props", props)
+	if _, stderr, err := b.run(b.buildCommand(true, append(set, vol)...)...); err != nil {
+		return b.wrapCmdError("setting properties", stderr, err)
+	}
+	return nil
+}
+
+// isPrimary reports whether the target dataset vol, or one of its
+// ancestors, was promoted with Promote.
+func (b *Backup) isPrimary(vol string) (bool, error) {
+	lines, stderr, err := b.query(b.buildCommand(true, "get", "-H", "-o", "value", roleProperty, vol)...)
+	if err != nil {
+		return false, b.wrapCmdError("getting role", stderr, err)
+	}
+	return len(lines) > 0 && strings.TrimSpace(lines[0]) == rolePrimary, nil
+}
@@ -0,0 +1,139 @@
+package zfs
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// propertyPrefix namespaces the user properties zfsbackup sets.
+const propertyPrefix = "zfsbackup:"
+
+// ownerProperty marks the snapshots zfsbackup creates. Cleanup only ever
+// destroys snapshots whose owner matches.
+const ownerProperty = propertyPrefix + "owner"
+
+// DefaultOwner is the ownership marker used unless WithOwnerOption is given.
+const DefaultOwner = "zfsbackup"
+
+// labelProperty returns the user property name for a run label.
+func labelProperty(key string) string {
+	return propertyPrefix + "label." + key
+}
+
+// validLabelKey reports whether key can be used in a user property name.
+func validLabelKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ParseLabel parses a key=value label.
+func ParseLabel(s string) (key, value string, err error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid label %q: want key=value", s)
+	}
+	if !validLabelKey(key) {
+		return "", "", fmt.Errorf("invalid label key %q: use lower-case letters, digits, '-', '_' and '.'", key)
+	}
+	return key, value, nil
+}
+
+// WithLabelsOption attaches labels to the run. They are added to every log
+// message and stored as zfsbackup:label.<key> user properties on the
+// snapshots created on the source and received on the target.
+func WithLabelsOption(labels map[string]string) BackupOption {
+	return func(b *Backup) error {
+		for k := range labels {
+			if !validLabelKey(k) {
+				return fmt.Errorf("invalid label key %q", k)
+			}
+		}
+		b.labels = labels
+		return nil
+	}
+}
+
+// WithOwnerOption sets the value of the zfsbackup:owner property stored
+// on every snapshot zfsbackup creates or receives, e.g. a job name.
+// Cleanup only destroys snapshots with a matching owner, so snapshots
+// from other tools, or from other jobs with their own owner, are never
+// touched.
+func WithOwnerOption(owner string) BackupOption {
+	return func(b *Backup) error {
+		if owner == "" {
+			return fmt.Errorf("owner cannot be empty")
+		}
+		b.owner = owner
+		return nil
+	}
+}
+
+// snapshotProps returns the property assignments for new snapshots: the
+// owner marker followed by the run labels, in a stable order.
+func (b *Backup) snapshotProps() []string {
+	args := []string{ownerProperty + "=" + b.owner}
+	for _, k := range slices.Sorted(maps.Keys(b.labels)) {
+		args = append(args, labelProperty(k)+"="+b.labels[k])
+	}
+	return args
+}
+
+// setSnapshotProps sets the owner marker and run labels on a received
+// target snapshot, since plain sends don't carry user properties.
+func (b *Backup) setSnapshotProps(snap string) error {
+	args := append([]string{"set"}, b.snapshotProps()...)
+	args = append(args, snap)
+	_, stderr, err := b.run(b.buildCommand(true, args...)...)
+	if err != nil {
+		return b.wrapCmdError("setting snapshot properties", stderr, err)
+	}
+	return nil
+}
+
+// listOwnedSnapshots lists the snapshots of vol in creation order, along
+// with the set of those carrying this Backup's owner marker.
+func (b *Backup) listOwnedSnapshots(vol string) ([]string, map[string]bool, error) {
+	if indexed, ok := b.indexedSnapshots(vol); ok {
+		var snaps []string
+		owned := make(map[string]bool)
+		for _, s := range indexed {
+			snaps = append(snaps, s.name)
+			if s.owner == b.owner {
+				owned[s.name] = true
+			}
+		}
+		return snaps, owned, nil
+	}
+	args := b.buildCommand(b.isTargetVolume(vol), "list", "-H", "-o", "name,"+ownerProperty, "-t", "snapshot", "-d", "1", "-s", "creation", vol)
+	var snaps []string
+	owned := make(map[string]bool)
+	stderr, err := b.queryEach(func(l string) error {
+		name, owner, ok := strings.Cut(l, "\t")
+		if !ok {
+			return fmt.Errorf("malformed snapshot line %q", l)
+		}
+		snaps = append(snaps, name)
+		if strings.TrimSpace(owner) == b.owner {
+			owned[name] = true
+		}
+		return nil
+	}, args...)
+	if err != nil {
+		if stderr == "" {
+			return nil, nil, err
+		}
+		return nil, nil, b.wrapCmdError("listing snapshots", stderr, err)
+	}
+	return snaps, owned, nil
+}
@@ -0,0 +1,66 @@
+package zfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+)
+
+// readOnlyVerbs are the subcommands of each tool zfsbackup runs that
+// never change anything.
+var readOnlyVerbs = map[string][]string{
+	"zfs":      {"list", "get", "version", "diff", "holds", "send"},
+	"zpool":    {"list", "get", "status"},
+	"smartctl": {"-H"},
+	"id":       {"-u"},
+}
+
+// WithReadOnlyOption is a dry run that also refuses, rather than skips,
+// every command not known to be free of side effects, including on the
+// paths a dry run still executes. Hooks and session logs are skipped as
+// in a dry run.
+func WithReadOnlyOption() BackupOption {
+	return func(b *Backup) error {
+		b.readOnly = true
+		b.dryrun = true
+		return nil
+	}
+}
+
+// findTool returns the index in args of the first tool known from
+// readOnlyVerbs, so wrappers such as ssh or sudo in front of it are
+// skipped, or -1 if there is none.
+func findTool(args []string) int {
+	for i, arg := range args[:len(args)-1] {
+		if _, ok := readOnlyVerbs[filepath.Base(arg)]; ok {
+			return i
+		}
+	}
+	return -1
+}
+
+// isReadOnlyCommand reports whether args runs one of readOnlyVerbs. zfs
+// send only counts with -n, which sends nothing.
+func isReadOnlyCommand(args []string) bool {
+	i := findTool(args)
+	if i < 0 {
+		return false
+	}
+	tool, verb := filepath.Base(args[i]), args[i+1]
+	if tool == "zfs" && verb == "send" {
+		return slices.Contains(args[i+2:], "-n")
+	}
+	return slices.Contains(readOnlyVerbs[tool], verb)
+}
+
+// checkReadOnly returns an error if read-only mode is set and cmds could
+// change anything. Pipelines always can.
+func (b *Backup) checkReadOnly(cmds [][]string) error {
+	if !b.readOnly {
+		return nil
+	}
+	if len(cmds) != 1 || !isReadOnlyCommand(cmds[0]) {
+		return fmt.Errorf("read-only mode: refusing to run %s", quotePipeline(cmds))
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jamesmcdonald/zfsbackup/util"
+)
+
+// WithRelayOption replicates snapshots received from an upstream job
+// instead of taking new ones, for chained topologies where a backup
+// target is replicated onward (A to B to C). Each source is sent up to
+// its latest snapshot carrying upstream's owner marker, which the
+// upstream job sets once a receive completes. The owner should differ
+// from this job's own so the two jobs' cleanups stay apart.
+func WithRelayOption(upstream string) BackupOption {
+	return func(b *Backup) error {
+		if upstream == "" {
+			return fmt.Errorf("relay owner cannot be empty")
+		}
+		b.relayOwner = upstream
+		return nil
+	}
+}
+
+// relaySnapshots picks the snapshot to replicate for each plan: the
+// latest one of the source owned by the upstream job, which must exist
+// on every dataset of the source.
+func (b *Backup) relaySnapshots(plans []*sourcePlan) error {
+	for _, plan := range plans {
+		snaps, err := b.snapshotsOwnedBy(plan.src.vol, b.relayOwner)
+		if err != nil {
+			return err
+		}
+		if len(snaps) == 0 {
+			return fmt.Errorf("no snapshot of %s owned by %s to relay", plan.src.vol, b.relayOwner)
+		}
+		_, snapName := splitSnapshot(snaps[len(snaps)-1])
+		for _, fs := range plan.filesystems {
+			if fs == plan.src.vol {
+				continue
+			}
+			owned, err := b.snapshotsOwnedBy(fs, b.relayOwner)
+			if err != nil {
+				return err
+			}
+			if len(owned) == 0 || owned[len(owned)-1] != fs+"@"+snapName {
+				return fmt.Errorf("upstream replication of %s@%s is incomplete: %s doesn't have it as its latest snapshot", plan.src.vol, snapName, fs)
+			}
+		}
+		plan.snapName = snapName
+
+		args := []any{"source", plan.src.String(), "snapshot", snapName, "upstream", b.relayOwner}
+		if created, err := time.ParseInLocation(snapshotTimeLayout, strings.TrimPrefix(snapName, b.snapshotPrefix), time.Local); err == nil {
+			if now, err := b.now(); err == nil {
+				args = append(args, "lag", util.HumanDuration(now.Sub(created)))
+			}
+		}
+		b.logger.Info("relaying upstream snapshot", args...)
+	}
+	return nil
+}
+
+// snapshotsOwnedBy lists the snapshots of vol carrying the given owner
+// marker, oldest first.
+func (b *Backup) snapshotsOwnedBy(vol, owner string) ([]string, error) {
+	args := b.buildCommand(b.isTargetVolume(vol), "list", "-H", "-o", "name,"+ownerProperty, "-t", "snapshot", "-d", "1", "-s", "creation", vol)
+	var snaps []string
+	stderr, err := b.queryEach(func(l string) error {
+		name, o, ok := strings.Cut(l, "\t")
+		if !ok {
+			return fmt.Errorf("malformed snapshot line %q", l)
+		}
+		if strings.TrimSpace(o) == owner {
+			snaps = append(snaps, name)
+		}
+		return nil
+	}, args...)
+	if err != nil {
+		if stderr == "" {
+			return nil, err
+		}
+		return nil, b.wrapCmdError("listing snapshots", stderr, err)
+	}
+	return snaps, nil
+}
@@ -0,0 +1,211 @@
+package zfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// recordEntry is one line of a record/replay fixture. Each entry holds
+// either a clock reading or a command invocation with its results.
+type recordEntry struct {
+	Now    *time.Time `json:"now,omitempty"`
+	Cmds   [][]string `json:"cmds,omitempty"`
+	Stdout []string   `json:"stdout,omitempty"`
+	Stderr string     `json:"stderr,omitempty"`
+	Error  string     `json:"error,omitempty"`
+	// Exit is the exit code of a failed command, or -1 if it didn't exit
+	// normally.
+	Exit int `json:"exit,omitempty"`
+	// Failed holds the failed stages of a failed pipeline.
+	Failed []recordStage `json:"failed,omitempty"`
+}
+
+// recordStage is a failed pipeline stage in a record/replay fixture.
+type recordStage struct {
+	Index  int      `json:"index"`
+	Name   string   `json:"name"`
+	Cmd    []string `json:"cmd"`
+	Stderr string   `json:"stderr,omitempty"`
+	Exit   int      `json:"exit"`
+	Error  string   `json:"error"`
+}
+
+// replayedError is a recorded command failure. It carries the exit code
+// of the original failure, so exitCode sees the same value it would have
+// on a live run.
+type replayedError struct {
+	msg  string
+	code int
+}
+
+func (e *replayedError) Error() string { return e.msg }
+
+// newReplayedError returns the replayedError for msg and code. Fixtures
+// recorded before exit codes were stored have no code, which is treated
+// like a command that didn't exit normally.
+func newReplayedError(msg string, code int) *replayedError {
+	if code == 0 {
+		code = -1
+	}
+	return &replayedError{msg: msg, code: code}
+}
+
+// WithRecordOption writes every clock reading and command invocation,
+// with its output, to w as JSON lines. The result can be replayed with
+// WithReplayOption.
+func WithRecordOption(w io.Writer) BackupOption {
+	return func(b *Backup) error {
+		b.recorder = json.NewEncoder(w)
+		return nil
+	}
+}
+
+// WithReplayOption replays a fixture written by WithRecordOption instead
+// of executing any commands. Every command must match the recording in
+// order, or it fails with an error.
+func WithReplayOption(r io.Reader) BackupOption {
+	return func(b *Backup) error {
+		dec := json.NewDecoder(r)
+		var entries []recordEntry
+		for {
+			var e recordEntry
+			err := dec.Decode(&e)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("error reading replay fixture: %w", err)
+			}
+			entries = append(entries, e)
+		}
+		b.replay = entries
+		b.replaying = true
+		return nil
+	}
+}
+
+func (b *Backup) record(e recordEntry) {
+	if b.recorder == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.recorder.Encode(e); err != nil {
+		b.logger.Warn("error writing record fixture", "err", err)
+	}
+}
+
+func (b *Backup) nextReplay() (recordEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.replay) == 0 {
+		return recordEntry{}, fmt.Errorf("replay: fixture exhausted")
+	}
+	e := b.replay[0]
+	b.replay = b.replay[1:]
+	return e, nil
+}
+
+// now returns the current time, or the recorded time when replaying.
+func (b *Backup) now() (time.Time, error) {
+	if b.replaying {
+		e, err := b.nextReplay()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if e.Now == nil {
+			return time.Time{}, fmt.Errorf("replay: expected clock reading, got command %q", quotePipeline(e.Cmds))
+		}
+		return *e.Now, nil
+	}
+	t := time.Now()
+	b.record(recordEntry{Now: &t})
+	return t, nil
+}
+
+// exec runs a single command or a pipeline, recording or replaying it as configured.
+// meter and sessionLog are passed on to execPipeline.
+func (b *Backup) exec(cmds [][]string, meter *progressMeter, sessionLog io.Writer) ([]string, string, error) {
+	if b.debug {
+		b.logger.Info("exec", "cmd", quotePipeline(cmds))
+	}
+	if b.replaying {
+		return b.replayExec(cmds)
+	}
+	if err := b.checkReadOnly(cmds); err != nil {
+		return nil, "", err
+	}
+
+	var stdout []string
+	var stderr string
+	var err error
+	if len(cmds) == 1 {
+		stdout, stderr, err = runProcess(b.newProcess(cmds[0]))
+	} else {
+		stdout, stderr, err = b.execPipeline(cmds, meter, sessionLog)
+	}
+
+	e := recordEntry{Cmds: cmds, Stdout: stdout, Stderr: stderr}
+	if err != nil {
+		e.Error = err.Error()
+		e.Exit = exitCode(err)
+		var pipeErr *PipelineError
+		if errors.As(err, &pipeErr) {
+			for _, st := range pipeErr.Failed {
+				e.Failed = append(e.Failed, recordStage{
+					Index:  st.Index,
+					Name:   st.Name,
+					Cmd:    st.Cmd,
+					Stderr: st.Stderr,
+					Exit:   st.ExitCode,
+					Error:  st.Err.Error(),
+				})
+			}
+		}
+	}
+	b.record(e)
+	return stdout, stderr, err
+}
+
+func (b *Backup) replayExec(cmds [][]string) ([]string, string, error) {
+	e, err := b.nextReplay()
+	if err != nil {
+		return nil, "", err
+	}
+	if !slices.EqualFunc(e.Cmds, cmds, slices.Equal) {
+		want := "clock reading"
+		if e.Now == nil {
+			want = quotePipeline(e.Cmds)
+		}
+		return nil, "", fmt.Errorf("replay: unexpected command %q, want %q", quotePipeline(cmds), want)
+	}
+	if e.Error != "" {
+		return e.Stdout, e.Stderr, e.replayError()
+	}
+	return e.Stdout, e.Stderr, nil
+}
+
+// replayError rebuilds the error of a recorded failure: a *PipelineError
+// with the same failed stages for a pipeline, or an error with the same
+// message and exit code for a single command.
+func (e recordEntry) replayError() error {
+	if len(e.Failed) == 0 {
+		return newReplayedError(e.Error, e.Exit)
+	}
+	pipeErr := &PipelineError{}
+	for _, st := range e.Failed {
+		pipeErr.Failed = append(pipeErr.Failed, PipelineStage{
+			Index:    st.Index,
+			Name:     st.Name,
+			Cmd:      st.Cmd,
+			Stderr:   st.Stderr,
+			ExitCode: st.Exit,
+			Err:      newReplayedError(st.Error, st.Exit),
+		})
+	}
+	return pipeErr
+}
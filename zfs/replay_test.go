@@ -0,0 +1,157 @@
+package zfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// replayBackup runs a backup of tank/data to target, replaying the
+// fixture testdata/name.jsonl, and checks that every recorded command
+// was run.
+func replayBackup(t *testing.T, name, target string, opts ...BackupOption) error {
+	t.Helper()
+	return replaySource(t, name, "tank/data", target, opts...)
+}
+
+// replaySource is replayBackup for the source given by source.
+func replaySource(t *testing.T, name, source, target string, opts ...BackupOption) error {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	opts = append([]BackupOption{
+		WithReplayOption(f),
+		WithProgressOption(ProgressNone),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}, opts...)
+	b, err := NewBackup(target, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := ParseSource(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.RunBackup([]Source{src})
+	if len(b.replay) > 0 {
+		t.Errorf("%d fixture entries not replayed, next is %q", len(b.replay), quotePipeline(b.replay[0].Cmds))
+	}
+	return err
+}
+
+// newReplayBackup returns a Backup to target that replays entries instead
+// of running commands.
+func newReplayBackup(t *testing.T, target string, entries []recordEntry, opts ...BackupOption) *Backup {
+	t.Helper()
+	var fixture bytes.Buffer
+	enc := json.NewEncoder(&fixture)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts = append([]BackupOption{
+		WithReplayOption(&fixture),
+		WithProgressOption(ProgressNone),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	}, opts...)
+	b, err := NewBackup(target, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestReplayFullBackup(t *testing.T) {
+	if err := replayBackup(t, "full-backup", "backup"); err != nil {
+		t.Fatalf("RunBackup: %v", err)
+	}
+}
+
+func TestReplayIncrementalBackup(t *testing.T) {
+	if err := replayBackup(t, "incremental-backup", "backup"); err != nil {
+		t.Fatalf("RunBackup: %v", err)
+	}
+}
+
+func TestReplayPipelineFailure(t *testing.T) {
+	err := replayBackup(t, "receive-out-of-space", "backup")
+	if err == nil {
+		t.Fatal("RunBackup succeeded, want the recorded receive failure")
+	}
+	if class := ClassOf(err); class != ClassNoSpace {
+		t.Errorf("ClassOf = %q, want %q", class, ClassNoSpace)
+	}
+	var pipeErr *PipelineError
+	if !errors.As(err, &pipeErr) {
+		t.Fatalf("error %v is not a *PipelineError", err)
+	}
+	if len(pipeErr.Failed) != 1 {
+		t.Fatalf("%d failed stages, want 1", len(pipeErr.Failed))
+	}
+	s := pipeErr.Failed[0]
+	if s.Name != "receive" || s.Index != 1 || s.ExitCode != 1 {
+		t.Errorf("failed stage %s (command %d) with exit code %d, want receive (command 1) with exit code 1", s.Name, s.Index, s.ExitCode)
+	}
+	if code := exitCode(s.Err); code != 1 {
+		t.Errorf("exitCode = %d, want 1", code)
+	}
+}
+
+func TestReplayUnexpectedCommand(t *testing.T) {
+	b := newReplayBackup(t, "backup", []recordEntry{
+		{Cmds: [][]string{{"zfs", "list", "-H", "-t", "filesystem,volume", "tank/other"}}},
+	})
+	if _, _, err := b.query("zfs", "list", "-H", "-t", "filesystem,volume", "tank/data"); err == nil || !strings.Contains(err.Error(), "unexpected command") {
+		t.Errorf("query error %v, want an unexpected command", err)
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestPrintCommands checks the --print-commands output of replayed
+// backups against testdata/name.golden.
+func TestPrintCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		opts   []BackupOption
+	}{
+		{"full-backup", "backup", nil},
+		{"incremental-backup", "backup", nil},
+		{"ssh-target", "backup/my data", []BackupOption{WithSSHTargetOption(SSHHost{Host: "nas"})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			opts := append([]BackupOption{WithPrintCommandsOption(&buf)}, tt.opts...)
+			if err := replayBackup(t, tt.name, tt.target, opts...); err != nil {
+				t.Fatalf("RunBackup: %v", err)
+			}
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != string(want) {
+				t.Errorf("printed commands differ from %s:\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package zfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ioniceClasses maps the I/O scheduling class names accepted by
+// WithNiceOption to ionice class numbers.
+var ioniceClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// WithNiceOption runs send and receive processes with reduced CPU and I/O
+// priority, so large sends don't starve other workloads. nice is the
+// niceness passed to nice(1), 0 to leave it unchanged. ioClass is an
+// ionice(1) class, "idle", "best-effort" or "realtime", optionally followed
+// by ":<level>", or "" to leave I/O priority unchanged.
+func WithNiceOption(nice int, ioClass string) BackupOption {
+	return func(b *Backup) error {
+		if nice < -20 || nice > 19 {
+			return fmt.Errorf("nice value %d out of range -20 to 19", nice)
+		}
+		var wrap []string
+		if nice != 0 {
+			wrap = append(wrap, "nice", "-n", strconv.Itoa(nice))
+		}
+		if ioClass != "" {
+			name, level, hasLevel := strings.Cut(ioClass, ":")
+			class, ok := ioniceClasses[name]
+			if !ok {
+				return fmt.Errorf("unknown ionice class %q", name)
+			}
+			wrap = append(wrap, "ionice", "-c", class)
+			if hasLevel {
+				n, err := strconv.Atoi(level)
+				if err != nil || n < 0 || n > 7 {
+					return fmt.Errorf("invalid ionice level %q: must be 0 to 7", level)
+				}
+				wrap = append(wrap, "-n", level)
+			}
+		}
+		b.niceWrap = wrap
+		return nil
+	}
+}
+
+// WithSystemdPropertiesOption launches send and receive processes in
+// transient systemd scopes with the given unit properties, e.g.
+// "CPUQuota=50%" or "IOReadBandwidthMax=/dev/sda 50M", giving hard resource
+// caps. Each process gets its own scope, so the caps apply per process.
+func WithSystemdPropertiesOption(props []string) BackupOption {
+	return func(b *Backup) error {
+		for _, p := range props {
+			if k, _, ok := strings.Cut(p, "="); !ok || k == "" {
+				return fmt.Errorf("invalid systemd property %q: must be Name=value", p)
+			}
+		}
+		b.systemdProps = props
+		return nil
+	}
+}
+
+// throttle prefixes a send or receive command with the configured priority
+// and resource wrappers.
+func (b *Backup) throttle(args []string) []string {
+	var wrap []string
+	if len(b.systemdProps) > 0 {
+		wrap = append(wrap, "systemd-run", "--scope", "--quiet", "--collect")
+		for _, p := range b.systemdProps {
+			wrap = append(wrap, "-p", p)
+		}
+		wrap = append(wrap, "--")
+	}
+	wrap = append(wrap, b.niceWrap...)
+	if len(wrap) == 0 {
+		return args
+	}
+	return append(wrap, args...)
+}
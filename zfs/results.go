@@ -0,0 +1,17 @@
+package zfs
+
+// SourceResult is the outcome of replicating one source in the last run.
+type SourceResult struct {
+	Source   Source
+	Datasets int // datasets replicated
+	// Deferred is set if the deadline passed before the source, or some of
+	// its datasets, could be replicated.
+	Deferred bool
+	Err      error
+}
+
+// Results returns the per-source outcome of the last RunBackup, in order.
+// Sources are only listed once they have been snapshotted.
+func (b *Backup) Results() []SourceResult {
+	return append([]SourceResult(nil), b.results...)
+}
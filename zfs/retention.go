@@ -0,0 +1,108 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy keeps the newest backup snapshot of each of the last
+// Hourly hours, Daily days, Weekly ISO weeks, Monthly months and Yearly
+// years that have one, on top of the newest snapshots kept by
+// WithRetainOption. A snapshot's time is taken from its name.
+type RetentionPolicy struct {
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+// retentionBuckets are the periods of a RetentionPolicy, in the order of
+// its fields, with the key identifying the period a time falls in.
+var retentionBuckets = []struct {
+	name string
+	key  func(time.Time) string
+}{
+	{"hourly", func(t time.Time) string { return t.Format("2006-01-02T15") }},
+	{"daily", func(t time.Time) string { return t.Format("2006-01-02") }},
+	{"weekly", func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}},
+	{"monthly", func(t time.Time) string { return t.Format("2006-01") }},
+	{"yearly", func(t time.Time) string { return t.Format("2006") }},
+}
+
+func (p RetentionPolicy) counts() []int {
+	return []int{p.Hourly, p.Daily, p.Weekly, p.Monthly, p.Yearly}
+}
+
+// IsZero reports whether p keeps no buckets.
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// Total is the most snapshots p can keep.
+func (p RetentionPolicy) Total() int {
+	total := 0
+	for _, n := range p.counts() {
+		total += n
+	}
+	return total
+}
+
+func (p RetentionPolicy) String() string {
+	var parts []string
+	for i, n := range p.counts() {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", retentionBuckets[i].name, n))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// WithRetentionPolicyOption thins out old backup snapshots on the source
+// and target by period, grandfather-father-son style, instead of keeping
+// only the newest ones. A snapshot is destroyed only if every period it
+// falls in has a newer snapshot, or is older than the periods kept.
+func WithRetentionPolicyOption(p RetentionPolicy) BackupOption {
+	return func(b *Backup) error {
+		for i, n := range p.counts() {
+			if n < 0 {
+				return fmt.Errorf("%s retention cannot be negative", retentionBuckets[i].name)
+			}
+		}
+		b.retention = p
+		return nil
+	}
+}
+
+// retentionTracker assigns snapshots, newest first, to the buckets of a
+// policy.
+type retentionTracker struct {
+	left []int
+	last []string
+}
+
+func (p RetentionPolicy) tracker() *retentionTracker {
+	return &retentionTracker{left: p.counts(), last: make([]string, len(retentionBuckets))}
+}
+
+// keep returns the names of the buckets in which a snapshot taken at t is
+// the newest and that still have room. Snapshots must be passed newest
+// first.
+func (r *retentionTracker) keep(t time.Time) []string {
+	var kept []string
+	for i, bucket := range retentionBuckets {
+		if r.left[i] == 0 {
+			continue
+		}
+		if key := bucket.key(t); key != r.last[i] {
+			r.last[i] = key
+			r.left[i]--
+			kept = append(kept, bucket.name)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,179 @@
+package zfs
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRetentionTrackerKeep(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	plus14 := time.FixedZone("UTC+14", 14*60*60)
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		loc    *time.Location
+		times  []string // newest first
+		want   [][]string
+	}{
+		{
+			name:   "zero policy keeps nothing",
+			policy: RetentionPolicy{},
+			loc:    time.UTC,
+			times:  []string{"2026-02-01T12:00:00", "2026-01-01T12:00:00"},
+			want:   [][]string{nil, nil},
+		},
+		{
+			name:   "hour boundary",
+			policy: RetentionPolicy{Hourly: 3},
+			loc:    time.UTC,
+			times:  []string{"2026-02-01T12:00:00", "2026-02-01T11:59:59", "2026-02-01T11:00:00", "2026-02-01T10:59:59", "2026-02-01T09:00:00"},
+			want:   [][]string{{"hourly"}, {"hourly"}, nil, {"hourly"}, nil},
+		},
+		{
+			name:   "day boundary",
+			policy: RetentionPolicy{Daily: 2},
+			loc:    time.UTC,
+			times:  []string{"2026-02-02T00:00:00", "2026-02-01T23:59:59", "2026-02-01T00:00:00", "2026-01-31T23:59:59"},
+			want:   [][]string{{"daily"}, {"daily"}, nil, nil},
+		},
+		{
+			name:   "ISO week across the new year",
+			policy: RetentionPolicy{Weekly: 3},
+			loc:    time.UTC,
+			// 2026-01-01 is a Thursday, so 2025-12-29 is in 2026-W01.
+			times: []string{"2026-01-05T00:00:00", "2026-01-01T00:00:00", "2025-12-29T00:00:00", "2025-12-28T23:00:00"},
+			want:  [][]string{{"weekly"}, {"weekly"}, nil, {"weekly"}},
+		},
+		{
+			name:   "month and year boundaries",
+			policy: RetentionPolicy{Monthly: 2, Yearly: 2},
+			loc:    time.UTC,
+			times:  []string{"2026-01-01T00:00:00", "2025-12-31T23:59:59", "2025-12-01T00:00:00", "2025-11-30T00:00:00", "2024-06-01T00:00:00"},
+			want:   [][]string{{"monthly", "yearly"}, {"monthly", "yearly"}, nil, nil, nil},
+		},
+		{
+			name:   "every bucket",
+			policy: RetentionPolicy{Hourly: 1, Daily: 1, Weekly: 1, Monthly: 1, Yearly: 1},
+			loc:    time.UTC,
+			times:  []string{"2026-02-01T12:00:00", "2026-02-01T11:00:00"},
+			want:   [][]string{{"hourly", "daily", "weekly", "monthly", "yearly"}, nil},
+		},
+		{
+			name:   "zero count skips its bucket",
+			policy: RetentionPolicy{Hourly: 2, Weekly: 0, Monthly: 1},
+			loc:    time.UTC,
+			times:  []string{"2026-02-01T12:00:00", "2026-01-31T12:00:00", "2026-01-20T12:00:00"},
+			want:   [][]string{{"hourly", "monthly"}, {"hourly"}, nil},
+		},
+		{
+			name:   "periods follow the time zone",
+			policy: RetentionPolicy{Daily: 2},
+			loc:    plus14,
+			// One day in UTC, two at UTC+14.
+			times: []string{"2026-02-01T10:00:00Z", "2026-02-01T09:59:00Z"},
+			want:  [][]string{{"daily"}, {"daily"}},
+		},
+		{
+			name:   "same times in UTC",
+			policy: RetentionPolicy{Daily: 2},
+			loc:    time.UTC,
+			times:  []string{"2026-02-01T10:00:00Z", "2026-02-01T09:59:00Z"},
+			want:   [][]string{{"daily"}, nil},
+		},
+		{
+			name:   "23 hour day when DST starts",
+			policy: RetentionPolicy{Hourly: 3, Daily: 2},
+			loc:    oslo,
+			// 02:00 doesn't exist on 2026-03-29.
+			times: []string{"2026-03-29T03:30:00", "2026-03-29T01:30:00", "2026-03-29T00:00:00", "2026-03-28T23:00:00"},
+			want:  [][]string{{"hourly", "daily"}, {"hourly"}, {"hourly"}, {"daily"}},
+		},
+		{
+			name:   "repeated hour when DST ends",
+			policy: RetentionPolicy{Hourly: 3, Daily: 1},
+			loc:    oslo,
+			// 02:00 to 03:00 happens twice on 2026-10-25; both are one
+			// hourly period, as periods go by local time.
+			times: []string{"2026-10-25T03:00:00+01:00", "2026-10-25T02:30:00+01:00", "2026-10-25T02:30:00+02:00", "2026-10-25T01:30:00+02:00"},
+			want:  [][]string{{"hourly", "daily"}, {"hourly"}, nil, {"hourly"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.policy.tracker()
+			for i, s := range tt.times {
+				ts, err := parseTestTime(s, tt.loc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := r.keep(ts); !slices.Equal(got, tt.want[i]) {
+					t.Errorf("keep(%s) = %q, want %q", ts, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// parseTestTime parses s in loc. Times with an offset are converted to
+// loc instead, e.g. to tell apart the repeated hour at the end of DST.
+func parseTestTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.In(loc), nil
+	}
+	return time.ParseInLocation(snapshotTimeLayout, s, loc)
+}
+
+// TestRetentionPolicyWithRetain checks that the snapshots kept by
+// WithRetainOption use up the periods they fall in.
+func TestRetentionPolicyWithRetain(t *testing.T) {
+	tests := []struct {
+		name   string
+		retain int
+		policy RetentionPolicy
+		snaps  []string // oldest first
+		want   string   // destroyed
+	}{
+		{
+			name:   "retained snapshots fill their day",
+			retain: 2,
+			policy: RetentionPolicy{Daily: 2},
+			snaps:  []string{"2026-01-29T10:00:00", "2026-01-30T10:00:00", "2026-01-31T08:00:00", "2026-01-31T10:00:00"},
+			want:   "tank/data@2026-01-29T10:00:00",
+		},
+		{
+			name:   "policy keeps older than retain",
+			retain: 1,
+			policy: RetentionPolicy{Daily: 3},
+			snaps:  []string{"2026-01-29T10:00:00", "2026-01-30T08:00:00", "2026-01-30T10:00:00", "2026-01-31T10:00:00"},
+			want:   "tank/data@2026-01-30T08:00:00",
+		},
+		{
+			name:   "zero policy is plain retain",
+			retain: 2,
+			snaps:  []string{"2026-01-29T10:00:00", "2026-01-30T10:00:00", "2026-01-31T08:00:00", "2026-01-31T10:00:00"},
+			want:   "tank/data@2026-01-29T10:00:00,2026-01-30T10:00:00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var owned []string
+			for _, s := range tt.snaps {
+				owned = append(owned, "tank/data@"+s+"\t"+DefaultOwner)
+			}
+			b := newReplayBackup(t, "backup", []recordEntry{
+				{Cmds: [][]string{{"zfs", "list", "-H", "-o", "name,zfsbackup:owner", "-t", "snapshot", "-d", "1", "-s", "creation", "tank/data"}}, Stdout: owned},
+				{Cmds: [][]string{{"zfs", "destroy", tt.want}}},
+			}, WithRetentionPolicyOption(tt.policy))
+			if err := b.cleanSnapshots("tank/data", tt.retain, nil, false); err != nil {
+				t.Fatal(err)
+			}
+			if len(b.replay) > 0 {
+				t.Errorf("%d fixture entries not replayed, next is %q", len(b.replay), quotePipeline(b.replay[0].Cmds))
+			}
+		})
+	}
+}
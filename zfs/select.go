@@ -0,0 +1,264 @@
+package zfs
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// WithPriorityOption orders the datasets of a recursive source so that
+// those matching earlier patterns are replicated first. Patterns use
+// path.Match syntax against full dataset names. A pattern of just "*"
+// stands for every dataset that matches no other pattern; without one,
+// unmatched datasets go last. Ties keep zfs list order.
+func WithPriorityOption(patterns []string) BackupOption {
+	return func(b *Backup) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid priority pattern %q: %w", p, err)
+			}
+		}
+		b.priority = patterns
+		return nil
+	}
+}
+
+// priorityRank returns the position of fs in the priority order.
+func (b *Backup) priorityRank(fs string) int {
+	rest := len(b.priority)
+	for i, p := range b.priority {
+		if p == "*" {
+			rest = i
+			continue
+		}
+		if ok, _ := path.Match(p, fs); ok {
+			return i
+		}
+	}
+	return rest
+}
+
+// orderFilesystems sorts filesystems by priority, keeping the original
+// order among datasets of equal priority. A dataset ranks no later than
+// its best-ranked descendant, so it is never replicated after its
+// children: their first full receive needs it on the target.
+func (b *Backup) orderFilesystems(filesystems []string) []string {
+	if len(b.priority) == 0 {
+		return filesystems
+	}
+	rank := make(map[string]int, len(filesystems))
+	for _, fs := range filesystems {
+		rank[fs] = b.priorityRank(fs)
+	}
+	for _, fs := range filesystems {
+		for _, d := range filesystems {
+			if strings.HasPrefix(d, fs+"/") {
+				rank[fs] = min(rank[fs], rank[d])
+			}
+		}
+	}
+	ordered := slices.Clone(filesystems)
+	slices.SortStableFunc(ordered, func(x, y string) int {
+		return rank[x] - rank[y]
+	})
+	b.logDebug("dataset order", "filesystems", ordered)
+	return ordered
+}
+
+// ephemeralPatterns match dataset name components that almost never need
+// backing up.
+var ephemeralPatterns = []struct {
+	re     *regexp.Regexp
+	reason string
+	// volume restricts the pattern to the names of volumes.
+	volume bool
+}{
+	// Layers created by the Docker zfs storage driver.
+	{regexp.MustCompile(`^[0-9a-f]{64}(-init)?$`), "docker layer", false},
+	// TrueNAS system dataset.
+	{regexp.MustCompile(`^\.system$`), "system dataset", false},
+	{regexp.MustCompile(`^swap[0-9]*$`), "swap volume", true},
+}
+
+// WithExcludeEphemeralOption skips well-known ephemeral datasets, and
+// everything under them, in recursive sources: Docker storage driver
+// layers, the TrueNAS .system dataset and swap volumes. Only the datasets
+// below the root of a source are matched, never the root itself. They are
+// still included in recursive snapshots but are not replicated.
+func WithExcludeEphemeralOption() BackupOption {
+	return func(b *Backup) error {
+		b.excludeEphemeral = true
+		return nil
+	}
+}
+
+// ephemeralReason returns why fs, a dataset of the recursive source root,
+// is considered ephemeral, or "" if it is not. Only the components of fs
+// below root are matched. isVolume is called only for datasets whose name
+// matches a pattern restricted to volumes.
+func ephemeralReason(root, fs string, isVolume func(string) (bool, error)) (string, error) {
+	rel, ok := strings.CutPrefix(fs, root+"/")
+	if !ok {
+		return "", nil
+	}
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		for _, p := range ephemeralPatterns {
+			if !p.re.MatchString(part) {
+				continue
+			}
+			if !p.volume {
+				return p.reason, nil
+			}
+			// Volumes have no children, so only the last component
+			// can name one.
+			if i < len(parts)-1 {
+				continue
+			}
+			vol, err := isVolume(fs)
+			if err != nil {
+				return "", err
+			}
+			if vol {
+				return p.reason, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// isVolume reports whether the source dataset fs is a volume.
+func (b *Backup) isVolume(fs string) (bool, error) {
+	lines, stderr, err := b.query(b.buildCommand(false, "get", "-H", "-o", "value", "type", fs)...)
+	if err != nil {
+		return false, b.wrapCmdError("getting dataset type", stderr, err)
+	}
+	return len(lines) > 0 && strings.TrimSpace(lines[0]) == "volume", nil
+}
+
+// filterFilesystems drops excluded datasets from the recursive listing of
+// root.
+func (b *Backup) filterFilesystems(root string, filesystems []string) ([]string, error) {
+	if !b.excludeEphemeral {
+		return filesystems, nil
+	}
+	var kept []string
+	for _, fs := range filesystems {
+		reason, err := ephemeralReason(root, fs, b.isVolume)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			b.logDebug("excluding ephemeral dataset", "fs", fs, "reason", reason)
+			continue
+		}
+		kept = append(kept, fs)
+	}
+	return kept, nil
+}
+
+// WithSyncHistoryOption replicates every existing source snapshot whose
+// name matches pattern (path.Match syntax, e.g. "autosnap_*" or "*"), not
+// just the new one, as a chain of incremental sends. A newly seeded
+// target then gets the source's existing snapshot history.
+func WithSyncHistoryOption(pattern string) BackupOption {
+	return func(b *Backup) error {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid history pattern %q: %w", pattern, err)
+		}
+		b.syncHistory = true
+		b.historyPattern = pattern
+		return nil
+	}
+}
+
+// historySteps returns the snapshots of fs to send in order after
+// startSnap: every matching snapshot newer than startSnap (or all of them
+// if it is empty), ending with endSnap.
+func (b *Backup) historySteps(fs, startSnap, endSnap string) ([]string, error) {
+	snaps, err := b.listSnapshots(fs)
+	if err != nil {
+		return nil, err
+	}
+	if startSnap != "" {
+		i := slices.Index(snaps, startSnap)
+		if i < 0 {
+			return nil, fmt.Errorf("base snapshot %s not found on source", startSnap)
+		}
+		snaps = snaps[i+1:]
+	}
+	var steps []string
+	for _, snap := range snaps {
+		if snap == endSnap {
+			continue
+		}
+		_, name := splitSnapshot(snap)
+		if ok, _ := path.Match(b.historyPattern, name); ok {
+			steps = append(steps, snap)
+		}
+	}
+	b.logDebug("syncing history", "fs", fs, "from", startSnap, "snapshots", len(steps))
+	return append(steps, endSnap), nil
+}
+
+// autoSnapshotProperty is the zfs-auto-snapshot opt-out property.
+const autoSnapshotProperty = "com.sun:auto-snapshot"
+
+// WithHonorAutoSnapshotOption skips datasets in recursive sources whose
+// com.sun:auto-snapshot property is false, the convention used by
+// zfs-auto-snapshot and similar tools, so exclusions only need to be set
+// once. Like other exclusions, they are still covered by the recursive
+// snapshot but are not replicated.
+func WithHonorAutoSnapshotOption() BackupOption {
+	return func(b *Backup) error {
+		b.honorAutoSnapshot = true
+		return nil
+	}
+}
+
+// autoSnapshotOptOuts returns the datasets under vol that have
+// com.sun:auto-snapshot=false, directly or inherited.
+func (b *Backup) autoSnapshotOptOuts(vol string) (map[string]bool, error) {
+	// Only datasets where the property is set or inherited are listed.
+	args := b.buildCommand(false, "get", "-H", "-o", "name,value", "-s", "local,inherited", "-r", "-t", "filesystem,volume", autoSnapshotProperty, vol)
+	optOuts := make(map[string]bool)
+	stderr, err := b.queryEach(func(l string) error {
+		name, value, ok := strings.Cut(l, "\t")
+		if !ok {
+			return fmt.Errorf("malformed %s line %q", autoSnapshotProperty, l)
+		}
+		if strings.EqualFold(strings.TrimSpace(value), "false") {
+			optOuts[name] = true
+		}
+		return nil
+	}, args...)
+	if err != nil {
+		if stderr == "" {
+			return nil, err
+		}
+		return nil, b.wrapCmdError("listing "+autoSnapshotProperty, stderr, err)
+	}
+	return optOuts, nil
+}
+
+// excludeOptOuts drops datasets that opted out via com.sun:auto-snapshot.
+func (b *Backup) excludeOptOuts(vol string, filesystems []string) ([]string, error) {
+	if !b.honorAutoSnapshot {
+		return filesystems, nil
+	}
+	optOuts, err := b.autoSnapshotOptOuts(vol)
+	if err != nil {
+		return nil, err
+	}
+	var kept []string
+	for _, fs := range filesystems {
+		if optOuts[fs] {
+			b.logDebug("excluding dataset", "fs", fs, "reason", autoSnapshotProperty+"=false")
+			continue
+		}
+		kept = append(kept, fs)
+	}
+	return kept, nil
+}
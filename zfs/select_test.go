@@ -0,0 +1,92 @@
+package zfs
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestOrderFilesystems(t *testing.T) {
+	filesystems := []string{"tank/data", "tank/data/db", "tank/data/media", "tank/home", "tank/home/db"}
+	tests := []struct {
+		priority []string
+		want     []string
+	}{
+		{nil, filesystems},
+		{[]string{"tank/home"}, []string{"tank/home", "tank/data", "tank/data/db", "tank/data/media", "tank/home/db"}},
+		// Parents are never moved after their children.
+		{[]string{"tank/data/media"}, []string{"tank/data", "tank/data/media", "tank/data/db", "tank/home", "tank/home/db"}},
+		{[]string{"tank/*/db", "*"}, []string{"tank/data", "tank/data/db", "tank/home", "tank/home/db", "tank/data/media"}},
+	}
+	for _, tt := range tests {
+		b, err := NewBackup("backup", WithPriorityOption(tt.priority))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.orderFilesystems(filesystems); !slices.Equal(got, tt.want) {
+			t.Errorf("priority %q: order %q, want %q", tt.priority, got, tt.want)
+		}
+	}
+}
+
+// TestReplayPriorityFreshTarget checks that a prioritized child is not
+// received before its parent exists on the target.
+func TestReplayPriorityFreshTarget(t *testing.T) {
+	err := replaySource(t, "priority-fresh-target", "tank/data/...", "backup", WithPriorityOption([]string{"tank/data/db"}))
+	if err != nil {
+		t.Fatalf("RunBackup: %v", err)
+	}
+}
+
+func TestEphemeralReason(t *testing.T) {
+	layer := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	volumes := []string{"tank/swap", "tank/vm/swap1"}
+	tests := []struct {
+		root, fs string
+		want     string
+	}{
+		{"tank", "tank/docker/" + layer, "docker layer"},
+		{"tank", "tank/docker/" + layer + "-init", "docker layer"},
+		{"tank", "tank/docker/" + layer + "/sub", "docker layer"},
+		{"tank", "tank/.system", "system dataset"},
+		{"tank", "tank/.system/samba4", "system dataset"},
+		{"tank", "tank/swap", "swap volume"},
+		{"tank", "tank/vm/swap1", "swap volume"},
+		// Filesystems named like swap volumes are kept.
+		{"tank", "tank/swap2", ""},
+		{"tank", "tank/swap2/data", ""},
+		{"tank", "tank/data", ""},
+		// The source root and its ancestors are never matched.
+		{"tank/.system", "tank/.system", ""},
+		{"tank/.system", "tank/.system/samba4", ""},
+		{"tank/swap", "tank/swap", ""},
+		{"tank/docker/" + layer, "tank/docker/" + layer + "/sub", ""},
+	}
+	for _, tt := range tests {
+		got, err := ephemeralReason(tt.root, tt.fs, func(fs string) (bool, error) {
+			return slices.Contains(volumes, fs), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("ephemeralReason(%q, %q) = %q, want %q", tt.root, tt.fs, got, tt.want)
+		}
+	}
+}
+
+func TestFilterFilesystemsSwapVolume(t *testing.T) {
+	b := newReplayBackup(t, "backup", []recordEntry{
+		{Cmds: [][]string{{"zfs", "get", "-H", "-o", "value", "type", "tank/swap"}}, Stdout: []string{"volume"}},
+		{Cmds: [][]string{{"zfs", "get", "-H", "-o", "value", "type", "tank/swap2"}}, Stdout: []string{"filesystem"}},
+	}, WithExcludeEphemeralOption())
+	got, err := b.filterFilesystems("tank", []string{"tank", "tank/swap", "tank/swap2", "tank/.system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"tank", "tank/swap2"}; !slices.Equal(got, want) {
+		t.Errorf("filterFilesystems = %q, want %q", got, want)
+	}
+	if len(b.replay) > 0 {
+		t.Errorf("%d fixture entries not replayed, next is %q", len(b.replay), quotePipeline(b.replay[0].Cmds))
+	}
+}
@@ -0,0 +1,107 @@
+package zfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultLogRetain is the default number of session logs kept per dataset.
+const DefaultLogRetain = 10
+
+// WithLogDirOption writes the stderr of every stage of each send/receive
+// pipeline to a session log file in dir, one file per dataset and
+// snapshot. Only the newest retain logs are kept per dataset, or all of
+// them if retain is 0.
+func WithLogDirOption(dir string, retain int) BackupOption {
+	return func(b *Backup) error {
+		if dir == "" {
+			return fmt.Errorf("log directory cannot be empty")
+		}
+		if retain < 0 {
+			return fmt.Errorf("log retention cannot be negative")
+		}
+		b.logDir = dir
+		b.logRetain = retain
+		return nil
+	}
+}
+
+// sessionLogPrefix returns the file name prefix of the session logs of fs.
+func sessionLogPrefix(fs string) string {
+	return strings.ReplaceAll(fs, "/", "_") + "@"
+}
+
+// openSessionLog creates the session log for sending snap of fs and prunes
+// old logs of fs. It returns a nil file if session logs are disabled or
+// nothing is executed.
+func (b *Backup) openSessionLog(fs, snap string) (*os.File, error) {
+	if b.logDir == "" || b.dryrun || b.replaying {
+		return nil, nil
+	}
+	if err := os.MkdirAll(b.logDir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating log directory: %w", err)
+	}
+	_, snapName := splitSnapshot(snap)
+	path := filepath.Join(b.logDir, sessionLogPrefix(fs)+snapName+".log")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session log: %w", err)
+	}
+	b.pruneSessionLogs(fs)
+	return f, nil
+}
+
+// pruneSessionLogs removes all but the newest b.logRetain session logs of
+// fs. Failures are only logged.
+func (b *Backup) pruneSessionLogs(fs string) {
+	if b.logRetain == 0 {
+		return
+	}
+	entries, err := os.ReadDir(b.logDir)
+	if err != nil {
+		b.logger.Warn("error reading log directory", "dir", b.logDir, "err", err)
+		return
+	}
+	prefix := sessionLogPrefix(fs)
+	var logs []string
+	for _, e := range entries {
+		// A longer dataset name can't produce this prefix, since it would
+		// need a '@' in its name.
+		if strings.HasPrefix(e.Name(), prefix) && strings.HasSuffix(e.Name(), ".log") {
+			logs = append(logs, e.Name())
+		}
+	}
+	// Snapshot names are timestamps, so names sort oldest first.
+	slices.Sort(logs)
+	for len(logs) > b.logRetain {
+		path := filepath.Join(b.logDir, logs[0])
+		if err := os.Remove(path); err != nil {
+			b.logger.Warn("error removing old session log", "path", path, "err", err)
+		}
+		logs = logs[1:]
+	}
+}
+
+// writeSessionLog writes each command of a pipeline with its stderr and
+// exit status to w. Stages whose stderr went elsewhere have a nil entry
+// in stderrs.
+func writeSessionLog(w io.Writer, cmds [][]string, stderrs [][]byte, errs []error) {
+	for i, cmd := range cmds {
+		fmt.Fprintf(w, "$ %s\n", quoteCommand(cmd))
+		if stderrs[i] != nil {
+			w.Write(stderrs[i])
+			if n := len(stderrs[i]); n > 0 && stderrs[i][n-1] != '\n' {
+				fmt.Fprintln(w)
+			}
+		}
+		if errs[i] != nil {
+			fmt.Fprintf(w, "# %v\n", errs[i])
+		} else {
+			fmt.Fprintln(w, "# exit status 0")
+		}
+	}
+}
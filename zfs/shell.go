@@ -0,0 +1,45 @@
+package zfs
+
+import "strings"
+
+// shellSafe reports whether s can appear unquoted in a POSIX shell command.
+func shellSafe(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("@%+=:,./_-", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// shellQuote quotes s for a POSIX shell, leaving it bare when that is safe.
+func shellQuote(s string) string {
+	if shellSafe(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// quoteCommand renders args as a copy-pasteable shell command.
+func quoteCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quotePipeline renders cmds as a copy-pasteable shell pipeline.
+func quotePipeline(cmds [][]string) string {
+	parts := make([]string, len(cmds))
+	for i, c := range cmds {
+		parts[i] = quoteCommand(c)
+	}
+	return strings.Join(parts, " | ")
+}
@@ -0,0 +1,82 @@
+package zfs
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"zfs", "zfs"},
+		{"tank/data@2026-01-02T00:00:00", "tank/data@2026-01-02T00:00:00"},
+		{"zfsbackup:owner=zfsbackup", "zfsbackup:owner=zfsbackup"},
+		{"-o", "-o"},
+		{"", "''"},
+		{"my data", "'my data'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"a;b", "'a;b'"},
+		{"*", "'*'"},
+		{"a\nb", "'a\nb'"},
+		{"~user", "'~user'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteCommand(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"zfs", "list", "-H"}, "zfs list -H"},
+		{[]string{"zfs", "set", "k=a b", "tank"}, "zfs set 'k=a b' tank"},
+		{[]string{"zfs", "receive", ""}, "zfs receive ''"},
+		// A quoted command quoted again, as when it is the remote
+		// command of ssh.
+		{[]string{"ssh", "nas", "zfs set 'k=a b' tank"}, `ssh nas 'zfs set '\''k=a b'\'' tank'`},
+	}
+	for _, tt := range tests {
+		if got := quoteCommand(tt.args); got != tt.want {
+			t.Errorf("quoteCommand(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestQuotePipeline(t *testing.T) {
+	cmds := [][]string{
+		{"zfs", "send", "tank/data@a"},
+		{"ssh", "nas", "zfs receive -F 'backup/my data'"},
+	}
+	want := `zfs send tank/data@a | ssh nas 'zfs receive -F '\''backup/my data'\'''`
+	if got := quotePipeline(cmds); got != want {
+		t.Errorf("quotePipeline = %s, want %s", got, want)
+	}
+}
+
+func TestPrintCommandsDryRun(t *testing.T) {
+	var buf bytes.Buffer
+	b, err := NewBackup("backup",
+		WithDryRunOption(),
+		WithPrintCommandsOption(&buf),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.run("zfs", "destroy", "backup/my data@a"); err != nil {
+		t.Fatal(err)
+	}
+	b.printCommands([]string{"zfs", "send", "tank/data@a"}, []string{"zfs", "receive", "-F", "backup/my data"})
+	want := "zfs destroy 'backup/my data@a'\nzfs send tank/data@a | zfs receive -F 'backup/my data'\n"
+	if got := buf.String(); got != want {
+		t.Errorf("printed commands:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+package zfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// datasetIndex caches the result of one recursive listing of datasets and
+// their snapshots, so recursive sources don't need two zfs list calls per
+// dataset. Only the datasets it was built for are covered; everything
+// else is queried as usual. It is only used during replication, which
+// handles one dataset at a time.
+type datasetIndex struct {
+	exists map[string]bool
+	snaps  map[string][]indexedSnapshot
+}
+
+type indexedSnapshot struct {
+	name  string
+	owner string
+}
+
+// indexDatasets lists root recursively on the source or target and caches
+// the existence and snapshots of each of vols, which must be under root.
+func (b *Backup) indexDatasets(isTarget bool, root string, vols []string) error {
+	args := b.buildCommand(isTarget, "list", "-H", "-o", "name,"+ownerProperty, "-t", "filesystem,volume,snapshot", "-s", "creation", "-r", root)
+	exists := make(map[string]bool)
+	snaps := make(map[string][]indexedSnapshot)
+	stderr, err := b.queryEach(func(l string) error {
+		name, owner, ok := strings.Cut(l, "\t")
+		if !ok {
+			return fmt.Errorf("malformed dataset line %q", l)
+		}
+		vol, snap := splitSnapshot(name)
+		if snap == "" {
+			exists[vol] = true
+			return nil
+		}
+		snaps[vol] = append(snaps[vol], indexedSnapshot{name: name, owner: strings.TrimSpace(owner)})
+		return nil
+	}, args...)
+	if err != nil {
+		if stderr == "" {
+			return err
+		}
+		return b.wrapCmdError("listing datasets", stderr, err)
+	}
+
+	if b.index == nil {
+		b.index = &datasetIndex{exists: make(map[string]bool), snaps: make(map[string][]indexedSnapshot)}
+	}
+	for _, vol := range vols {
+		b.index.exists[vol] = exists[vol]
+		b.index.snaps[vol] = snaps[vol]
+	}
+	b.logDebug("indexed datasets", "root", root, "datasets", len(vols))
+	return nil
+}
+
+// indexedExists returns whether vol exists according to the index, and
+// whether the index covers vol.
+func (b *Backup) indexedExists(vol string) (exists, ok bool) {
+	if b.index == nil {
+		return false, false
+	}
+	exists, ok = b.index.exists[vol]
+	return exists, ok
+}
+
+// indexedSnapshots returns the snapshots of vol in creation order from the
+// index, and whether the index covers vol.
+func (b *Backup) indexedSnapshots(vol string) ([]indexedSnapshot, bool) {
+	if b.index == nil {
+		return nil, false
+	}
+	snaps, ok := b.index.snaps[vol]
+	return snaps, ok
+}
+
+// invalidate drops vol, and its descendants if recurse is set, from the
+// index after a write.
+func (b *Backup) invalidate(vol string, recurse bool) {
+	if b.index == nil {
+		return
+	}
+	affected := func(k string) bool {
+		return k == vol || (recurse && strings.HasPrefix(k, vol+"/"))
+	}
+	for k := range b.index.exists {
+		if affected(k) {
+			delete(b.index.exists, k)
+		}
+	}
+	for k := range b.index.snaps {
+		if affected(k) {
+			delete(b.index.snaps, k)
+		}
+	}
+}
+
+// indexSource indexes the datasets of a recursive source and their
+// targets before replication.
+func (b *Backup) indexSource(plan *sourcePlan) error {
+	if !plan.src.recurse || len(plan.filesystems) < 2 {
+		return nil
+	}
+	if err := b.indexDatasets(false, plan.src.vol, plan.filesystems); err != nil {
+		return err
+	}
+	if !b.isZFSTarget() {
+		return nil
+	}
+	targetRoot := fmt.Sprintf("%s/%s", b.target, plan.src.vol)
+	exists, err := b.datasetExists(targetRoot)
+	if err != nil || !exists {
+		return err
+	}
+	var targets []string
+	for _, fs := range plan.filesystems {
+		targets = append(targets, fmt.Sprintf("%s/%s", b.target, fs))
+	}
+	return b.indexDatasets(true, targetRoot, targets)
+}
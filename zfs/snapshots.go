@@ -0,0 +1,68 @@
+package zfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SnapshotInfo describes a snapshot for browsing.
+type SnapshotInfo struct {
+	Name       string
+	Created    time.Time
+	Used       int64 // space freed if only this snapshot were destroyed
+	Referenced int64
+	Owned      bool // carries this Backup's owner marker
+}
+
+// Snapshots lists the snapshots of vol, on the target if vol is under the
+// target filesystem and on the source otherwise, oldest first.
+func (b *Backup) Snapshots(vol string) ([]SnapshotInfo, error) {
+	args := b.buildCommand(b.isTargetVolume(vol), "list", "-H", "-p", "-o", "name,creation,used,referenced,"+ownerProperty, "-t", "snapshot", "-d", "1", "-s", "creation", vol)
+	var snaps []SnapshotInfo
+	stderr, err := b.queryEach(func(l string) error {
+		cols := strings.Split(l, "\t")
+		if len(cols) != 5 {
+			return fmt.Errorf("malformed snapshot line %q", l)
+		}
+		created, err := strconv.ParseInt(cols[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid creation time in %q: %w", l, err)
+		}
+		used, err := parseBytes(cols[2])
+		if err != nil {
+			return fmt.Errorf("invalid used in %q: %w", l, err)
+		}
+		referenced, err := parseBytes(cols[3])
+		if err != nil {
+			return fmt.Errorf("invalid referenced in %q: %w", l, err)
+		}
+		snaps = append(snaps, SnapshotInfo{
+			Name:       cols[0],
+			Created:    time.Unix(created, 0),
+			Used:       used,
+			Referenced: referenced,
+			Owned:      strings.TrimSpace(cols[4]) == b.owner,
+		})
+		return nil
+	}, args...)
+	if err != nil {
+		if stderr == "" {
+			return nil, err
+		}
+		return nil, b.wrapCmdError("listing snapshots", stderr, err)
+	}
+	return snaps, nil
+}
+
+// DiffSnapshots returns the changes between two snapshots of the same
+// dataset as reported by `zfs diff -H -F`.
+func (b *Backup) DiffSnapshots(from, to string) ([]string, error) {
+	vol, _ := splitSnapshot(from)
+	lines, stderr, err := b.query(b.buildCommand(b.isTargetVolume(vol), "diff", "-H", "-F", from, to)...)
+	if err != nil {
+		return nil, b.wrapCmdError("running zfs diff", stderr, err)
+	}
+	return lines, nil
+}
@@ -0,0 +1,155 @@
+package zfs
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SSHHost is a remote source or target host reached with ssh.
+type SSHHost struct {
+	Host     string
+	User     string // remote user, or empty for ssh's default
+	Port     int    // ssh port, or 0 for ssh's default
+	Identity string // private key file, or empty for ssh's default
+}
+
+// destination returns the [user@]host argument of ssh.
+func (t SSHHost) destination() string {
+	if t.User != "" {
+		return t.User + "@" + t.Host
+	}
+	return t.Host
+}
+
+// validate checks t for values ssh would misread or reject.
+func (t SSHHost) validate() error {
+	if t.Host == "" {
+		return fmt.Errorf("host cannot be empty")
+	}
+	if strings.HasPrefix(t.Host, "-") || strings.ContainsAny(t.Host, "@ \t") {
+		return fmt.Errorf("invalid host %q", t.Host)
+	}
+	if strings.HasPrefix(t.User, "-") || strings.ContainsAny(t.User, "@ \t") {
+		return fmt.Errorf("invalid user %q", t.User)
+	}
+	if t.Port < 0 || t.Port > 65535 {
+		return fmt.Errorf("invalid ssh port %d", t.Port)
+	}
+	if t.Identity != "" {
+		if _, err := os.Stat(t.Identity); err != nil {
+			return fmt.Errorf("ssh identity: %w", err)
+		}
+	}
+	return nil
+}
+
+// login returns the ssh command logging in to the host, without the
+// remote command. BatchMode makes ssh fail instead of prompting for a
+// password or host key, so an unattended run can't hang.
+func (t SSHHost) login() []string {
+	cmd := []string{"ssh", "-o", "BatchMode=yes"}
+	if t.Port != 0 {
+		cmd = append(cmd, "-p", strconv.Itoa(t.Port))
+	}
+	if t.Identity != "" {
+		cmd = append(cmd, "-i", t.Identity)
+	}
+	return append(cmd, t.destination())
+}
+
+// command returns the ssh command running remote on the host. ssh joins
+// its arguments with spaces for the remote shell to parse again, so
+// remote is quoted and passed as a single argument.
+func (t SSHHost) command(remote []string) []string {
+	return append(t.login(), quoteCommand(remote))
+}
+
+// sshEndpoint is the host a source or target command runs on, with the
+// command run there.
+type sshEndpoint struct {
+	host   SSHHost
+	remote []string
+}
+
+// sshOption wraps the source or target command in ssh to host. The
+// remote command stays split into its arguments, so commands can be
+// inspected as before; newProcess quotes it when the command is run.
+func sshOption(isTarget bool, host SSHHost) BackupOption {
+	return func(b *Backup) error {
+		if err := host.validate(); err != nil {
+			return err
+		}
+		cmd, endpoint := &b.sourceCmd, &b.sshSource
+		if isTarget {
+			cmd, endpoint = &b.targetCmd, &b.sshTarget
+		}
+		*endpoint = &sshEndpoint{host: host, remote: slices.Clone(*cmd)}
+		*cmd = append(host.login(), *cmd...)
+		return nil
+	}
+}
+
+// WithSSHTargetOption runs the target command on a remote host over ssh,
+// so the target command set before this option, "zfs" by default, is the
+// command run on the host. The connection and the remote zfs command are
+// checked before any snapshot is taken.
+func WithSSHTargetOption(host SSHHost) BackupOption {
+	return sshOption(true, host)
+}
+
+// WithSSHSourceOption runs the source command on a remote host over ssh,
+// for pull backups where the backup server holds the credentials and
+// receives locally. The source command set before this option, "zfs" by
+// default, is the command run on the host. The connection and the remote
+// zfs command are checked before any snapshot is taken.
+func WithSSHSourceOption(host SSHHost) BackupOption {
+	return sshOption(false, host)
+}
+
+// sshEndpointOf returns the ssh endpoint of the target if isTarget is
+// set, or of the source otherwise, or nil if that side is local.
+func (b *Backup) sshEndpointOf(isTarget bool) *sshEndpoint {
+	if isTarget {
+		return b.sshTarget
+	}
+	return b.sshSource
+}
+
+// sshError explains a failure of the source or target command run over
+// ssh: ssh exits with 255 if it couldn't connect, and the remote shell
+// with 127 if the command wasn't found. Other failures are returned as
+// they are.
+func (b *Backup) sshError(isTarget bool, stderr string, err error) error {
+	e := b.sshEndpointOf(isTarget)
+	side := "source"
+	if isTarget {
+		side = "target"
+	}
+	host := e.host.destination()
+	switch code := exitCode(err); {
+	case code == 255:
+		return fmt.Errorf("can't connect to %s host %s: %s", side, host, strings.TrimSpace(stderr))
+	case code == 127 || strings.Contains(stderr, "command not found"):
+		return fmt.Errorf("%q not found on %s host %s: install ZFS there or set the %s command to the full path of zfs", quoteCommand(e.remote), side, host, side)
+	}
+	return b.wrapCmdError(fmt.Sprintf("checking %s host %s", side, host), stderr, err)
+}
+
+// checkSSHHosts checks that the remote source and target hosts can be
+// reached and run zfs.
+func (b *Backup) checkSSHHosts() error {
+	for _, isTarget := range []bool{false, true} {
+		e := b.sshEndpointOf(isTarget)
+		if e == nil {
+			continue
+		}
+		if _, stderr, err := b.query(b.buildCommand(isTarget, "version")...); err != nil {
+			return b.sshError(isTarget, stderr, err)
+		}
+		b.logDebug("host reachable", "host", e.host.destination())
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+package zfs
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialTimeout bounds connecting and logging in to a host, so an
+// unattended run can't hang on a host that doesn't answer.
+const sshDialTimeout = 30 * time.Second
+
+// defaultIdentities are the private keys in ~/.ssh tried if no identity
+// file is set, like ssh does.
+var defaultIdentities = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sshClients connects to the source and target hosts for
+// WithNativeSSHOption and keeps one connection per host for the sessions
+// of all commands run there.
+type sshClients struct {
+	knownHosts []string
+	mu         sync.Mutex // guards everything below
+	hostKeys   ssh.HostKeyCallback
+	clients    map[string]*ssh.Client
+}
+
+// WithNativeSSHOption runs the commands of WithSSHSourceOption and
+// WithSSHTargetOption over ssh sessions opened by zfsbackup itself instead
+// of the ssh client, so no ssh binary is needed. Each host is connected to
+// once and every command gets a session on that connection.
+//
+// Host keys are checked against the knownHosts files, or
+// ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts if none are given, and
+// unknown hosts are refused. Keys are taken from the identity file and the
+// ssh agent, and from ~/.ssh/id_ed25519, id_ecdsa and id_rsa without an
+// identity file. ssh_config is not read. Commands are still logged,
+// recorded and journaled as the ssh commands they replace. Close the
+// Backup to close the connections.
+func WithNativeSSHOption(knownHosts ...string) BackupOption {
+	return func(b *Backup) error {
+		b.sshClients = &sshClients{knownHosts: knownHosts, clients: make(map[string]*ssh.Client)}
+		return nil
+	}
+}
+
+// Close closes the connections opened for WithNativeSSHOption. It is safe
+// to call on any Backup.
+func (b *Backup) Close() error {
+	if b.sshClients == nil {
+		return nil
+	}
+	return b.sshClients.close()
+}
+
+func (c *sshClients) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	for key, client := range c.clients {
+		if err := client.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+		delete(c.clients, key)
+	}
+	return errors.Join(errs...)
+}
+
+// sshConnectError is returned when the in-process ssh client can't
+// connect or log in to a host.
+type sshConnectError struct {
+	host string
+	err  error
+}
+
+func (e *sshConnectError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sshConnectError) Unwrap() error {
+	return e.err
+}
+
+// session opens a session on the connection to host, connecting first if
+// there is no connection yet or it was lost.
+func (c *sshClients) session(host SSHHost) (*ssh.Session, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := host.destination() + ":" + strconv.Itoa(host.Port)
+	if client := c.clients[key]; client != nil {
+		s, err := client.NewSession()
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			return nil, fmt.Errorf("%s refused another session, raise MaxSessions in its sshd_config: %w", host.Host, err)
+		}
+		if err == nil {
+			return s, nil
+		}
+		client.Close()
+		delete(c.clients, key)
+	}
+	client, err := c.dial(host)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[key] = client
+	return client.NewSession()
+}
+
+// dial connects and logs in to host. c.mu must be held.
+func (c *sshClients) dial(host SSHHost) (*ssh.Client, error) {
+	name := host.User
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("error getting local user name: %w", err)
+		}
+		name = u.Username
+	}
+	port := host.Port
+	if port == 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(host.Host, strconv.Itoa(port))
+	hostKeys, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, &sshConnectError{host: host.Host, err: err}
+	}
+	auth, closeAgent, err := authMethods(host.Identity)
+	if err != nil {
+		return nil, &sshConnectError{host: host.Host, err: err}
+	}
+	defer closeAgent()
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              name,
+		Auth:              auth,
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: knownAlgorithms(hostKeys, addr),
+		Timeout:           sshDialTimeout,
+	})
+	if err != nil {
+		return nil, c.connectError(host.Host, name, err)
+	}
+	return client, nil
+}
+
+// hostKeyCallback returns the callback checking host keys against the
+// known hosts files. c.mu must be held.
+func (c *sshClients) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if c.hostKeys != nil {
+		return c.hostKeys, nil
+	}
+	if len(c.knownHosts) == 0 {
+		var files []string
+		if home, err := os.UserHomeDir(); err == nil {
+			files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+		}
+		files = append(files, "/etc/ssh/ssh_known_hosts")
+		c.knownHosts = slices.DeleteFunc(files, func(f string) bool {
+			_, err := os.Stat(f)
+			return err != nil
+		})
+		if len(c.knownHosts) == 0 {
+			return nil, fmt.Errorf("host key verification failed: no known hosts file, add the host keys to ~/.ssh/known_hosts with ssh-keyscan")
+		}
+	}
+	hostKeys, err := knownhosts.New(c.knownHosts...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading known hosts: %w", err)
+	}
+	c.hostKeys = hostKeys
+	return hostKeys, nil
+}
+
+// knownAlgorithms returns the algorithms of the keys known for addr, so
+// the server is asked for a key that can be checked instead of the one it
+// prefers. If no key is known, the server's choice is refused anyway.
+func knownAlgorithms(hostKeys ssh.HostKeyCallback, addr string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if err := hostKeys(addr, &net.TCPAddr{}, probe); !errors.As(err, &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, k := range keyErr.Want {
+		switch t := k.Key.Type(); t {
+		case ssh.KeyAlgoRSA:
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, t)
+		}
+	}
+	slices.Sort(algos)
+	return slices.Compact(algos)
+}
+
+// connectError explains why connecting to host as user failed, in the
+// words ssh uses, so the failure is classified the same way.
+func (c *sshClients) connectError(host, user string, err error) error {
+	var keyErr *knownhosts.KeyError
+	var revoked *knownhosts.RevokedError
+	switch {
+	case errors.As(err, &revoked):
+		err = fmt.Errorf("host key verification failed: the key of %s is revoked in %s", host, revoked.Revoked.Filename)
+	case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+		err = fmt.Errorf("host key verification failed: %s is not in %s, add its key with ssh-keyscan", host, strings.Join(c.knownHosts, " or "))
+	case errors.As(err, &keyErr):
+		want := keyErr.Want[0]
+		err = fmt.Errorf("host key verification failed: the key of %s doesn't match %s:%d, check why it changed before replacing it", host, want.Filename, want.Line)
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		err = fmt.Errorf("permission denied: no key of the ssh agent or identity file was accepted for %s@%s", user, host)
+	}
+	return &sshConnectError{host: host, err: err}
+}
+
+// authMethods returns the public key method with the keys of the identity
+// file and the ssh agent, or of the agent and the default identities if
+// there is no identity file, and the function closing the connection to
+// the agent once logged in. An encrypted identity file is an error since
+// nothing may prompt for its passphrase; add it to the agent instead.
+func authMethods(identity string) ([]ssh.AuthMethod, func(), error) {
+	var signers []ssh.Signer
+	if identity != "" {
+		signer, err := readIdentity(identity)
+		if err != nil {
+			return nil, nil, err
+		}
+		signers = append(signers, signer)
+	}
+	closeAgent := func() {}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			closeAgent = func() { conn.Close() }
+			if keys, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, keys...)
+			}
+		}
+	}
+	if identity == "" {
+		home, _ := os.UserHomeDir()
+		for _, name := range defaultIdentities {
+			if signer, err := readIdentity(filepath.Join(home, ".ssh", name)); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		closeAgent()
+		return nil, nil, fmt.Errorf("permission denied: no ssh key, set an identity file or start ssh-agent")
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, closeAgent, nil
+}
+
+// readIdentity reads an unencrypted private key file.
+func readIdentity(path string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ssh identity: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("ssh identity %s is encrypted, add it to ssh-agent instead", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh identity %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// process returns the process running remote on host. The remote command
+// line is quoted as for the ssh client, so both run the same command.
+func (c *sshClients) process(host SSHHost, remote []string) *sshProcess {
+	return &sshProcess{clients: c, host: host, cmd: quoteCommand(remote)}
+}
+
+// sshProcess is a command run on a host over a session of the shared
+// connection to it.
+type sshProcess struct {
+	clients *sshClients
+	host    SSHHost
+	cmd     string
+	stdin   io.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	// inR and outW are the ends of the pipes returned by stdinPipe and
+	// stdoutPipe.
+	inR     *io.PipeReader
+	outR    *io.PipeReader
+	outW    *io.PipeWriter
+	session *ssh.Session
+	// broken is set if the reader of the output went away, which is
+	// reported like the broken pipe of a local command.
+	broken atomic.Bool
+}
+
+func (p *sshProcess) setStdin(r io.Reader)  { p.stdin = r }
+func (p *sshProcess) setStdout(w io.Writer) { p.stdout = w }
+func (p *sshProcess) setStderr(w io.Writer) { p.stderr = w }
+
+// stdoutPipe returns a pipe the output is copied to. It is closed once the
+// remote command closes its output, not by wait.
+func (p *sshProcess) stdoutPipe() (io.ReadCloser, error) {
+	p.outR, p.outW = io.Pipe()
+	return p.outR, nil
+}
+
+// stdinPipe returns a pipe copied to the input of the remote command.
+func (p *sshProcess) stdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	p.stdin, p.inR = r, r
+	return w, nil
+}
+
+func (p *sshProcess) start() error {
+	s, err := p.clients.session(p.host)
+	if err != nil {
+		p.closePipes(err)
+		return err
+	}
+	// Run in the C locale like local commands, if the server accepts it.
+	s.Setenv("LC_ALL", "C")
+	s.Stdin, s.Stderr = p.stdin, p.stderr
+	var out io.Reader
+	if p.outW != nil {
+		if out, err = s.StdoutPipe(); err != nil {
+			s.Close()
+			p.closePipes(err)
+			return err
+		}
+	} else {
+		s.Stdout = p.stdout
+	}
+	if err := s.Start(p.cmd); err != nil {
+		s.Close()
+		p.closePipes(err)
+		return fmt.Errorf("error starting %q on %s: %w", p.cmd, p.host.Host, err)
+	}
+	p.session = s
+	if out != nil {
+		go p.copyOutput(out)
+	}
+	return nil
+}
+
+// copyOutput copies the output of the session to the stdout pipe. If the
+// reader is gone, the session is closed so the remote command stops
+// instead of blocking on a full channel.
+func (p *sshProcess) copyOutput(out io.Reader) {
+	_, err := io.Copy(p.outW, out)
+	if errors.Is(err, io.ErrClosedPipe) {
+		p.broken.Store(true)
+		p.session.Close()
+	}
+	p.outW.CloseWithError(err)
+}
+
+// closePipes fails the pipes of a process that didn't start.
+func (p *sshProcess) closePipes(err error) {
+	if p.outW != nil {
+		p.outW.CloseWithError(err)
+	}
+	if p.inR != nil {
+		p.inR.CloseWithError(err)
+	}
+}
+
+func (p *sshProcess) wait() error {
+	err := p.session.Wait()
+	p.session.Close()
+	// Like a local command exiting, stop whatever still writes to it.
+	if c, ok := p.stdin.(io.Closer); ok {
+		c.Close()
+	}
+	var missing *ssh.ExitMissingError
+	switch {
+	case err == nil:
+		return nil
+	case p.broken.Load():
+		return fmt.Errorf("%s on %s: %w", p.cmd, p.host.Host, syscall.EPIPE)
+	case errors.As(err, &missing):
+		return fmt.Errorf("lost connection to %s before %q exited", p.host.Host, p.cmd)
+	}
+	return err
+}
+
+func (p *sshProcess) kill() {
+	p.session.Signal(ssh.SIGKILL)
+	p.session.Close()
+	if p.outR != nil {
+		p.outR.CloseWithError(io.ErrClosedPipe)
+	}
+}
@@ -0,0 +1,132 @@
+package zfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// maxLineLength bounds a single line of command output.
+	maxLineLength = 1 << 20
+	// maxStderr bounds the stderr kept from a command; the rest is dropped.
+	maxStderr = 64 << 10
+	// maxMemoLines is the longest streamed output that is still memoized.
+	maxMemoLines = 10000
+)
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - l.buf.Len(); room > 0 {
+		l.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (l *limitedBuffer) String() string {
+	return l.buf.String()
+}
+
+// execStream always executes a single process, regardless of dry-run mode,
+// calling fn with each line of its output as it is read instead of
+// buffering it. If fn returns an error, the rest of the output is
+// discarded and that error is returned once the process exits.
+func execStream(p process, fn func(line string) error) (string, error) {
+	stdout, err := p.stdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("error setting up pipe: %w", err)
+	}
+	stderrBuf := &limitedBuffer{limit: maxStderr}
+	p.setStderr(stderrBuf)
+	if err := p.start(); err != nil {
+		return err.Error(), err
+	}
+
+	var fnErr error
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64<<10), maxLineLength)
+	for scanner.Scan() {
+		if fnErr = fn(scanner.Text()); fnErr != nil {
+			break
+		}
+	}
+	scanErr := scanner.Err()
+	// Drain whatever is left so the command isn't blocked writing to us.
+	io.Copy(io.Discard, stdout)
+
+	err = p.wait()
+	if err != nil {
+		stderrStr := strings.TrimSpace(strings.ToValidUTF8(stderrBuf.String(), "\uFFFD"))
+		if stderrStr == "" {
+			stderrStr = err.Error()
+		}
+		return stderrStr, err
+	}
+	if scanErr != nil {
+		return scanErr.Error(), fmt.Errorf("error reading output: %w", scanErr)
+	}
+	return "", fnErr
+}
+
+// queryEach runs a read-only command like query, calling fn with each
+// non-empty, trimmed line of its output. Unless the run is being recorded
+// or replayed, the output is streamed rather than buffered, and only
+// memoized if it is short.
+func (b *Backup) queryEach(fn func(line string) error, args ...string) (string, error) {
+	each := func(lines []string, stderr string, err error) (string, error) {
+		if err != nil {
+			return stderr, err
+		}
+		for _, l := range parseNames(lines) {
+			if err := fn(l); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+	if r, ok := b.memo.get(args); ok {
+		return each(r.stdout, r.stderr, r.err)
+	}
+	if b.replaying || b.recorder != nil {
+		return each(b.query(args...))
+	}
+
+	if b.debug {
+		b.logger.Info("exec", "cmd", quoteCommand(args))
+	}
+	if err := b.checkReadOnly([][]string{args}); err != nil {
+		return "", err
+	}
+	var lines []string
+	overflow := false
+	var fnErr error
+	stderr, err := execStream(b.newProcess(args), func(line string) error {
+		if !overflow {
+			if len(lines) < maxMemoLines {
+				lines = append(lines, line)
+			} else {
+				overflow, lines = true, nil
+			}
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			return nil
+		}
+		fnErr = fn(line)
+		return fnErr
+	})
+	if fnErr != nil {
+		return "", fnErr
+	}
+	if !overflow {
+		b.memo.put(memoResult{args: args, stdout: lines, stderr: stderr, err: err})
+	}
+	return stderr, err
+}
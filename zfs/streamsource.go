@@ -0,0 +1,70 @@
+package zfs
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// StreamSource produces the send streams that are replicated to a Target.
+// The planner sends through it, so other producers, such as archived
+// stream files, can feed the same pipelines.
+type StreamSource interface {
+	// ListSnapshots lists the snapshots of vol, oldest first, as vol@name.
+	ListSnapshots(vol string) ([]string, error)
+	// SendCommand returns the first stage of the send pipeline, writing
+	// the stream of endSnap, incremental from startSnap if set. startSnap
+	// may also be a bookmark, vol#name, where the source supports them.
+	SendCommand(startSnap, endSnap string) []string
+}
+
+// zfsSource sends with zfs send through the source command.
+type zfsSource struct {
+	b *Backup
+}
+
+func (s *zfsSource) ListSnapshots(vol string) ([]string, error) {
+	return s.b.listSnapshotsOn(false, vol)
+}
+
+func (s *zfsSource) SendCommand(startSnap, endSnap string) []string {
+	if startSnap != "" {
+		return s.b.buildCommand(false, "send", "-i", startSnap, endSnap)
+	}
+	return s.b.buildCommand(false, "send", endSnap)
+}
+
+// fileSource replays the stream files written by a file target in dir.
+// Only the increments that were archived can be sent: endSnap must have
+// been stored as a full stream, or as an incremental from startSnap.
+type fileSource struct {
+	fileTarget
+}
+
+// WithFileSourceOption reads archived send streams from the stream files
+// a file target wrote under dir, instead of sending with zfs. It is only
+// useful with Copy, since backups need a ZFS source to snapshot.
+func WithFileSourceOption(dir string) BackupOption {
+	return func(b *Backup) error {
+		if dir == "" {
+			return fmt.Errorf("file source directory cannot be empty")
+		}
+		b.producer = &fileSource{fileTarget{dir: dir}}
+		return nil
+	}
+}
+
+func (s *fileSource) SendCommand(startSnap, endSnap string) []string {
+	vol, _ := splitSnapshot(endSnap)
+	return []string{"cat", s.streamFile(vol, startSnap, endSnap)}
+}
+
+// streamFile returns the path of the stream of vol holding the snapshot
+// named like endSnap, incremental from the one named like startSnap if set.
+func (t *fileTarget) streamFile(vol, startSnap, endSnap string) string {
+	_, name := splitSnapshot(endSnap)
+	if startSnap != "" {
+		_, base := splitSnapshot(startSnap)
+		name += ".i-" + base
+	}
+	return filepath.Join(t.path(vol), name+streamSuffix)
+}
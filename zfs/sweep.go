@@ -0,0 +1,68 @@
+package zfs
+
+import (
+	"fmt"
+	"slices"
+)
+
+// WithSweepOrphansOption destroys orphaned source snapshots after each
+// successful replication: snapshots owned by this Backup that never
+// reached the target, typically left by failed runs. Without it they
+// would count towards retention and could push out the snapshots that
+// incremental backups depend on. Only snapshots taken since the last one
+// the target has are orphans, and the owner set with WithOwnerOption
+// must be specific to the target: snapshots of other targets sharing the
+// owner would look like orphans too.
+func WithSweepOrphansOption() BackupOption {
+	return func(b *Backup) error {
+		b.sweepOrphans = true
+		return nil
+	}
+}
+
+// findOrphans returns the owned backup snapshots of fs taken after the
+// latest one that also exists on targetVol, but missing from it,
+// excluding the current run's snapshot. Older snapshots missing from the
+// target were pruned there, and without a snapshot in common none of
+// them is known to be meant for this target.
+func (b *Backup) findOrphans(fs, targetVol, snapName string) ([]string, error) {
+	snaps, owned, err := b.listOwnedSnapshots(fs)
+	if err != nil {
+		return nil, err
+	}
+	targetSnaps, err := b.backend.ListSnapshots(targetVol)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	common := false
+	for _, snap := range snaps {
+		_, name := splitSnapshot(snap)
+		if !owned[snap] || !b.isBackupSnapshot(snap) || name == snapName {
+			continue
+		}
+		if slices.Contains(targetSnaps, fmt.Sprintf("%s@%s", targetVol, name)) {
+			common = true
+			orphans = nil
+			continue
+		}
+		orphans = append(orphans, snap)
+	}
+	if !common {
+		return nil, nil
+	}
+	return orphans, nil
+}
+
+// sweep destroys orphaned source snapshots of fs.
+func (b *Backup) sweep(fs, targetVol, snapName string) error {
+	orphans, err := b.findOrphans(fs, targetVol, snapName)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	b.logger.Warn("sweeping orphaned snapshots", "fs", fs, "snaps", orphans)
+	return b.deleteSnapshots(orphans, false)
+}
@@ -0,0 +1,66 @@
+package zfs
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFindOrphans(t *testing.T) {
+	tests := []struct {
+		name   string
+		source []string // snapshot names on the source, oldest first, all owned
+		target []string // snapshot names on the target
+		want   []string
+	}{
+		{
+			name:   "failed run",
+			source: []string{"2026-01-01T00:00:00", "2026-01-02T00:00:00", "2026-01-03T00:00:00"},
+			target: []string{"2026-01-01T00:00:00", "2026-01-03T00:00:00"},
+			want:   []string{"tank/data@2026-01-02T00:00:00"},
+		},
+		{
+			name:   "pruned by target retention",
+			source: []string{"2026-01-01T00:00:00", "2026-01-02T00:00:00", "2026-01-03T00:00:00", "2026-01-04T00:00:00"},
+			target: []string{"2026-01-03T00:00:00", "2026-01-04T00:00:00"},
+		},
+		{
+			name:   "no snapshot in common",
+			source: []string{"2026-01-01T00:00:00", "2026-01-02T00:00:00", "2026-01-03T00:00:00"},
+			target: []string{"2026-01-03T00:00:00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var owned, onTarget []string
+			for _, s := range tt.source {
+				owned = append(owned, "tank/data@"+s+"\toffsite")
+			}
+			for _, s := range tt.target {
+				onTarget = append(onTarget, "backup/tank/data@"+s)
+			}
+			b := newReplayBackup(t, "backup", []recordEntry{
+				{Cmds: [][]string{{"zfs", "list", "-H", "-o", "name,zfsbackup:owner", "-t", "snapshot", "-d", "1", "-s", "creation", "tank/data"}}, Stdout: owned},
+				{Cmds: [][]string{{"zfs", "list", "-H", "-o", "name", "-t", "snapshot", "-d", "1", "-s", "creation", "backup/tank/data"}}, Stdout: onTarget},
+			}, WithOwnerOption("offsite"))
+			current := tt.source[len(tt.source)-1]
+			got, err := b.findOrphans("tank/data", "backup/tank/data", current)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("orphans %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweepOrphansNeedsOwner(t *testing.T) {
+	_, err := NewBackup("backup", WithSweepOrphansOption())
+	if err == nil || !strings.Contains(err.Error(), "owner") {
+		t.Errorf("sweeping with the default owner: error %v, want one about the owner", err)
+	}
+	if _, err := NewBackup("backup", WithSweepOrphansOption(), WithOwnerOption("offsite")); err != nil {
+		t.Errorf("sweeping with a specific owner: %v", err)
+	}
+}
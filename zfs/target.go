@@ -0,0 +1,166 @@
+package zfs
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Target is where replicated streams end up. The planner only asks a
+// Target what it already has, how to receive a stream and how to prune;
+// everything else about the backend stays behind this interface.
+type Target interface {
+	// Exists reports whether vol has received anything yet.
+	Exists(vol string) (bool, error)
+	// ListSnapshots lists the snapshots of vol, oldest first, as vol@name.
+	ListSnapshots(vol string) ([]string, error)
+	// ReceiveCommand returns the last stage of the send pipeline, which
+	// stores the stream of endSnap, incremental from startSnap if set, as vol.
+	ReceiveCommand(vol, startSnap, endSnap string) []string
+	// Prune removes old snapshots of vol, keeping at least retain and
+	// never the snapshots named in keep.
+	Prune(vol string, retain int, keep []string, recurse bool) error
+}
+
+// zfsTarget receives into a ZFS filesystem with the target command.
+type zfsTarget struct {
+	b *Backup
+}
+
+func (t *zfsTarget) Exists(vol string) (bool, error) {
+	return t.b.datasetExistsOn(true, vol)
+}
+
+func (t *zfsTarget) ListSnapshots(vol string) ([]string, error) {
+	return t.b.listSnapshotsOn(true, vol)
+}
+
+func (t *zfsTarget) ReceiveCommand(vol, startSnap, endSnap string) []string {
+	args := []string{"receive", "-F"}
+	if t.b.targetReadonly {
+		args = append(args, "-o", "readonly=on")
+	}
+	return t.b.buildCommand(true, append(args, vol)...)
+}
+
+func (t *zfsTarget) Prune(vol string, retain int, keep []string, recurse bool) error {
+	return t.b.cleanSnapshots(vol, retain, keep, recurse)
+}
+
+// WithFileTargetOption stores send streams as files under dir instead of
+// receiving them into a ZFS filesystem, e.g. on a NAS without ZFS. The
+// streams of target/fs are kept in dir/target/fs as <snapshot>.zfs for a
+// full send and <snapshot>.i-<base>.zfs for an incremental one. Restoring
+// means receiving the full stream and then every incremental in order, so
+// the files are never pruned. Options that need a ZFS target can't be
+// combined with it.
+func WithFileTargetOption(dir string) BackupOption {
+	return func(b *Backup) error {
+		if dir == "" {
+			return fmt.Errorf("file target directory cannot be empty")
+		}
+		b.backend = &fileTarget{dir: dir}
+		return nil
+	}
+}
+
+// fileTarget stores send streams as files in a local directory.
+type fileTarget struct {
+	dir string
+}
+
+const streamSuffix = ".zfs"
+
+func (t *fileTarget) path(vol string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(vol))
+}
+
+func (t *fileTarget) Exists(vol string) (bool, error) {
+	_, err := os.Stat(t.path(vol))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (t *fileTarget) ListSnapshots(vol string) ([]string, error) {
+	entries, err := os.ReadDir(t.path(vol))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	type stream struct {
+		name string
+		info fs.FileInfo
+	}
+	var streams []stream
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), streamSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		name, _, _ = strings.Cut(name, ".i-")
+		streams = append(streams, stream{name, info})
+	}
+	slices.SortFunc(streams, func(x, y stream) int {
+		return cmp.Or(x.info.ModTime().Compare(y.info.ModTime()), strings.Compare(x.name, y.name))
+	})
+	snaps := make([]string, len(streams))
+	for i, s := range streams {
+		snaps[i] = vol + "@" + s.name
+	}
+	return snaps, nil
+}
+
+// ReceiveCommand writes the stream to a temporary file and renames it
+// into place once complete, so an interrupted send leaves no stream that
+// looks usable.
+func (t *fileTarget) ReceiveCommand(vol, startSnap, endSnap string) []string {
+	file := t.streamFile(vol, startSnap, endSnap)
+	return []string{"sh", "-c", `mkdir -p "$(dirname "$1")" && cat >"$1.part" && mv "$1.part" "$1"`, "sh", file}
+}
+
+func (t *fileTarget) Prune(vol string, retain int, keep []string, recurse bool) error {
+	return nil
+}
+
+// zfsTargetOnly lists the options set on b that need a ZFS target.
+func (b *Backup) zfsTargetOnly() []string {
+	var opts []string
+	for _, o := range []struct {
+		set  bool
+		name string
+	}{
+		{b.unmount, "unmount target"},
+		{b.targetReadonly, "target readonly"},
+		{b.holdTarget, "hold target"},
+		{b.checkDrift, "drift check"},
+		{b.divergence != DivergenceIgnore, "divergence check"},
+		{b.hostNamespace != "", "host namespace"},
+		{b.smartCheck != SmartOff, "SMART check"},
+		{b.checkPoolErrors, "pool error check"},
+		{b.rootCheck != RootAllow, "root check"},
+		{b.sshTarget != nil, "target host"},
+	} {
+		if o.set {
+			opts = append(opts, o.name)
+		}
+	}
+	return opts
+}
+
+// isZFSTarget reports whether the target is a ZFS filesystem.
+func (b *Backup) isZFSTarget() bool {
+	_, ok := b.backend.(*zfsTarget)
+	return ok
+}
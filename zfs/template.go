@@ -0,0 +1,84 @@
+package zfs
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateVars are the variables that can be used in the target
+// filesystem, the snapshot prefix and hook commands, e.g.
+// "backup/{{.Hostname}}" or "{{.Job}}-".
+type templateVars struct {
+	Hostname string // short hostname
+	Date     string // day the run started, as 2006-01-02; hooks only
+	Job      string // name of the config file job, empty otherwise
+}
+
+// WithJobOption sets the job name available as {{.Job}} in templates and
+// adds it to every log line.
+func WithJobOption(name string) BackupOption {
+	return func(b *Backup) error {
+		b.job = name
+		return nil
+	}
+}
+
+// expandTemplates resolves the template variables in every setting that
+// accepts them. NewBackup calls it once, so they are resolved per run.
+// The target filesystem and snapshot prefix must come out the same every
+// run, since snapshots are matched against them later: {{.Date}} would
+// start a new full backup every day and orphan the snapshots of earlier
+// days.
+func (b *Backup) expandTemplates() error {
+	b.preSnapshot = slices.Clone(b.preSnapshot)
+	b.postSnapshot = slices.Clone(b.postSnapshot)
+	type setting struct {
+		value  *string
+		what   string
+		stable bool // must not depend on the date
+	}
+	settings := []setting{{&b.target, "target filesystem", true}, {&b.snapshotPrefix, "snapshot prefix", true}}
+	for i := range b.preSnapshot {
+		settings = append(settings, setting{&b.preSnapshot[i], "pre-snapshot hook", false})
+	}
+	for i := range b.postSnapshot {
+		settings = append(settings, setting{&b.postSnapshot[i], "post-snapshot hook", false})
+	}
+
+	var vars *templateVars
+	for _, s := range settings {
+		if !strings.Contains(*s.value, "{{") {
+			continue
+		}
+		if vars == nil {
+			host, err := os.Hostname()
+			if err != nil {
+				return fmt.Errorf("error getting hostname: %w", err)
+			}
+			host, _, _ = strings.Cut(host, ".")
+			vars = &templateVars{Hostname: host, Date: time.Now().Format("2006-01-02"), Job: b.job}
+		}
+		tmpl, err := template.New(s.what).Option("missingkey=error").Parse(*s.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s template: %w", s.what, err)
+		}
+		var out strings.Builder
+		if err := tmpl.Execute(&out, vars); err != nil {
+			return fmt.Errorf("invalid %s template: %w", s.what, err)
+		}
+		if s.stable {
+			other := *vars
+			other.Date = "0001-01-01"
+			var otherOut strings.Builder
+			if err := tmpl.Execute(&otherOut, &other); err != nil || otherOut.String() != out.String() {
+				return fmt.Errorf("invalid %s template: it can't use {{.Date}}, since it must be the same every run", s.what)
+			}
+		}
+		*s.value = out.String()
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package zfs
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplates(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skipf("no hostname: %v", err)
+	}
+	host, _, _ = strings.Cut(host, ".")
+	b, err := NewBackup("backup/{{.Hostname}}", WithJobOption("daily"), WithSnapshotPrefixOption("{{.Job}}-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "backup/" + host; b.target != want {
+		t.Errorf("target = %q, want %q", b.target, want)
+	}
+	if b.snapshotPrefix != "daily-" {
+		t.Errorf("snapshot prefix = %q, want %q", b.snapshotPrefix, "daily-")
+	}
+	for _, target := range []string{"backup/{{.Nope}}", "backup/{{.Hostname"} {
+		if _, err := NewBackup(target); err == nil {
+			t.Errorf("target %q: no error, want an invalid template", target)
+		}
+	}
+}
+
+func TestExpandTemplatesDate(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		opts    []BackupOption
+		wantErr bool
+	}{
+		{"hostname in target", "backup/{{.Hostname}}", nil, false},
+		{"job in prefix", "backup", []BackupOption{WithJobOption("daily"), WithSnapshotPrefixOption("{{.Job}}-")}, false},
+		{"date in hook", "backup", []BackupOption{WithSnapshotHooksOption([]string{"logger {{.Date}}"}, nil, time.Minute)}, false},
+		{"date in target", "backup/{{.Date}}", nil, true},
+		{"date in prefix", "backup", []BackupOption{WithSnapshotPrefixOption("{{.Date}}-")}, true},
+		{"date that doesn't change the prefix", "backup", []BackupOption{WithSnapshotPrefixOption(`{{if .Date}}x-{{end}}`)}, false},
+		{"date in prefix expression", "backup", []BackupOption{WithSnapshotPrefixOption(`{{slice .Date 0 4}}-`)}, true},
+	}
+	for _, tt := range tests {
+		_, err := NewBackup(tt.target, tt.opts...)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// TestSnapshotTimeAcrossDays checks that snapshots taken on earlier days
+// still match the prefix, so they are counted and pruned.
+func TestSnapshotTimeAcrossDays(t *testing.T) {
+	b, err := NewBackup("backup", WithJobOption("daily"), WithSnapshotPrefixOption("{{.Job}}-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, snap := range []string{"tank/data@daily-2026-01-01T00:00:00", "tank/data@daily-2026-03-29T01:30:00"} {
+		if _, ok := b.snapshotTime(snap); !ok {
+			t.Errorf("snapshot %s of an earlier day doesn't match", snap)
+		}
+	}
+}